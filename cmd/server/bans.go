@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/xflash-panda/server-vmess/internal/pkg/admin"
+	"github.com/xflash-panda/server-vmess/internal/pkg/reputation"
+)
+
+func adminSocketFlag(destination *string, required bool) *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:        "admin_socket",
+		Usage:       "Unix socket of the local admin interface",
+		EnvVars:     []string{"X_PANDA_VMESS_ADMIN_SOCKET", "ADMIN_SOCKET"},
+		Required:    required,
+		Destination: destination,
+	}
+}
+
+// bansCommand lists and clears the sources banned for failing the handshake
+func bansCommand() *cli.Command {
+	var socket string
+	var ip string
+	return &cli.Command{
+		Name:  "bans",
+		Usage: "List or clear the banned source addresses of a running node",
+		Flags: []cli.Flag{adminSocketFlag(&socket, true)},
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "List the banned source addresses",
+				Action: func(c *cli.Context) error {
+					var bans []reputation.Ban
+					if err := admin.NewClient(socket).Do(http.MethodGet, "/bans", nil, &bans); err != nil {
+						return err
+					}
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "IP\tUNTIL\tLEVEL")
+					for _, ban := range bans {
+						fmt.Fprintf(w, "%s\t%s\t%d\n", ban.IP, ban.Until.Format(time.RFC3339), ban.Level)
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:  "clear",
+				Usage: "Lift the ban of an address, or every ban without --ip",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "ip",
+						Usage:       "Source address to clear",
+						Required:    false,
+						Destination: &ip,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					var resp struct {
+						Cleared int `json:"cleared"`
+					}
+					query := url.Values{}
+					if ip != "" {
+						query.Set("ip", ip)
+					}
+					if err := admin.NewClient(socket).Do(http.MethodDelete, "/bans", query, &resp); err != nil {
+						return err
+					}
+					fmt.Printf("%d sources cleared\n", resp.Cleared)
+					return nil
+				},
+			},
+		},
+	}
+}
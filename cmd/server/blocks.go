@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/xflash-panda/server-vmess/internal/pkg/admin"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+)
+
+// blocksCommand blocks and unblocks users on a running node without waiting for the panel
+func blocksCommand() *cli.Command {
+	var socket string
+	var uid int
+	var duration time.Duration
+	var reason string
+	userFlag := &cli.IntFlag{
+		Name:        "user_id",
+		Usage:       "ID of the user",
+		Required:    true,
+		Destination: &uid,
+	}
+	return &cli.Command{
+		Name:  "blocks",
+		Usage: "Block, unblock or list the blocked users of a running node",
+		Flags: []cli.Flag{adminSocketFlag(&socket, true)},
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "List the blocked users",
+				Action: func(c *cli.Context) error {
+					var blocks []service.Block
+					if err := admin.NewClient(socket).Do(http.MethodGet, "/blocks", nil, &blocks); err != nil {
+						return err
+					}
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "USER\tSINCE\tUNTIL\tREASON")
+					for _, block := range blocks {
+						until := "-"
+						if !block.Until.IsZero() {
+							until = block.Until.Format(time.RFC3339)
+						}
+						fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", block.UID, block.Since.Format(time.RFC3339), until, block.Reason)
+					}
+					return w.Flush()
+				},
+			},
+			{
+				Name:  "add",
+				Usage: "Remove a user from the node and interrupt its connections, whatever the panel returns",
+				Flags: []cli.Flag{
+					userFlag,
+					&cli.DurationFlag{
+						Name:        "duration",
+						Usage:       "How long the user is blocked, until it is cleared if 0",
+						Required:    false,
+						Destination: &duration,
+					},
+					&cli.StringFlag{
+						Name:        "reason",
+						Usage:       "Note kept with the block",
+						Required:    false,
+						Destination: &reason,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					query := url.Values{"user_id": {strconv.Itoa(uid)}}
+					if duration > 0 {
+						query.Set("duration", duration.String())
+					}
+					if reason != "" {
+						query.Set("reason", reason)
+					}
+					var block service.Block
+					if err := admin.NewClient(socket).Do(http.MethodPost, "/blocks", query, &block); err != nil {
+						return err
+					}
+					if block.Until.IsZero() {
+						fmt.Printf("user %d blocked until cleared\n", block.UID)
+					} else {
+						fmt.Printf("user %d blocked until %s\n", block.UID, block.Until.Format(time.RFC3339))
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "clear",
+				Usage: "Lift the block of a user, it is added back if the panel still returns it",
+				Flags: []cli.Flag{userFlag},
+				Action: func(c *cli.Context) error {
+					var resp struct {
+						Lifted bool `json:"lifted"`
+					}
+					query := url.Values{"user_id": {strconv.Itoa(uid)}}
+					if err := admin.NewClient(socket).Do(http.MethodDelete, "/blocks", query, &resp); err != nil {
+						return err
+					}
+					if !resp.Lifted {
+						fmt.Printf("user %d is not blocked\n", uid)
+						return nil
+					}
+					fmt.Printf("user %d unblocked\n", uid)
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/xflash-panda/server-vmess/internal/pkg/accesslog"
+)
+
+// lookupCommand answers abuse complaints: which user connected to a destination at a given time
+func lookupCommand() *cli.Command {
+	var (
+		dir       string
+		at        string
+		window    time.Duration
+		address   string
+		port      int
+		localPort int
+	)
+	return &cli.Command{
+		Name:  "lookup",
+		Usage: "Search the connection log for the users of a destination",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "conn_log_dir",
+				Usage:       "Connection log directory",
+				EnvVars:     []string{"X_PANDA_VMESS_CONN_LOG_DIR", "CONN_LOG_DIR"},
+				Required:    true,
+				Destination: &dir,
+			},
+			&cli.StringFlag{
+				Name:        "dest",
+				Usage:       "Destination ip or domain",
+				Required:    false,
+				Destination: &address,
+			},
+			&cli.IntFlag{
+				Name:        "port",
+				Usage:       "Destination port, 0 for any",
+				Required:    false,
+				Destination: &port,
+			},
+			&cli.IntFlag{
+				Name:        "source_port",
+				Usage:       "Source port of the node side connection, 0 for any",
+				Required:    false,
+				Destination: &localPort,
+			},
+			&cli.StringFlag{
+				Name:        "time",
+				Usage:       "Time of the complaint, RFC3339",
+				Required:    true,
+				Destination: &at,
+			},
+			&cli.DurationFlag{
+				Name:        "window",
+				Usage:       "Tolerance around the time",
+				Value:       time.Minute * 5,
+				DefaultText: "5m",
+				Required:    false,
+				Destination: &window,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			t, err := time.Parse(time.RFC3339, at)
+			if err != nil {
+				return fmt.Errorf("invalid time %s: %s", at, err)
+			}
+			if address == "" && port == 0 {
+				return fmt.Errorf("one of dest or port is required")
+			}
+			query := &accesslog.Query{
+				Address:   address,
+				Port:      uint16(port),
+				LocalPort: uint16(localPort),
+				From:      t.Add(-window),
+				To:        t.Add(window),
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "USER\tSTART\tEND\tSOURCE\tDESTINATION\tREMOTE\tLOCAL\tUP\tDOWN")
+			matched := 0
+			err = accesslog.Lookup(dir, query, func(r *accesslog.Record) {
+				matched++
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", r.UserID,
+					r.Start.Format(time.RFC3339), r.Time.Format(time.RFC3339), r.Source,
+					r.Destination, r.Remote, r.Local, r.Upload, r.Download)
+			})
+			if err != nil {
+				return err
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			fmt.Printf("%d connections matched\n", matched)
+			return nil
+		},
+	}
+}
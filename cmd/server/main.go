@@ -6,8 +6,19 @@ import (
 	"github.com/urfave/cli/v2"
 	api "github.com/xflash-panda/server-client/pkg"
 	"github.com/xflash-panda/server-vmess/internal/app/server"
+	"github.com/xflash-panda/server-vmess/internal/pkg/accesslog"
+	"github.com/xflash-panda/server-vmess/internal/pkg/backend"
+	"github.com/xflash-panda/server-vmess/internal/pkg/cert"
+	"github.com/xflash-panda/server-vmess/internal/pkg/connlimit"
+	"github.com/xflash-panda/server-vmess/internal/pkg/decoy"
+	"github.com/xflash-panda/server-vmess/internal/pkg/egress"
+	"github.com/xflash-panda/server-vmess/internal/pkg/reputation"
 	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+	"github.com/xflash-panda/server-vmess/internal/pkg/sockopt"
+	"github.com/xflash-panda/server-vmess/internal/pkg/transfer"
+	"github.com/xflash-panda/server-vmess/internal/pkg/webhook"
 	"github.com/xtls/xray-core/core"
+	"golang.org/x/crypto/acme/autocert"
 	"io"
 	"os"
 	"os/signal"
@@ -40,6 +51,15 @@ func main() {
 	var apiConfig api.Config
 	var serviceConfig service.Config
 	var certConfig service.CertConfig
+	var accessLogConfig accesslog.Config
+	var reputationConfig reputation.Config
+	var egressConfig egress.Config
+	var acmeConfig cert.ACMEConfig
+	var sockoptConfig sockopt.Config
+	var decoyConfig decoy.Config
+	var webhookConfig webhook.Config
+	var transferConfig transfer.Config
+	var connLimitConfig connlimit.Config
 
 	app := &cli.App{
 		Name:      Name,
@@ -49,18 +69,40 @@ func main() {
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:        "api",
-				Usage:       "Server address",
+				Usage:       "Server address, a comma separated list of the addresses of the same panel to fail over between them",
 				EnvVars:     []string{"X_PANDA_VMESS_API", "API"},
-				Required:    true,
+				Required:    false,
 				Destination: &apiConfig.APIHost,
 			},
 			&cli.StringFlag{
 				Name:        "token",
 				Usage:       "Token of server API",
 				EnvVars:     []string{"X_PANDA_VMESS_TOKEN", "TOKEN"},
-				Required:    true,
+				Required:    false,
 				Destination: &apiConfig.Token,
 			},
+			&cli.StringFlag{
+				Name:        "backend",
+				Usage:       "Kind of the panel at api, v2board, sspanel for the mod_mu API of SSPanel-UIM or rest for plain json resources",
+				EnvVars:     []string{"X_PANDA_VMESS_BACKEND", "BACKEND"},
+				Value:       backend.KindV2board,
+				Required:    false,
+				Destination: &config.Backend,
+			},
+			&cli.StringFlag{
+				Name:        "standalone",
+				Usage:       "YAML or JSON file the node and its users are read from instead of the panel, reloaded on change",
+				EnvVars:     []string{"X_PANDA_VMESS_STANDALONE", "STANDALONE"},
+				Required:    false,
+				Destination: &config.Standalone,
+			},
+			&cli.StringFlag{
+				Name:        "ledger",
+				Usage:       "File the traffic is appended to in standalone mode, ledger.jsonl in state_dir by default",
+				EnvVars:     []string{"X_PANDA_VMESS_LEDGER", "LEDGER"},
+				Required:    false,
+				Destination: &config.Ledger,
+			},
 
 			&cli.StringFlag{
 				Name:        "cert_file",
@@ -84,7 +126,7 @@ func main() {
 				Name:        "node",
 				Usage:       "Node ID",
 				EnvVars:     []string{"X_PANDA_VMESS_NODE", "NODE"},
-				Required:    true,
+				Required:    false,
 				Destination: &serviceConfig.NodeID,
 			},
 			&cli.DurationFlag{
@@ -113,6 +155,438 @@ func main() {
 				Destination: &config.LogLevel,
 				Required:    false,
 			},
+			&cli.StringFlag{
+				Name:        "access_log",
+				Usage:       "Access log file path, or syslog, empty to disable",
+				EnvVars:     []string{"X_PANDA_VMESS_ACCESS_LOG", "ACCESS_LOG"},
+				Required:    false,
+				Destination: &accessLogConfig.Target,
+			},
+			&cli.IntFlag{
+				Name:        "access_log_max_size",
+				Usage:       "Access log file size before rotation, unit: MB",
+				EnvVars:     []string{"X_PANDA_VMESS_ACCESS_LOG_MAX_SIZE", "ACCESS_LOG_MAX_SIZE"},
+				Value:       100,
+				DefaultText: "100",
+				Required:    false,
+				Destination: &accessLogConfig.MaxSize,
+			},
+			&cli.IntFlag{
+				Name:        "access_log_max_backups",
+				Usage:       "Rotated access log files to keep",
+				EnvVars:     []string{"X_PANDA_VMESS_ACCESS_LOG_MAX_BACKUPS", "ACCESS_LOG_MAX_BACKUPS"},
+				Value:       7,
+				DefaultText: "7",
+				Required:    false,
+				Destination: &accessLogConfig.MaxBackups,
+			},
+			&cli.BoolFlag{
+				Name:        "access_log_hash_ip",
+				Usage:       "Write a keyed hash instead of the source ip to the access log",
+				EnvVars:     []string{"X_PANDA_VMESS_ACCESS_LOG_HASH_IP", "ACCESS_LOG_HASH_IP"},
+				Required:    false,
+				Destination: &accessLogConfig.HashIP,
+			},
+			&cli.StringFlag{
+				Name:        "access_log_hash_salt",
+				Usage:       "Secret key of the source ip hash",
+				EnvVars:     []string{"X_PANDA_VMESS_ACCESS_LOG_HASH_SALT", "ACCESS_LOG_HASH_SALT"},
+				Required:    false,
+				Destination: &accessLogConfig.HashSalt,
+			},
+			&cli.StringFlag{
+				Name:        "conn_log_dir",
+				Usage:       "Directory of the connection log used by lookup, empty to disable",
+				EnvVars:     []string{"X_PANDA_VMESS_CONN_LOG_DIR", "CONN_LOG_DIR"},
+				Required:    false,
+				Destination: &accessLogConfig.StoreDir,
+			},
+			&cli.DurationFlag{
+				Name:        "conn_log_retention",
+				Usage:       "How long the connection log is kept",
+				EnvVars:     []string{"X_PANDA_VMESS_CONN_LOG_RETENTION", "CONN_LOG_RETENTION"},
+				Value:       time.Hour * 24 * 30,
+				DefaultText: "720h",
+				Required:    false,
+				Destination: &accessLogConfig.Retention,
+			},
+			&cli.IntFlag{
+				Name:        "ban_threshold",
+				Usage:       "Handshake failures of a source within ban_window before it is banned, 0 to disable",
+				EnvVars:     []string{"X_PANDA_VMESS_BAN_THRESHOLD", "BAN_THRESHOLD"},
+				Value:       10,
+				DefaultText: "10",
+				Required:    false,
+				Destination: &reputationConfig.Threshold,
+			},
+			&cli.DurationFlag{
+				Name:        "ban_window",
+				Usage:       "Period in which handshake failures are counted",
+				EnvVars:     []string{"X_PANDA_VMESS_BAN_WINDOW", "BAN_WINDOW"},
+				Value:       time.Minute * 5,
+				DefaultText: "5m",
+				Required:    false,
+				Destination: &reputationConfig.Window,
+			},
+			&cli.DurationFlag{
+				Name:        "ban_duration",
+				Usage:       "First ban of a source, doubled on every repeated ban",
+				EnvVars:     []string{"X_PANDA_VMESS_BAN_DURATION", "BAN_DURATION"},
+				Value:       time.Minute * 10,
+				DefaultText: "10m",
+				Required:    false,
+				Destination: &reputationConfig.BanDuration,
+			},
+			&cli.DurationFlag{
+				Name:        "ban_max_duration",
+				Usage:       "Longest ban of a source",
+				EnvVars:     []string{"X_PANDA_VMESS_BAN_MAX_DURATION", "BAN_MAX_DURATION"},
+				Value:       time.Hour * 24,
+				DefaultText: "24h",
+				Required:    false,
+				Destination: &reputationConfig.MaxBanDuration,
+			},
+			&cli.StringFlag{
+				Name:        "allow_cidr_file",
+				Usage:       "File of networks which are never banned, one per line",
+				EnvVars:     []string{"X_PANDA_VMESS_ALLOW_CIDR_FILE", "ALLOW_CIDR_FILE"},
+				Required:    false,
+				Destination: &reputationConfig.AllowFile,
+			},
+			&cli.StringFlag{
+				Name:        "deny_cidr_file",
+				Usage:       "File of networks which are always rejected, one per line",
+				EnvVars:     []string{"X_PANDA_VMESS_DENY_CIDR_FILE", "DENY_CIDR_FILE"},
+				Required:    false,
+				Destination: &reputationConfig.DenyFile,
+			},
+			&cli.BoolFlag{
+				Name:        "egress_guard",
+				Usage:       "Block user connections to private, loopback and link-local networks and the node itself",
+				EnvVars:     []string{"X_PANDA_VMESS_EGRESS_GUARD", "EGRESS_GUARD"},
+				Value:       true,
+				DefaultText: "true",
+				Required:    false,
+				Destination: &egressConfig.Enabled,
+			},
+			&cli.StringFlag{
+				Name:        "egress_allow",
+				Usage:       "Networks or addresses exempted from the egress guard, comma separated",
+				EnvVars:     []string{"X_PANDA_VMESS_EGRESS_ALLOW", "EGRESS_ALLOW"},
+				Required:    false,
+				Destination: &egressConfig.Allow,
+			},
+			&cli.BoolFlag{
+				Name:        "traffic_breakdown",
+				Usage:       "Report the traffic of the users by protocol class and network besides their totals",
+				EnvVars:     []string{"X_PANDA_VMESS_TRAFFIC_BREAKDOWN", "TRAFFIC_BREAKDOWN"},
+				Value:       false,
+				DefaultText: "false",
+				Required:    false,
+				Destination: &serviceConfig.TrafficBreakdown,
+			},
+			&cli.DurationFlag{
+				Name:        "status_interval",
+				Usage:       "How often the node status and the users online are reported to the panel, 0 to disable it",
+				EnvVars:     []string{"X_PANDA_VMESS_STATUS_INTERVAL", "STATUS_INTERVAL"},
+				Value:       time.Minute,
+				Required:    false,
+				Destination: &config.StatusInterval,
+			},
+			&cli.IntFlag{
+				Name:        "transfer_cap",
+				Usage:       "Bytes the node may transfer in a month, inbounds and outbounds in both directions, unit: GB, 0 for no cap",
+				EnvVars:     []string{"X_PANDA_VMESS_TRANSFER_CAP", "TRANSFER_CAP"},
+				Value:       0,
+				DefaultText: "0",
+				Required:    false,
+				Destination: &transferConfig.Cap,
+			},
+			&cli.IntFlag{
+				Name:        "transfer_reset_day",
+				Usage:       "Day of the month the transfer is reset on, 1 to 28",
+				EnvVars:     []string{"X_PANDA_VMESS_TRANSFER_RESET_DAY", "TRANSFER_RESET_DAY"},
+				Value:       1,
+				DefaultText: "1",
+				Required:    false,
+				Destination: &transferConfig.ResetDay,
+			},
+			&cli.StringFlag{
+				Name:        "transfer_cap_action",
+				Usage:       "What the node does once the transfer cap is reached, alert, stop (refuse new connections) or throttle",
+				EnvVars:     []string{"X_PANDA_VMESS_TRANSFER_CAP_ACTION", "TRANSFER_CAP_ACTION"},
+				Value:       transfer.ActionAlert,
+				Required:    false,
+				Destination: &transferConfig.Action,
+			},
+			&cli.IntFlag{
+				Name:        "transfer_throttle_rate",
+				Usage:       "Rate of the whole node once throttled, unit: KB/s",
+				EnvVars:     []string{"X_PANDA_VMESS_TRANSFER_THROTTLE_RATE", "TRANSFER_THROTTLE_RATE"},
+				Value:       1024,
+				DefaultText: "1024",
+				Required:    false,
+				Destination: &transferConfig.ThrottleRate,
+			},
+			&cli.IntFlag{
+				Name:        "user_conn_limit",
+				Usage:       "Connections a user may have at once, unless the panel sets it for the user, 0 for no limit",
+				EnvVars:     []string{"X_PANDA_VMESS_USER_CONN_LIMIT", "USER_CONN_LIMIT"},
+				Value:       0,
+				DefaultText: "0",
+				Required:    false,
+				Destination: &connLimitConfig.Links,
+			},
+			&cli.IntFlag{
+				Name:        "user_conn_rate",
+				Usage:       "New connections a user may open a second, unless the panel sets it for the user, 0 for no limit",
+				EnvVars:     []string{"X_PANDA_VMESS_USER_CONN_RATE", "USER_CONN_RATE"},
+				Value:       0,
+				DefaultText: "0",
+				Required:    false,
+				Destination: &connLimitConfig.Rate,
+			},
+			&cli.StringFlag{
+				Name:        "webhook",
+				Usage:       "Address the panel pushes the user changes to, signed with the token, like :8443, raise fetch_users_interval as the polling only reconciles then",
+				EnvVars:     []string{"X_PANDA_VMESS_WEBHOOK", "WEBHOOK"},
+				Required:    false,
+				Destination: &webhookConfig.Listen,
+			},
+			&cli.StringFlag{
+				Name:        "webhook_cert_file",
+				Usage:       "Cert file to serve the webhook over tls",
+				EnvVars:     []string{"X_PANDA_VMESS_WEBHOOK_CERT_FILE", "WEBHOOK_CERT_FILE"},
+				Required:    false,
+				Destination: &webhookConfig.CertFile,
+			},
+			&cli.StringFlag{
+				Name:        "webhook_key_file",
+				Usage:       "Key file to serve the webhook over tls",
+				EnvVars:     []string{"X_PANDA_VMESS_WEBHOOK_KEY_FILE", "WEBHOOK_KEY_FILE"},
+				Required:    false,
+				Destination: &webhookConfig.KeyFile,
+			},
+			&cli.StringFlag{
+				Name:        "decoy_dir",
+				Usage:       "Directory of a static site served on the ws, h2 and grpc inbounds to the requests which are not for the proxy",
+				EnvVars:     []string{"X_PANDA_VMESS_DECOY_DIR", "DECOY_DIR"},
+				Required:    false,
+				Destination: &decoyConfig.Dir,
+			},
+			&cli.StringFlag{
+				Name:        "decoy_upstream",
+				Usage:       "Local web server the requests which are not for the proxy are passed to instead, like http://127.0.0.1:8080",
+				EnvVars:     []string{"X_PANDA_VMESS_DECOY_UPSTREAM", "DECOY_UPSTREAM"},
+				Required:    false,
+				Destination: &decoyConfig.Upstream,
+			},
+			&cli.BoolFlag{
+				Name:        "proxy_protocol",
+				Usage:       "Accept the PROXY protocol on the tcp or ws inbound on server_port, from the proxy_protocol_trusted sources only",
+				EnvVars:     []string{"X_PANDA_VMESS_PROXY_PROTOCOL", "PROXY_PROTOCOL"},
+				Value:       false,
+				DefaultText: "false",
+				Required:    false,
+				Destination: &serviceConfig.ProxyProtocol,
+			},
+			&cli.StringFlag{
+				Name:        "proxy_protocol_trusted",
+				Usage:       "Networks or addresses of the load balancers allowed to send the PROXY protocol, comma separated",
+				EnvVars:     []string{"X_PANDA_VMESS_PROXY_PROTOCOL_TRUSTED", "PROXY_PROTOCOL_TRUSTED"},
+				Required:    false,
+				Destination: &config.ProxyProtocolTrusted,
+			},
+			&cli.StringFlag{
+				Name:        "extra_ports",
+				Usage:       "Ports the inbound listens on besides server_port, like 8443,20000-20100",
+				EnvVars:     []string{"X_PANDA_VMESS_EXTRA_PORTS", "EXTRA_PORTS"},
+				Required:    false,
+				Destination: &serviceConfig.ExtraPorts,
+			},
+			&cli.StringFlag{
+				Name:        "listen",
+				Usage:       "Address the inbound listens on, all addresses by default",
+				EnvVars:     []string{"X_PANDA_VMESS_LISTEN", "LISTEN"},
+				Required:    false,
+				Destination: &sockoptConfig.Listen,
+			},
+			&cli.StringFlag{
+				Name:        "listen_interface",
+				Usage:       "Interface the inbound is bound to",
+				EnvVars:     []string{"X_PANDA_VMESS_LISTEN_INTERFACE", "LISTEN_INTERFACE"},
+				Required:    false,
+				Destination: &sockoptConfig.ListenInterface,
+			},
+			&cli.StringFlag{
+				Name:        "outbound_interface",
+				Usage:       "Interface the outbound connections are sent from",
+				EnvVars:     []string{"X_PANDA_VMESS_OUTBOUND_INTERFACE", "OUTBOUND_INTERFACE"},
+				Required:    false,
+				Destination: &sockoptConfig.OutboundInterface,
+			},
+			&cli.BoolFlag{
+				Name:        "tcp_fast_open",
+				Usage:       "Enable TCP Fast Open on the inbound and the outbound",
+				EnvVars:     []string{"X_PANDA_VMESS_TCP_FAST_OPEN", "TCP_FAST_OPEN"},
+				Value:       false,
+				DefaultText: "false",
+				Required:    false,
+				Destination: &sockoptConfig.TCPFastOpen,
+			},
+			&cli.DurationFlag{
+				Name:        "tcp_keepalive_idle",
+				Usage:       "Idle time before the first TCP keepalive probe, the kernel default when 0",
+				EnvVars:     []string{"X_PANDA_VMESS_TCP_KEEPALIVE_IDLE", "TCP_KEEPALIVE_IDLE"},
+				Required:    false,
+				Destination: &sockoptConfig.KeepAliveIdle,
+			},
+			&cli.DurationFlag{
+				Name:        "tcp_keepalive_interval",
+				Usage:       "Interval of the TCP keepalive probes, the kernel default when 0",
+				EnvVars:     []string{"X_PANDA_VMESS_TCP_KEEPALIVE_INTERVAL", "TCP_KEEPALIVE_INTERVAL"},
+				Required:    false,
+				Destination: &sockoptConfig.KeepAliveInterval,
+			},
+			&cli.DurationFlag{
+				Name:        "tcp_user_timeout",
+				Usage:       "TCP_USER_TIMEOUT of the sockets, the kernel default when 0",
+				EnvVars:     []string{"X_PANDA_VMESS_TCP_USER_TIMEOUT", "TCP_USER_TIMEOUT"},
+				Required:    false,
+				Destination: &sockoptConfig.UserTimeout,
+			},
+			&cli.StringFlag{
+				Name:        "tcp_congestion",
+				Usage:       "TCP congestion control of the sockets, e.g. bbr",
+				EnvVars:     []string{"X_PANDA_VMESS_TCP_CONGESTION", "TCP_CONGESTION"},
+				Required:    false,
+				Destination: &sockoptConfig.Congestion,
+			},
+			&cli.IntFlag{
+				Name:        "so_mark",
+				Usage:       "SO_MARK of the sockets, for policy routing",
+				EnvVars:     []string{"X_PANDA_VMESS_SO_MARK", "SO_MARK"},
+				Required:    false,
+				Destination: &sockoptConfig.Mark,
+			},
+			adminSocketFlag(&config.AdminSocket, false),
+			&cli.StringFlag{
+				Name:        "state_dir",
+				Usage:       "Directory of the state kept across restarts",
+				EnvVars:     []string{"X_PANDA_VMESS_STATE_DIR", "STATE_DIR"},
+				Value:       "/var/lib/vmess-node",
+				Required:    false,
+				Destination: &config.StateDir,
+			},
+			&cli.DurationFlag{
+				Name:        "cert_check_interval",
+				Usage:       "How often the certificate files are checked for a renewal, besides the file events and SIGHUP",
+				EnvVars:     []string{"X_PANDA_VMESS_CERT_CHECK_INTERVAL", "CERT_CHECK_INTERVAL"},
+				Value:       time.Minute,
+				Required:    false,
+				Destination: &config.CertCheckInterval,
+			},
+			&cli.DurationFlag{
+				Name:        "panel_cert_interval",
+				Usage:       "How often the node config is fetched for a certificate rotated by the panel, besides SIGHUP",
+				EnvVars:     []string{"X_PANDA_VMESS_PANEL_CERT_INTERVAL", "PANEL_CERT_INTERVAL"},
+				Value:       time.Hour,
+				Required:    false,
+				Destination: &config.PanelCertInterval,
+			},
+			&cli.StringFlag{
+				Name:        "cert_warn_days",
+				Usage:       "Days before the certificate expiry to warn at, comma separated",
+				EnvVars:     []string{"X_PANDA_VMESS_CERT_WARN_DAYS", "CERT_WARN_DAYS"},
+				Value:       "30,14,7,3,1",
+				Required:    false,
+				Destination: &config.CertWarnDays,
+			},
+			&cli.BoolFlag{
+				Name:        "cert_cache",
+				Usage:       "Cache the certificate delivered by the panel in the state dir, it is kept in memory only otherwise",
+				EnvVars:     []string{"X_PANDA_VMESS_CERT_CACHE", "CERT_CACHE"},
+				Value:       false,
+				DefaultText: "false",
+				Required:    false,
+				Destination: &config.CertCache,
+			},
+			&cli.BoolFlag{
+				Name:        "acme",
+				Usage:       "Obtain and renew the TLS certificate from an ACME server",
+				EnvVars:     []string{"X_PANDA_VMESS_ACME", "ACME"},
+				Value:       false,
+				DefaultText: "false",
+				Required:    false,
+				Destination: &acmeConfig.Enabled,
+			},
+			&cli.StringFlag{
+				Name:        "acme_domain",
+				Usage:       "Domain of the certificate, default the server name of the node",
+				EnvVars:     []string{"X_PANDA_VMESS_ACME_DOMAIN", "ACME_DOMAIN"},
+				Required:    false,
+				Destination: &acmeConfig.Domain,
+			},
+			&cli.StringFlag{
+				Name:        "acme_email",
+				Usage:       "Contact email of the ACME account",
+				EnvVars:     []string{"X_PANDA_VMESS_ACME_EMAIL", "ACME_EMAIL"},
+				Required:    false,
+				Destination: &acmeConfig.Email,
+			},
+			&cli.StringFlag{
+				Name:        "acme_directory",
+				Usage:       "Directory URL of the ACME server",
+				EnvVars:     []string{"X_PANDA_VMESS_ACME_DIRECTORY", "ACME_DIRECTORY"},
+				Value:       autocert.DefaultACMEDirectory,
+				Required:    false,
+				Destination: &acmeConfig.DirectoryURL,
+			},
+			&cli.StringFlag{
+				Name:        "acme_directory_ca",
+				Usage:       "CA file trusted for the ACME directory",
+				EnvVars:     []string{"X_PANDA_VMESS_ACME_DIRECTORY_CA", "ACME_DIRECTORY_CA"},
+				Required:    false,
+				Destination: &acmeConfig.DirectoryCA,
+			},
+			&cli.StringFlag{
+				Name:        "acme_challenge",
+				Usage:       "ACME challenge, http-01 or tls-alpn-01",
+				EnvVars:     []string{"X_PANDA_VMESS_ACME_CHALLENGE", "ACME_CHALLENGE"},
+				Value:       cert.ChallengeHTTP01,
+				Required:    false,
+				Destination: &acmeConfig.Challenge,
+			},
+			&cli.IntFlag{
+				Name:        "acme_http_port",
+				Usage:       "Listen port of the http-01 challenge",
+				EnvVars:     []string{"X_PANDA_VMESS_ACME_HTTP_PORT", "ACME_HTTP_PORT"},
+				Value:       80,
+				Required:    false,
+				Destination: &acmeConfig.HTTPPort,
+			},
+			&cli.IntFlag{
+				Name:        "acme_tls_port",
+				Usage:       "Listen port of the tls-alpn-01 challenge",
+				EnvVars:     []string{"X_PANDA_VMESS_ACME_TLS_PORT", "ACME_TLS_PORT"},
+				Value:       443,
+				Required:    false,
+				Destination: &acmeConfig.TLSPort,
+			},
+			&cli.DurationFlag{
+				Name:        "acme_renew_before",
+				Usage:       "Renew the certificate this long before it expires",
+				EnvVars:     []string{"X_PANDA_VMESS_ACME_RENEW_BEFORE", "ACME_RENEW_BEFORE"},
+				Value:       720 * time.Hour,
+				Required:    false,
+				Destination: &acmeConfig.RenewBefore,
+			},
+		},
+		Commands: []*cli.Command{
+			lookupCommand(),
+			bansCommand(),
+			blocksCommand(),
+			realityKeygenCommand(),
 		},
 		Before: func(c *cli.Context) error {
 			log.SetFormatter(&log.TextFormatter{})
@@ -132,6 +606,11 @@ func main() {
 			return nil
 		},
 		Action: func(c *cli.Context) error {
+			// checked here instead of Required, so the subcommands and the standalone mode don't need them
+			if config.Standalone == "" && (apiConfig.APIHost == "" || apiConfig.Token == "" || serviceConfig.NodeID == 0) {
+				_ = cli.ShowAppHelp(c)
+				return fmt.Errorf("required flags \"api, token, node\" not set")
+			}
 			if config.LogLevel != server.LogLevelDebug {
 				defer func() {
 					if r := recover(); r != nil {
@@ -140,14 +619,29 @@ func main() {
 				}()
 			}
 			serviceConfig.Cert = &certConfig
+			serviceConfig.Sockopt = &sockoptConfig
+			config.AccessLog = &accessLogConfig
+			config.Reputation = &reputationConfig
+			config.Egress = &egressConfig
+			config.Decoy = &decoyConfig
+			config.Webhook = &webhookConfig
+			config.Transfer = &transferConfig
+			config.ConnLimit = &connLimitConfig
+			config.ACME = &acmeConfig
+			config.Version = Version
 			serv := server.New(&config, &apiConfig, &serviceConfig)
 			serv.Start()
 			defer serv.Close()
 			runtime.GC()
 			{
 				osSignals := make(chan os.Signal, 1)
-				signal.Notify(osSignals, os.Interrupt, syscall.SIGTERM)
-				<-osSignals
+				signal.Notify(osSignals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+				for sig := range osSignals {
+					if sig != syscall.SIGHUP {
+						break
+					}
+					serv.ReloadCert()
+				}
 			}
 			return nil
 		},
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"github.com/xflash-panda/server-vmess/internal/pkg/reality"
+)
+
+// realityKeygenCommand prints a key pair and short ids for the reality_settings of the node config
+func realityKeygenCommand() *cli.Command {
+	var privateKey string
+	var count int
+	var size int
+	return &cli.Command{
+		Name:  "reality-keygen",
+		Usage: "Generate an x25519 key pair and short ids for REALITY",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "private_key",
+				Usage:       "Print the public key of this private key instead of generating one",
+				Required:    false,
+				Destination: &privateKey,
+			},
+			&cli.IntFlag{
+				Name:        "short_ids",
+				Usage:       "Number of short ids",
+				Value:       4,
+				Required:    false,
+				Destination: &count,
+			},
+			&cli.IntFlag{
+				Name:        "short_id_len",
+				Usage:       "Length of the short ids in bytes, at most 8",
+				Value:       reality.MaxShortIDLen,
+				Required:    false,
+				Destination: &size,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			var keyPair *reality.KeyPair
+			var err error
+			if privateKey != "" {
+				keyPair, err = reality.KeyFromPrivate(privateKey)
+			} else {
+				keyPair, err = reality.GenerateKey()
+			}
+			if err != nil {
+				return err
+			}
+			shortIDs, err := reality.ShortIDs(count, size)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Private key: %s\n", keyPair.PrivateKey)
+			fmt.Printf("Public key: %s\n", keyPair.PublicKey)
+			fmt.Printf("Short ids: %s\n", strings.Join(shortIDs, ","))
+			return nil
+		},
+	}
+}
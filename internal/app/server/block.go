@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xflash-panda/server-vmess/internal/pkg/admin"
+)
+
+// serveBlocks list the blocked users on GET, block the user_id query parameter for duration (until it
+// is lifted if empty) on POST, and lift the block of user_id on DELETE
+func (s *Server) serveBlocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		admin.WriteJSON(w, s.service.Blocks())
+		return
+	}
+	query := r.URL.Query()
+	uid, err := strconv.Atoi(query.Get("user_id"))
+	if err != nil || uid <= 0 {
+		admin.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user_id %q", query.Get("user_id")))
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var d time.Duration
+		if duration := query.Get("duration"); duration != "" {
+			if d, err = time.ParseDuration(duration); err != nil || d <= 0 {
+				admin.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid duration %q", duration))
+				return
+			}
+		}
+		block, err := s.service.BlockUser(uid, d, query.Get("reason"))
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		admin.WriteJSON(w, block)
+	case http.MethodDelete:
+		lifted, err := s.service.UnblockUser(uid)
+		if err != nil {
+			admin.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		admin.WriteJSON(w, map[string]bool{"lifted": lifted})
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-vmess/internal/pkg/admin"
+	"github.com/xflash-panda/server-vmess/internal/pkg/cert"
+	"github.com/xflash-panda/server-vmess/internal/pkg/metrics"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// obtainACMECert request the certificate of the node domain before the inbound is built
+func (s *Server) obtainACMECert() error {
+	acmeConfig := s.config.ACME
+	if acmeConfig.Domain == "" {
+		acmeConfig.Domain = s.nodeConfig.ServerName()
+	}
+	// the challenge listens as long as the certificate is renewed
+	port := acmeConfig.HTTPPort
+	if acmeConfig.Challenge == cert.ChallengeTLSALPN01 {
+		port = acmeConfig.TLSPort
+	}
+	owner, err := service.PortOwner(s.serviceConfig, s.nodeConfig, port)
+	if err != nil {
+		return err
+	}
+	if owner != "" {
+		return fmt.Errorf("acme %s port %d is used by %s, use another port or challenge", acmeConfig.Challenge, port, owner)
+	}
+	acmeConfig.CacheDir = filepath.Join(s.config.StateDir, "acme")
+
+	s.acme, err = cert.NewACME(acmeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to start acme: %s", err)
+	}
+	pair, err := s.acme.Obtain()
+	if err != nil {
+		return err
+	}
+	s.serviceConfig.Cert.CertPEM = pair.CertPEM
+	s.serviceConfig.Cert.KeyPEM = pair.KeyPEM
+	return nil
+}
+
+// watchCert reload the certificate files when they are renewed
+func (s *Server) watchCert() error {
+	certConfig := s.serviceConfig.Cert
+	if certConfig.CertFile == "" || certConfig.KeyFile == "" {
+		return nil
+	}
+	s.certWatcher = cert.NewWatcher(certConfig.CertFile, certConfig.KeyFile, s.config.CertCheckInterval)
+	return s.certWatcher.Start(s.reloadCert, func(err error) {
+		s.certFailed.Add(1)
+		log.Errorf("certificate not reloaded, keep the current one: %s", err)
+	})
+}
+
+// ReloadCert check the certificate files or the panel now, e.g. on SIGHUP
+func (s *Server) ReloadCert() {
+	if s.panelCert != nil {
+		log.Infoln("reloading certificate of the panel")
+		_ = s.refreshPanelCert()
+		return
+	}
+	if s.certWatcher == nil {
+		log.Warnln("no certificate files to reload")
+		return
+	}
+	log.Infoln("reloading certificate files")
+	s.certWatcher.Check()
+}
+
+// reloadCert put a new certificate into the running inbounds, the validated content is used instead of the files
+// so the cert and the key can't be read from two different renewals. The TLS inbounds are rebuilt and restored with
+// the current certificate if one fails, so all of them keep the same certificate, the fronts serving the decoy take it
+// from their next handshake on.
+func (s *Server) reloadCert(pair *cert.Pair) error {
+	s.reload.Lock()
+	certPEM, keyPEM := s.serviceConfig.Cert.CertPEM, s.serviceConfig.Cert.KeyPEM
+	s.serviceConfig.Cert.CertPEM = pair.CertPEM
+	s.serviceConfig.Cert.KeyPEM = pair.KeyPEM
+	s.reload.Unlock()
+	err := s.reloadInbound()
+	if err == nil {
+		err = s.certStore.Set(pair)
+	}
+	if err != nil {
+		s.reload.Lock()
+		s.serviceConfig.Cert.CertPEM, s.serviceConfig.Cert.KeyPEM = certPEM, keyPEM
+		s.reload.Unlock()
+		if restoreErr := s.reloadInbound(); restoreErr != nil {
+			log.Errorf("restore the inbounds with the current certificate failed: %s", restoreErr)
+		}
+		s.certFailed.Add(1)
+		return err
+	}
+	s.certReloaded.Add(1)
+	log.Infof("certificate valid until %s applied", pair.Leaf.NotAfter.Format("2006-01-02 15:04:05"))
+	if s.certMonitor != nil {
+		s.certMonitor.Check()
+	}
+	return nil
+}
+
+// monitorCert check the expiry and the names of the certificate in use
+func (s *Server) monitorCert() error {
+	serverName := s.nodeConfig.ServerName()
+	daysLeft := metrics.Counter(s.statsManager(), "cert", "days_left")
+	nameMismatch := metrics.Counter(s.statsManager(), "cert", "name_mismatch")
+	var err error
+	s.certMonitor, err = cert.NewMonitor(serverName, s.config.CertWarnDays, s.currentCert, func(status *cert.Status) {
+		if status.Error != "" {
+			return
+		}
+		daysLeft.Set(int64(status.DaysLeft))
+		if status.NameMatch {
+			nameMismatch.Set(0)
+		} else {
+			nameMismatch.Set(1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return s.certMonitor.Start()
+}
+
+// currentCert return the pair the inbound was built from
+func (s *Server) currentCert() (*cert.Pair, error) {
+	s.reload.Lock()
+	certConfig := *s.serviceConfig.Cert
+	s.reload.Unlock()
+	if len(certConfig.CertPEM) > 0 && len(certConfig.KeyPEM) > 0 {
+		return cert.ParsePair(certConfig.CertPEM, certConfig.KeyPEM)
+	}
+	certPEM, err := os.ReadFile(certConfig.CertFile)
+	if err != nil {
+		return nil, fmt.Errorf("read certificate failed: %s", err)
+	}
+	keyPEM, err := os.ReadFile(certConfig.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read key failed: %s", err)
+	}
+	return cert.ParsePair(certPEM, keyPEM)
+}
+
+// serveCert return the status of the certificate in use
+func (s *Server) serveCert(w http.ResponseWriter, r *http.Request) {
+	if s.certMonitor == nil {
+		admin.WriteError(w, http.StatusNotFound, fmt.Errorf("the inbound doesn't use tls"))
+		return
+	}
+	admin.WriteJSON(w, s.certMonitor.Status())
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"github.com/xflash-panda/server-vmess/internal/pkg/front"
+	"github.com/xflash-panda/server-vmess/internal/pkg/proxyprotocol"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/inbound"
+	statsFeature "github.com/xtls/xray-core/features/stats"
+	"net/http"
+)
+
+// buildInboundHandler create the inbound handler, it is not started
+func (s *Server) buildInboundHandler(inboundConfig *service.Inbound) (inbound.Handler, error) {
+	rawHandler, err := core.CreateObject(s.instance, inboundConfig.InboundHandlerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inbound handler: %s", err)
+	}
+	handler, ok := rawHandler.(inbound.Handler)
+	if !ok {
+		return nil, fmt.Errorf("inbound %s is not an inbound handler", inboundConfig.Tag)
+	}
+	return handler, nil
+}
+
+// prepareFronts create the fronts of the inbounds the node listens for, they are started with the instance,
+// site is the decoy site if one is configured
+func (s *Server) prepareFronts(inbounds []*service.Inbound, site http.Handler) error {
+	for _, inboundConfig := range inbounds {
+		if inboundConfig.Front == nil {
+			continue
+		}
+		if len(s.fronts) == 0 {
+			if err := front.PrepareDir(s.serviceConfig.FrontDir); err != nil {
+				return err
+			}
+		}
+		if inboundConfig.ProxyProtocol && s.proxyGuard == nil {
+			var err error
+			if s.proxyGuard, err = proxyprotocol.New(s.config.ProxyProtocolTrusted); err != nil {
+				return err
+			}
+		}
+		if inboundConfig.Front.TLS != nil && s.certStore.Certificate() == nil {
+			pair, err := s.currentCert()
+			if err != nil {
+				return err
+			}
+			if err := s.certStore.Set(pair); err != nil {
+				return err
+			}
+		}
+		f, err := front.New(inboundConfig.Front, s.proxyGuard, s.tracker, &s.certStore, site)
+		if err != nil {
+			return err
+		}
+		s.fronts = append(s.fronts, f)
+	}
+	return nil
+}
+
+// reloadInbound rebuild the TLS inbounds from the current config and swap them for the running ones,
+// xray reads the TLS certificates only when the listener starts. Every inbound is built before the first one
+// is swapped, a failed swap leaves the ones before it swapped, see reloadCert.
+func (s *Server) reloadInbound() error {
+	s.reload.Lock()
+	defer s.reload.Unlock()
+	inbounds, err := service.InboundBuilder(s.serviceConfig, s.nodeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to build inbound config: %s", err)
+	}
+	var handlers []inbound.Handler
+	for _, inboundConfig := range inbounds {
+		// the fronts serving the decoy terminate TLS with the certificate of the store
+		if inboundConfig.Security != service.TLS || (inboundConfig.Front != nil && inboundConfig.Front.TLS != nil) {
+			continue
+		}
+		handler, err := s.buildInboundHandler(inboundConfig)
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, handler)
+	}
+	for _, handler := range handlers {
+		if err := s.service.ReplaceInbound(handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) statsManager() statsFeature.Manager {
+	return s.instance.GetFeature(statsFeature.ManagerType()).(statsFeature.Manager)
+}
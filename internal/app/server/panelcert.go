@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/cert"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+	"github.com/xtls/xray-core/common/task"
+	"path/filepath"
+)
+
+// fetchNodeConfig get the node config from the backend
+func (s *Server) fetchNodeConfig() (*service.NodeConfig, error) {
+	return s.backend.Config(api.NodeId(s.serviceConfig.NodeID), api.VMess)
+}
+
+// usePanelCert build the inbound from the certificate in the node config, it is kept in memory only
+// unless caching is allowed, then the cached one is the fallback for an invalid delivery
+func (s *Server) usePanelCert(nodeConfig *service.NodeConfig) error {
+	if s.config.PanelCertInterval <= 0 {
+		return fmt.Errorf("invalid panel certificate interval %s", s.config.PanelCertInterval)
+	}
+	pair, err := cert.ParsePair([]byte(nodeConfig.TLSCert), []byte(nodeConfig.TLSKey))
+	if err != nil {
+		if !s.config.CertCache {
+			return fmt.Errorf("certificate of the panel: %s", err)
+		}
+		log.Errorf("certificate of the panel: %s, use the cached one", err)
+		if pair, err = cert.LoadCache(s.panelCertCacheDir()); err != nil {
+			return err
+		}
+	} else {
+		s.cachePanelCert(pair)
+	}
+	s.serviceConfig.Cert.CertPEM = pair.CertPEM
+	s.serviceConfig.Cert.KeyPEM = pair.KeyPEM
+	s.panelCert = &task.Periodic{
+		Interval: s.config.PanelCertInterval,
+		Execute:  s.refreshPanelCert,
+	}
+	return nil
+}
+
+// refreshPanelCert apply the certificate of the panel once it has been rotated
+func (s *Server) refreshPanelCert() error {
+	nodeConfig, err := s.fetchNodeConfig()
+	if err != nil {
+		log.Errorf("refresh panel certificate failed: %s", err)
+		return nil
+	}
+	if !nodeConfig.HasCert() {
+		return nil
+	}
+	current, err := s.currentCert()
+	if err == nil && string(current.CertPEM) == nodeConfig.TLSCert && string(current.KeyPEM) == nodeConfig.TLSKey {
+		return nil
+	}
+	pair, err := cert.ParsePair([]byte(nodeConfig.TLSCert), []byte(nodeConfig.TLSKey))
+	if err != nil {
+		s.certFailed.Add(1)
+		log.Errorf("certificate of the panel not applied, keep the current one: %s", err)
+		return nil
+	}
+	if err := s.reloadCert(pair); err != nil {
+		log.Errorf("apply certificate of the panel failed: %s", err)
+		return nil
+	}
+	s.cachePanelCert(pair)
+	return nil
+}
+
+func (s *Server) cachePanelCert(pair *cert.Pair) {
+	if !s.config.CertCache {
+		return
+	}
+	if err := cert.SaveCache(s.panelCertCacheDir(), pair); err != nil {
+		log.Errorf("cache certificate of the panel failed: %s", err)
+	}
+}
+
+func (s *Server) panelCertCacheDir() string {
+	return filepath.Join(s.config.StateDir, "panel-cert")
+}
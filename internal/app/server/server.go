@@ -1,34 +1,118 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/accesslog"
+	"github.com/xflash-panda/server-vmess/internal/pkg/admin"
+	"github.com/xflash-panda/server-vmess/internal/pkg/backend"
+	"github.com/xflash-panda/server-vmess/internal/pkg/cert"
+	"github.com/xflash-panda/server-vmess/internal/pkg/connlimit"
+	"github.com/xflash-panda/server-vmess/internal/pkg/decoy"
 	_ "github.com/xflash-panda/server-vmess/internal/pkg/dep"
 	"github.com/xflash-panda/server-vmess/internal/pkg/dispatcher"
+	"github.com/xflash-panda/server-vmess/internal/pkg/egress"
+	"github.com/xflash-panda/server-vmess/internal/pkg/front"
+	"github.com/xflash-panda/server-vmess/internal/pkg/metrics"
+	"github.com/xflash-panda/server-vmess/internal/pkg/proxyprotocol"
+	"github.com/xflash-panda/server-vmess/internal/pkg/reputation"
 	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+	"github.com/xflash-panda/server-vmess/internal/pkg/standalone"
+	"github.com/xflash-panda/server-vmess/internal/pkg/status"
+	"github.com/xflash-panda/server-vmess/internal/pkg/transfer"
+	"github.com/xflash-panda/server-vmess/internal/pkg/webhook"
 	"github.com/xtls/xray-core/app/dns"
+	applog "github.com/xtls/xray-core/app/log"
 	"github.com/xtls/xray-core/app/proxyman"
 	"github.com/xtls/xray-core/app/router"
 	"github.com/xtls/xray-core/app/stats"
+	xlog "github.com/xtls/xray-core/common/log"
 	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/common/task"
 	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/features/routing"
+	statsFeature "github.com/xtls/xray-core/features/stats"
 	"github.com/xtls/xray-core/infra/conf"
+	"net/http"
+	"path/filepath"
 	"sync"
+	"time"
 	"unsafe"
 )
 
 type Config struct {
-	LogLevel string
+	LogLevel    string
+	AdminSocket string
+	AccessLog   *accesslog.Config
+	Egress      *egress.Config
+	Decoy       *decoy.Config
+	Reputation  *reputation.Config
+	ACME        *cert.ACMEConfig
+	StateDir    string
+	// CertCheckInterval is how often the certificate files are checked besides the file events
+	CertCheckInterval time.Duration
+	// PanelCertInterval is how often the node config is fetched for the certificate of the panel, a fetch a minute
+	// would load the panel with the whole config
+	PanelCertInterval time.Duration
+	// CertWarnDays lists the days before the expiry to warn at, comma separated
+	CertWarnDays string
+	// CertCache allows writing the certificate delivered by the panel into the state dir
+	CertCache bool
+	// ProxyProtocolTrusted lists the networks allowed to send the PROXY protocol, comma separated
+	ProxyProtocolTrusted string
+	// Standalone is the file the node and its users are read from instead of the panel
+	Standalone string
+	// Ledger is the file the traffic is appended to in standalone mode
+	Ledger string
+	// Backend is the kind of the panel, see backend.New
+	Backend string
+	Webhook *webhook.Config
+	// StatusInterval is how often the node status and the users online are reported, 0 to disable it
+	StatusInterval time.Duration
+	// Version is the version of the node, reported in the status
+	Version  string
+	Transfer *transfer.Config
+	// ConnLimit is the default limits of the links of a user
+	ConnLimit *connlimit.Config
 }
 
 type Server struct {
-	access        sync.Mutex
-	service       service.Service
-	config        *Config
-	apiConfig     *api.Config
-	serviceConfig *service.Config
-	Running       bool
+	access          sync.Mutex
+	service         *service.Builder
+	instance        *core.Instance
+	nodeConfig      *service.NodeConfig
+	vmessConfig     *api.VMessConfig
+	reload          sync.Mutex
+	acme            *cert.ACME
+	certWatcher     *cert.Watcher
+	certStore       cert.Store
+	certMonitor     *cert.Monitor
+	backend         backend.Backend
+	panelCert       *task.Periodic
+	certReloaded    statsFeature.Counter
+	certFailed      statsFeature.Counter
+	accessLog       *accesslog.Logger
+	tracker         *reputation.Tracker
+	proxyGuard      *proxyprotocol.Guard
+	fronts          []*front.Front
+	admin           *admin.Server
+	webhook         *webhook.Server
+	statusReport    *task.Periodic
+	transfer        *transfer.Meter
+	connLimiter     *connlimit.Limiter
+	statusCollector *status.Collector
+	// statusUnsupported is set once the backend has no endpoint for the status or the host status can't be read
+	statusUnsupported bool
+	// onlineUnsupported is set once the backend has no endpoint for the users online
+	onlineUnsupported bool
+	configHash        string
+	config            *Config
+	apiConfig         *api.Config
+	serviceConfig     *service.Config
+	Running           bool
 }
 
 func New(config *Config, apiConfig *api.Config, serviceConfig *service.Config) *Server {
@@ -39,19 +123,54 @@ func (s *Server) Start() {
 	s.access.Lock()
 	defer s.access.Unlock()
 	log.Infoln("server Start")
-	apiClient := api.New(s.apiConfig)
-	nodeInfo, err := apiClient.Config(api.NodeId(s.serviceConfig.NodeID), api.VMess)
+	panel, err := s.newBackend()
+	if err != nil {
+		panic(err)
+	}
+	s.backend = panel
+	nodeConfig, err := s.fetchNodeConfig()
 	if err != nil {
 		panic(fmt.Errorf("failed to get node inf :%s", err))
 	}
 
-	vmessConfig := nodeInfo.(*api.VMessConfig)
-	pbInBoundConfig, err := service.InboundBuilder(s.serviceConfig, vmessConfig)
+	if s.config.Standalone != "" && s.serviceConfig.NodeID == 0 {
+		s.serviceConfig.NodeID = nodeConfig.ID
+	}
+	s.serviceConfig.BatchFile = filepath.Join(s.config.StateDir, fmt.Sprintf("traffic-%d.json", s.serviceConfig.NodeID))
+	s.serviceConfig.BlockFile = filepath.Join(s.config.StateDir, fmt.Sprintf("blocks-%d.json", s.serviceConfig.NodeID))
+	s.serviceConfig.FrontDir = filepath.Join(s.config.StateDir, "front")
+	s.serviceConfig.Decoy = s.config.Decoy != nil && s.config.Decoy.Enabled()
+	s.serviceConfig.Guard = s.config.Reputation != nil && s.config.Reputation.Enabled()
+	vmessConfig := &nodeConfig.VMessConfig
+	s.nodeConfig = nodeConfig
+	s.configHash = configHash(nodeConfig)
+	if nodeConfig.TrafficMultiplier != nil {
+		if err := nodeConfig.TrafficMultiplier.Compile(); err != nil {
+			panic(err)
+		}
+	}
+	s.vmessConfig = vmessConfig
+	if s.config.ACME != nil && s.config.ACME.Enabled && nodeConfig.UsesSecurity(service.TLS) {
+		if err := s.obtainACMECert(); err != nil {
+			panic(err)
+		}
+	} else if nodeConfig.UsesSecurity(service.TLS) && nodeConfig.HasCert() {
+		if err := s.usePanelCert(nodeConfig); err != nil {
+			panic(err)
+		}
+	}
+
+	if s.serviceConfig.Sockopt != nil {
+		if err := s.serviceConfig.Sockopt.Validate(); err != nil {
+			panic(err)
+		}
+	}
+	inbounds, err := service.InboundBuilder(s.serviceConfig, nodeConfig)
 	if err != nil {
 		panic(fmt.Errorf("failed to build inbound config: %s", err))
 	}
 
-	pbOutBoundConfig, err := service.OutboundBuilder(vmessConfig)
+	pbOutBoundConfig, err := service.OutboundBuilder(s.serviceConfig, vmessConfig)
 	if err != nil {
 		panic(fmt.Errorf("failed to build outbound config: %s", err))
 	}
@@ -78,26 +197,159 @@ func (s *Server) Start() {
 		pbDnsConfig, _ = coreDnsConfig.Build()
 	}
 
-	instance, err := s.loadCore(pbInBoundConfig, pbOutBoundConfig, pbRouterConfig, pbDnsConfig)
+	instance, err := s.loadCore(pbOutBoundConfig, pbRouterConfig, pbDnsConfig)
+	if err != nil {
+		panic(err)
+	}
+	s.instance = instance
+	s.certReloaded = metrics.Counter(s.statsManager(), "cert", "reloaded")
+	s.certFailed = metrics.Counter(s.statsManager(), "cert", "reload_failed")
+
+	defaultDispatcher := instance.GetFeature(routing.DispatcherType()).(*dispatcher.DefaultDispatcher)
+	// the multiplier of a protocol needs the traffic of the users by class too
+	defaultDispatcher.SetTrafficBreakdown(s.serviceConfig.TrafficBreakdown || nodeConfig.TrafficMultiplier.ByProtocol())
+	s.transfer, err = transfer.New(s.config.Transfer, s.statsManager(), filepath.Join(s.config.StateDir, "transfer.json"))
+	if err != nil {
+		panic(fmt.Errorf("failed to create transfer meter: %s", err))
+	}
+	if s.config.Transfer.Cap > 0 {
+		defaultDispatcher.SetTransferMeter(s.transfer)
+	}
+	s.connLimiter, err = connlimit.New(s.config.ConnLimit, s.statsManager())
+	if err != nil {
+		panic(err)
+	}
+	defaultDispatcher.SetConnLimiter(s.connLimiter)
+	if s.config.AccessLog != nil && s.config.AccessLog.Enabled() {
+		s.accessLog, err = accesslog.New(s.config.AccessLog)
+		if err != nil {
+			panic(err)
+		}
+		defaultDispatcher.SetAccessLogger(s.accessLog)
+	}
+	if s.config.Egress != nil && s.config.Egress.Enabled {
+		guard, err := egress.New(s.config.Egress)
+		if err != nil {
+			panic(fmt.Errorf("failed to create egress guard: %s", err))
+		}
+		defaultDispatcher.SetEgressGuard(guard)
+	}
+
+	var site http.Handler
+	if s.serviceConfig.Decoy {
+		if site, err = decoy.New(s.config.Decoy); err != nil {
+			panic(err)
+		}
+	}
+
+	s.tracker, err = reputation.New(s.config.Reputation)
 	if err != nil {
+		panic(fmt.Errorf("failed to create reputation tracker: %s", err))
+	}
+	// the log of xray registered itself as the handler when the instance was created
+	xlog.RegisterHandler(s.tracker.Recorder(instance.GetFeature((*applog.Instance)(nil)).(*applog.Instance)))
+	inboundManager := instance.GetFeature(inbound.ManagerType()).(inbound.Manager)
+	inboundTags := make([]string, len(inbounds))
+	if err := s.prepareFronts(inbounds, site); err != nil {
 		panic(err)
 	}
+	for i, inboundConfig := range inbounds {
+		inboundHandler, err := s.buildInboundHandler(inboundConfig)
+		if err != nil {
+			panic(err)
+		}
+		if err := inboundManager.AddHandler(context.Background(), inboundHandler); err != nil {
+			panic(fmt.Errorf("failed to add inbound handler %s: %s", inboundConfig.Tag, err))
+		}
+		inboundTags[i] = inboundConfig.Tag
+	}
+	if err := s.tracker.Start(); err != nil {
+		panic(fmt.Errorf("failed to start reputation tracker: %s", err))
+	}
 
 	if err := instance.Start(); err != nil {
 		panic(fmt.Errorf("failed to start instance: %s", err))
 	}
+	for _, f := range s.fronts {
+		if err := f.Start(); err != nil {
+			panic(err)
+		}
+	}
 
-	buildService := service.New(pbInBoundConfig.Tag, instance, s.serviceConfig, vmessConfig,
-		apiClient.Users, apiClient.Submit)
+	buildService := service.New(inboundTags, instance, s.serviceConfig, vmessConfig,
+		s.backend.Users, s.backend.Submit, s.backend.SubmitBreakdown)
 	s.service = buildService
+	s.service.SetMultiplier(nodeConfig.TrafficMultiplier)
+	s.service.SetUserInterrupter(defaultDispatcher.InterruptUser)
+	s.service.SetConnLimiter(s.connLimiter)
 	if err := s.service.Start(); err != nil {
 		panic(fmt.Errorf("failed to start build service: %s", err))
 	}
+	if s.config.Webhook != nil && s.config.Webhook.Listen != "" {
+		s.webhook, err = webhook.New(s.config.Webhook, s.apiConfig.Token, s.service.UpdateUsers)
+		if err != nil {
+			panic(err)
+		}
+		if err := s.webhook.Start(); err != nil {
+			panic(err)
+		}
+	}
+	if err := s.transfer.Start(); err != nil {
+		panic(fmt.Errorf("failed to start transfer meter: %s", err))
+	}
+	if err := s.startStatusReport(); err != nil {
+		panic(err)
+	}
+	if s.acme != nil {
+		if err := s.acme.Start(s.reloadCert); err != nil {
+			panic(fmt.Errorf("failed to start acme renewal: %s", err))
+		}
+	} else if s.panelCert != nil {
+		if err := s.panelCert.Start(); err != nil {
+			panic(fmt.Errorf("failed to start panel certificate refresh: %s", err))
+		}
+	} else if nodeConfig.UsesSecurity(service.TLS) {
+		if err := s.watchCert(); err != nil {
+			panic(err)
+		}
+	}
+	if nodeConfig.UsesSecurity(service.TLS) {
+		if err := s.monitorCert(); err != nil {
+			panic(err)
+		}
+	}
+
+	if s.config.AdminSocket != "" {
+		s.admin = admin.New(s.config.AdminSocket)
+		s.admin.Handle("/bans", s.tracker.ServeBans)
+		s.admin.Handle("/blocks", s.serveBlocks)
+		s.admin.Handle("/cert", s.serveCert)
+		s.admin.Handle("/limits", s.connLimiter.ServeUsers)
+		s.admin.Handle("/metrics", metrics.Handler(s.statsManager()))
+		s.admin.Handle("/status", s.serveStatus)
+		s.admin.Handle("/transfer", s.serveTransfer)
+		if err := s.admin.Start(); err != nil {
+			panic(err)
+		}
+	}
 	s.Running = true
 	log.Infoln("server is running")
 }
 
-func (s *Server) loadCore(pbInboundConfig *core.InboundHandlerConfig, pbOutboundConfig *core.OutboundHandlerConfig,
+// newBackend return the panel or the standalone file the node config and the users come from and the traffic goes to
+func (s *Server) newBackend() (backend.Backend, error) {
+	if s.config.Standalone != "" {
+		ledger := s.config.Ledger
+		if ledger == "" {
+			ledger = filepath.Join(s.config.StateDir, "ledger.jsonl")
+		}
+		log.Infof("standalone mode, users from %s, traffic to %s", s.config.Standalone, ledger)
+		return standalone.New(s.config.Standalone, ledger), nil
+	}
+	return backend.New(s.config.Backend, s.apiConfig)
+}
+
+func (s *Server) loadCore(pbOutboundConfig *core.OutboundHandlerConfig,
 	pbRouterConfig *router.Config, pbDnsConfig *dns.Config) (*core.Instance, error) {
 	//Log Config
 	logConfig := &conf.LogConfig{}
@@ -109,10 +361,6 @@ func (s *Server) loadCore(pbInboundConfig *core.InboundHandlerConfig, pbOutbound
 	}
 	pbLogConfig := logConfig.Build()
 
-	//InboundConfig
-	inboundConfigs := make([]*core.InboundHandlerConfig, 1)
-	inboundConfigs[0] = pbInboundConfig
-
 	//OutBound config
 	outBoundConfigs := make([]*core.OutboundHandlerConfig, 2)
 	blockOutboundConfig, _ := service.OutboundBlockBuilder()
@@ -131,6 +379,13 @@ func (s *Server) loadCore(pbInboundConfig *core.InboundHandlerConfig, pbOutbound
 		BufferSize:        &defaultConnectionConfig.BufferSize,
 	}
 	policyConfig.Levels = map[uint32]*conf.Policy{0: pbPolicy}
+	// the transfer meter accounts the bytes of the inbounds and the outbounds
+	policyConfig.System = &conf.SystemPolicy{
+		StatsInboundUplink:    true,
+		StatsInboundDownlink:  true,
+		StatsOutboundUplink:   true,
+		StatsOutboundDownlink: true,
+	}
 	pbPolicyConfig, _ := policyConfig.Build()
 	pbCoreConfig := &core.Config{
 		App: []*serial.TypedMessage{
@@ -144,7 +399,6 @@ func (s *Server) loadCore(pbInboundConfig *core.InboundHandlerConfig, pbOutbound
 			serial.ToTypedMessage(pbRouterConfig),
 		},
 		Outbound: outBoundConfigs,
-		Inbound:  inboundConfigs,
 	}
 	instance, err := core.New(pbCoreConfig)
 	if err != nil {
@@ -156,9 +410,64 @@ func (s *Server) loadCore(pbInboundConfig *core.InboundHandlerConfig, pbOutbound
 func (s *Server) Close() {
 	s.access.Lock()
 	defer s.access.Unlock()
+	for _, f := range s.fronts {
+		if err := f.Close(); err != nil {
+			log.Errorf("front close failed: %s", err)
+		}
+	}
+	if s.webhook != nil {
+		if err := s.webhook.Close(); err != nil {
+			log.Errorf("webhook close failed: %s", err)
+		}
+	}
+	if s.statusReport != nil {
+		if err := s.statusReport.Close(); err != nil {
+			log.Errorf("status report close failed: %s", err)
+		}
+	}
 	err := s.service.Close()
 	if err != nil {
 		log.Panicf("server Close fialed: %s", err)
 	}
+	if s.certMonitor != nil {
+		if err := s.certMonitor.Close(); err != nil {
+			log.Errorf("certificate monitor close failed: %s", err)
+		}
+	}
+	if s.panelCert != nil {
+		if err := s.panelCert.Close(); err != nil {
+			log.Errorf("panel certificate refresh close failed: %s", err)
+		}
+	}
+	if s.certWatcher != nil {
+		if err := s.certWatcher.Close(); err != nil {
+			log.Errorf("certificate watcher close failed: %s", err)
+		}
+	}
+	if s.acme != nil {
+		if err := s.acme.Close(); err != nil {
+			log.Errorf("acme close failed: %s", err)
+		}
+	}
+	if s.admin != nil {
+		if err := s.admin.Close(); err != nil {
+			log.Errorf("admin server close failed: %s", err)
+		}
+	}
+	if s.transfer != nil {
+		if err := s.transfer.Close(); err != nil {
+			log.Errorf("transfer meter close failed: %s", err)
+		}
+	}
+	if s.tracker != nil {
+		if err := s.tracker.Close(); err != nil {
+			log.Errorf("reputation tracker close failed: %s", err)
+		}
+	}
+	if s.accessLog != nil {
+		if err := s.accessLog.Close(); err != nil {
+			log.Errorf("access log close failed: %s", err)
+		}
+	}
 	log.Infoln("server close")
 }
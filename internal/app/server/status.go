@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/admin"
+	"github.com/xflash-panda/server-vmess/internal/pkg/backend"
+	"github.com/xflash-panda/server-vmess/internal/pkg/dispatcher"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+	"github.com/xflash-panda/server-vmess/internal/pkg/status"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/routing"
+	"net/http"
+	"runtime"
+	"sort"
+)
+
+// configHash return the sha256 of the node config, to tell which one a node applied
+func configHash(nodeConfig *service.NodeConfig) string {
+	data, err := json.Marshal(nodeConfig)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// startStatusReport report the state of the node and the users online to the backend every status interval
+func (s *Server) startStatusReport() error {
+	s.statusCollector = status.NewCollector("", "/")
+	if s.config.StatusInterval <= 0 {
+		return nil
+	}
+	s.statusReport = &task.Periodic{
+		Interval: s.config.StatusInterval,
+		Execute:  s.reportStatus,
+	}
+	if err := s.statusReport.Start(); err != nil {
+		return fmt.Errorf("failed to start status report: %s", err)
+	}
+	return nil
+}
+
+func (s *Server) reportStatus() error {
+	s.reportOnline()
+	if s.statusUnsupported {
+		return nil
+	}
+	nodeStatus, err := s.nodeStatus()
+	if errors.Is(err, status.ErrUnsupported) {
+		log.Infof("%s, status report stopped", err)
+		s.statusUnsupported = true
+		return nil
+	}
+	if err != nil {
+		log.Errorf("collect node status failed: %s", err)
+		return nil
+	}
+	err = s.backend.SubmitStatus(api.NodeId(s.serviceConfig.NodeID), api.VMess, nodeStatus)
+	if errors.Is(err, backend.ErrUnsupported) {
+		// the admin socket still serves it
+		log.Infoln("the panel doesn't take the node status, status report stopped")
+		s.statusUnsupported = true
+		return nil
+	}
+	if err != nil {
+		log.Errorf("report node status failed: %s", err)
+		return nil
+	}
+	log.Debugf("node status reported, cpu %.1f%%, mem %.1f%%, %d connections", nodeStatus.CPU, nodeStatus.Mem, nodeStatus.Connections)
+	return nil
+}
+
+// reportOnline report the users with a link and the addresses they connect from
+func (s *Server) reportOnline() {
+	if s.onlineUnsupported {
+		return
+	}
+	defaultDispatcher := s.instance.GetFeature(routing.DispatcherType()).(*dispatcher.DefaultDispatcher)
+	onlineUsers := make([]*backend.OnlineUser, 0)
+	for uid, ips := range defaultDispatcher.OnlineUsers() {
+		for _, ip := range ips {
+			onlineUsers = append(onlineUsers, &backend.OnlineUser{UID: uid, IP: ip})
+		}
+	}
+	sort.Slice(onlineUsers, func(i, j int) bool {
+		if onlineUsers[i].UID != onlineUsers[j].UID {
+			return onlineUsers[i].UID < onlineUsers[j].UID
+		}
+		return onlineUsers[i].IP < onlineUsers[j].IP
+	})
+	err := s.backend.SubmitOnline(api.NodeId(s.serviceConfig.NodeID), api.VMess, onlineUsers)
+	if errors.Is(err, backend.ErrUnsupported) {
+		log.Infoln("the panel doesn't take the users online, online report stopped")
+		s.onlineUnsupported = true
+		return
+	}
+	if err != nil {
+		log.Errorf("report users online failed: %s", err)
+		return
+	}
+	log.Debugf("%d addresses of users online reported", len(onlineUsers))
+}
+
+// nodeStatus return the state of the host, the go runtime and the links of the node
+func (s *Server) nodeStatus() (*backend.Status, error) {
+	system, err := s.statusCollector.Collect()
+	if err != nil {
+		return nil, err
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	defaultDispatcher := s.instance.GetFeature(routing.DispatcherType()).(*dispatcher.DefaultDispatcher)
+	connections, onlineUsers := defaultDispatcher.Activity()
+	nodeStatus := &backend.Status{
+		CPU:         system.CPU,
+		Mem:         system.Mem,
+		Disk:        system.Disk,
+		MemTotal:    system.MemTotal,
+		MemUsed:     system.MemUsed,
+		DiskTotal:   system.DiskTotal,
+		DiskUsed:    system.DiskUsed,
+		Load:        system.Load,
+		Uptime:      system.Uptime,
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   mem.HeapAlloc,
+		NumGC:       mem.NumGC,
+		Connections: connections,
+		OnlineUsers: onlineUsers,
+		Version:     s.config.Version,
+		XrayVersion: core.Version(),
+		ConfigHash:  s.configHash,
+	}
+	if s.certMonitor != nil {
+		nodeStatus.Cert = s.certMonitor.Status()
+	}
+	if s.transfer != nil {
+		nodeStatus.Transfer = s.transfer.Status()
+	}
+	return nodeStatus, nil
+}
+
+// serveStatus return the state of the node as it is reported
+func (s *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	nodeStatus, err := s.nodeStatus()
+	if err != nil {
+		admin.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	admin.WriteJSON(w, nodeStatus)
+}
+
+// serveTransfer return the transfer of the node in the period of the cap
+func (s *Server) serveTransfer(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, s.transfer.Status())
+}
@@ -0,0 +1,141 @@
+// Package accesslog writes one JSON line per finished connection
+package accesslog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// TargetSyslog sends records to the local syslog daemon instead of a file
+	TargetSyslog = "syslog"
+)
+
+// the statuses of a record, a link which isn't relayed gets the reason it was refused
+const (
+	StatusRelayed = "relayed"
+	// StatusLimited is a link over the links or the new links a second of its user
+	StatusLimited       = "limited"
+	StatusEgressBlocked = "egress_blocked"
+	StatusTransferCap   = "transfer_cap"
+	StatusNoOutbound    = "no_outbound"
+)
+
+type Config struct {
+	// Target is a file path or TargetSyslog, empty disables the access log
+	Target     string
+	MaxSize    int
+	MaxBackups int
+	HashIP     bool
+	HashSalt   string
+	// StoreDir keeps hourly segments for Lookup, empty disables the store
+	StoreDir  string
+	Retention time.Duration
+}
+
+// Enabled report whether any access log output is configured
+func (c *Config) Enabled() bool {
+	return c.Target != "" || c.StoreDir != ""
+}
+
+// Record is a single connection, written when the connection ends or once it is refused
+type Record struct {
+	Time        time.Time `json:"time"`
+	Start       time.Time `json:"start"`
+	Duration    int64     `json:"duration_ms"`
+	UserID      int       `json:"user_id"`
+	InboundTag  string    `json:"inbound"`
+	Source      string    `json:"source"`
+	Network     string    `json:"network"`
+	Destination string    `json:"destination"`
+	Domain      string    `json:"domain,omitempty"`
+	Protocol    string    `json:"protocol,omitempty"`
+	OutboundTag string    `json:"outbound"`
+	Status      string    `json:"status"`
+	Local       string    `json:"local,omitempty"`
+	Remote      string    `json:"remote,omitempty"`
+	Upload      int64     `json:"up"`
+	Download    int64     `json:"down"`
+}
+
+type Logger struct {
+	access  sync.Mutex
+	config  *Config
+	writers []io.WriteCloser
+}
+
+// New return an access logger for the configured target and store
+func New(config *Config) (*Logger, error) {
+	if config.HashIP && config.HashSalt == "" {
+		return nil, fmt.Errorf("access log source ip hashing requires a salt")
+	}
+	l := &Logger{config: config}
+	if config.Target == TargetSyslog {
+		writer, err := newSyslogWriter()
+		if err != nil {
+			return nil, fmt.Errorf("open syslog failed: %s", err)
+		}
+		l.writers = append(l.writers, writer)
+	} else if config.Target != "" {
+		writer, err := newRotateWriter(config.Target, config.MaxSize, config.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("open access log %s failed: %s", config.Target, err)
+		}
+		l.writers = append(l.writers, writer)
+	}
+	if config.StoreDir != "" {
+		writer, err := newSegmentWriter(config.StoreDir, config.Retention)
+		if err != nil {
+			_ = l.Close()
+			return nil, fmt.Errorf("open connection store %s failed: %s", config.StoreDir, err)
+		}
+		l.writers = append(l.writers, writer)
+	}
+	return l, nil
+}
+
+// Log write the record as a single JSON line
+func (l *Logger) Log(record *Record) error {
+	if l.config.HashIP {
+		record.Source = l.hashIP(record.Source)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.access.Lock()
+	defer l.access.Unlock()
+	for _, writer := range l.writers {
+		if _, werr := writer.Write(data); werr != nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// hashIP replace the ip by a keyed hash, so the same source can still be correlated
+func (l *Logger) hashIP(ip string) string {
+	mac := hmac.New(sha256.New, []byte(l.config.HashSalt))
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (l *Logger) Close() error {
+	l.access.Lock()
+	defer l.access.Unlock()
+	var err error
+	for _, writer := range l.writers {
+		if cerr := writer.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Query selects the records of connections to a destination that were open during [From, To]
+type Query struct {
+	Address   string
+	Port      uint16
+	LocalPort uint16
+	From      time.Time
+	To        time.Time
+}
+
+// Lookup search the retained segments in dir and call fn for every matching record
+func Lookup(dir string, query *Query, fn func(*Record)) error {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		// records are stored by end time, so older segments can't overlap the window
+		if segment.start.Add(segmentDuration).Before(query.From) {
+			continue
+		}
+		if err := lookupSegment(segment.path, query, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func lookupSegment(path string, query *Query, fn func(*Record)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			// a partially written line of a crashed node
+			continue
+		}
+		if query.match(record) {
+			fn(record)
+		}
+	}
+	return scanner.Err()
+}
+
+func (q *Query) match(record *Record) bool {
+	if record.Start.After(q.To) || record.Time.Before(q.From) {
+		return false
+	}
+	if q.LocalPort != 0 && !matchEndpoint(record.Local, "", q.LocalPort) {
+		return false
+	}
+	return matchEndpoint(record.Remote, q.Address, q.Port) || matchEndpoint(record.Destination, q.Address, q.Port)
+}
+
+func matchEndpoint(endpoint string, address string, port uint16) bool {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	if address != "" && host != address {
+		return false
+	}
+	return port == 0 || portStr == strconv.Itoa(int(port))
+}
@@ -0,0 +1,113 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	segmentPrefix     = "conn-"
+	segmentSuffix     = ".jsonl"
+	segmentTimeFormat = "2006010215"
+	segmentDuration   = time.Hour
+)
+
+// segmentWriter writes records into hourly segment files and removes the segments older than retention
+type segmentWriter struct {
+	dir       string
+	retention time.Duration
+	current   time.Time
+	file      *os.File
+}
+
+func newSegmentWriter(dir string, retention time.Duration) (*segmentWriter, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	w := &segmentWriter{dir: dir, retention: retention}
+	if err := w.open(segmentStart(time.Now())); err != nil {
+		return nil, err
+	}
+	w.prune()
+	return w, nil
+}
+
+func (w *segmentWriter) open(start time.Time) error {
+	file, err := os.OpenFile(segmentPath(w.dir, start), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.current = start
+	return nil
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	if start := segmentStart(time.Now()); !start.Equal(w.current) {
+		if err := w.file.Close(); err != nil {
+			return 0, err
+		}
+		if err := w.open(start); err != nil {
+			return 0, err
+		}
+		w.prune()
+	}
+	return w.file.Write(p)
+}
+
+// prune remove the segments which ended before the retention period
+func (w *segmentWriter) prune() {
+	if w.retention <= 0 {
+		return
+	}
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(-w.retention)
+	for _, segment := range segments {
+		if segment.start.Add(segmentDuration).Before(deadline) {
+			_ = os.Remove(segment.path)
+		}
+	}
+}
+
+func (w *segmentWriter) Close() error {
+	return w.file.Close()
+}
+
+type segment struct {
+	path  string
+	start time.Time
+}
+
+// listSegments return the segments in dir, oldest first
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]segment, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		start, err := time.Parse(segmentTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{path: filepath.Join(dir, name), start: start})
+	}
+	return segments, nil
+}
+
+func segmentStart(t time.Time) time.Time {
+	return t.UTC().Truncate(segmentDuration)
+}
+
+func segmentPath(dir string, start time.Time) string {
+	return filepath.Join(dir, segmentPrefix+start.Format(segmentTimeFormat)+segmentSuffix)
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package accesslog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+const syslogTag = "vmess-node"
+
+func newSyslogWriter() (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package accesslog
+
+import (
+	"errors"
+	"io"
+)
+
+// newSyslogWriter fails, windows has no syslog daemon
+func newSyslogWriter() (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on windows, log to a file")
+}
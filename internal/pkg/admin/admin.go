@@ -0,0 +1,79 @@
+// Package admin serves the operator commands on a local unix socket
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type Server struct {
+	socket string
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+// New return an admin server listening on the unix socket once started
+func New(socket string) *Server {
+	mux := http.NewServeMux()
+	return &Server{
+		socket: socket,
+		mux:    mux,
+		server: &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second},
+	}
+}
+
+// Handle register the handler of an operator endpoint, it must be called before Start
+func (s *Server) Handle(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+func (s *Server) Start() error {
+	// a stale socket of a previous run would make listen fail
+	if err := os.Remove(s.socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove admin socket %s failed: %s", s.socket, err)
+	}
+	listener, err := net.Listen("unix", s.socket)
+	if err != nil {
+		return fmt.Errorf("listen admin socket %s failed: %s", s.socket, err)
+	}
+	if err := os.Chmod(s.socket, 0o600); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("chmod admin socket %s failed: %s", s.socket, err)
+	}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("admin server stopped: %s", err)
+		}
+	}()
+	log.Infof("admin interface listening on %s", s.socket)
+	return nil
+}
+
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// WriteJSON write v as the response body
+func WriteJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("admin response write failed: %s", err)
+	}
+}
+
+// WriteError write err as a JSON error body with status code
+func WriteError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+}
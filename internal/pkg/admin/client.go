@@ -0,0 +1,62 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client calls the admin server of a running node
+type Client struct {
+	client *http.Client
+}
+
+func NewClient(socket string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &Client{client: &http.Client{Transport: transport, Timeout: 10 * time.Second}}
+}
+
+// Do send the request and decode the JSON response into out, if not nil
+func (c *Client) Do(method string, path string, query url.Values, out interface{}) error {
+	u := url.URL{Scheme: "http", Host: "admin", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request %s failed: %s", path, err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("read response of %s failed: %s", path, err)
+	}
+	if res.StatusCode >= 400 {
+		var resp struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &resp) == nil && resp.Message != "" {
+			return fmt.Errorf("request %s failed: %s", path, resp.Message)
+		}
+		return fmt.Errorf("request %s failed: %s", path, res.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("parse response of %s failed: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Package backend is the panel the node gets its config and users from and reports to
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/cert"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+	"github.com/xflash-panda/server-vmess/internal/pkg/transfer"
+)
+
+// the kinds of panel
+const (
+	KindV2board = "v2board"
+	KindSSPanel = "sspanel"
+	KindREST    = "rest"
+)
+
+// ErrUnsupported is returned for the reports the panel has no endpoint for
+var ErrUnsupported = errors.New("not supported by the panel")
+
+// retryCount is the retries of a request to a single panel, behind a failover the next endpoint is tried instead
+const retryCount = 3
+
+// HeaderIdempotencyKey carries the id of a traffic batch besides the batch_id query parameter
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// Backend has the signatures of the panel client, so the methods are the injection points of service.New
+type Backend interface {
+	// Config return the node config
+	Config(nodeId api.NodeId, nodeType api.NodeType) (*service.NodeConfig, error)
+	// Users return the users of the node, api.ErrorUserNotModified if they didn't change since the last call
+	Users(nodeId api.NodeId, nodeType api.NodeType) (*[]service.User, error)
+	// Submit report a batch of the traffic of the users, with its id so the panel can drop a retried one
+	Submit(nodeId api.NodeId, nodeType api.NodeType, batch *service.TrafficBatch) error
+	// SubmitOnline report the users online and their addresses
+	SubmitOnline(nodeId api.NodeId, nodeType api.NodeType, onlineUsers []*OnlineUser) error
+	// SubmitStatus report the state of the node
+	SubmitStatus(nodeId api.NodeId, nodeType api.NodeType, status *Status) error
+	// SubmitBreakdown report the traffic of the users by protocol class and network
+	SubmitBreakdown(nodeId api.NodeId, nodeType api.NodeType, breakdown []*service.UserBreakdown) error
+}
+
+// OnlineUser is a user with a connection from IP
+type OnlineUser struct {
+	UID int    `json:"user_id"`
+	IP  string `json:"ip"`
+}
+
+// Status is the state of the node
+type Status struct {
+	// CPU, Mem and Disk are used percents
+	CPU  float64 `json:"cpu"`
+	Mem  float64 `json:"mem"`
+	Disk float64 `json:"disk"`
+	// MemTotal, MemUsed, DiskTotal and DiskUsed are bytes
+	MemTotal  uint64 `json:"mem_total"`
+	MemUsed   uint64 `json:"mem_used"`
+	DiskTotal uint64 `json:"disk_total"`
+	DiskUsed  uint64 `json:"disk_used"`
+	// Load is the load average of 1, 5 and 15 minutes
+	Load [3]float64 `json:"load"`
+	// Uptime is the seconds since the boot of the host
+	Uptime uint64 `json:"uptime"`
+	// Goroutines, HeapAlloc and NumGC are the ones of the go runtime of the node
+	Goroutines int    `json:"goroutines"`
+	HeapAlloc  uint64 `json:"heap_alloc"`
+	NumGC      uint32 `json:"num_gc"`
+	// Connections is the links being relayed, OnlineUsers the users with at least one of them
+	Connections int    `json:"connections"`
+	OnlineUsers int    `json:"online_users"`
+	Version     string `json:"version"`
+	XrayVersion string `json:"xray_version"`
+	// ConfigHash is the sha256 of the node config applied at the start
+	ConfigHash string           `json:"config_hash"`
+	Cert       *cert.Status     `json:"cert,omitempty"`
+	Transfer   *transfer.Status `json:"transfer,omitempty"`
+}
+
+// New return the backend of kind for the panel of config, with more than one host in the comma separated
+// api host the calls fail over between them
+func New(kind string, config *api.Config) (Backend, error) {
+	if hosts := splitHosts(config.APIHost); len(hosts) > 1 {
+		return NewFailover(kind, config, hosts)
+	}
+	return newBackend(kind, config, newClient(config, retryCount))
+}
+
+// newBackend return the backend of kind which sends its requests with client, v2board sends them with the
+// panel client and its retries instead
+func newBackend(kind string, config *api.Config, client *resty.Client) (Backend, error) {
+	switch kind {
+	case KindV2board, "":
+		return NewV2board(config), nil
+	case KindSSPanel:
+		return newSSPanel(config, client), nil
+	case KindREST:
+		return newREST(config, client), nil
+	default:
+		return nil, fmt.Errorf("backend %s not supported, use one of %s, %s, %s", kind, KindV2board, KindSSPanel, KindREST)
+	}
+}
+
+// newClient return a http client of the panel like the one of the panel client, which retries a failed request retries times
+func newClient(config *api.Config, retries int) *resty.Client {
+	client := resty.New()
+	if config.Timeout > 0 {
+		client.SetTimeout(config.Timeout)
+	} else {
+		client.SetTimeout(5 * time.Second)
+	}
+	client.SetBaseURL(config.APIHost)
+	client.SetRetryCount(retries)
+	client.SetCloseConnection(true)
+	if config.Debug {
+		client.SetDebug(true)
+	}
+	return client
+}
+
+// batchParams return the query parameters of a traffic batch
+func batchParams(batch *service.TrafficBatch) map[string]string {
+	return map[string]string{
+		"batch_id":     strconv.FormatUint(batch.ID, 10),
+		"window_start": strconv.FormatInt(batch.Start.Unix(), 10),
+		"window_end":   strconv.FormatInt(batch.End.Unix(), 10),
+	}
+}
+
+// checkResponse turn a failed request of path into an error
+func checkResponse(path string, res *resty.Response, err error) error {
+	if err != nil {
+		return fmt.Errorf("request %s failed: %s", path, err)
+	}
+	if res.StatusCode() >= 400 {
+		return fmt.Errorf("request %s failed: %s, %s", path, res.Status(), string(res.Body()))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+)
+
+// request is a request the test panel received
+type request struct {
+	Method string
+	Path   string
+	Query  map[string]string
+	Header http.Header
+	Body   []byte
+}
+
+// decode unmarshal the body of r into v
+func (r *request) decode(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		t.Fatalf("decode body %s of %s: %s", r.Body, r.Path, err)
+	}
+}
+
+// testPanel is a panel answering with handler, it records the requests it receives
+type testPanel struct {
+	*httptest.Server
+	access   sync.Mutex
+	requests []*request
+}
+
+func newTestPanel(t *testing.T, handler http.HandlerFunc) *testPanel {
+	p := &testPanel{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		query := make(map[string]string)
+		for key := range r.URL.Query() {
+			query[key] = r.URL.Query().Get(key)
+		}
+		p.access.Lock()
+		p.requests = append(p.requests, &request{Method: r.Method, Path: r.URL.Path, Query: query, Header: r.Header.Clone(), Body: body})
+		p.access.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// last return the last request received, it fails the test if there was none
+func (p *testPanel) last(t *testing.T) *request {
+	t.Helper()
+	p.access.Lock()
+	defer p.access.Unlock()
+	if len(p.requests) == 0 {
+		t.Fatal("no request received")
+	}
+	return p.requests[len(p.requests)-1]
+}
+
+func (p *testPanel) count() int {
+	p.access.Lock()
+	defer p.access.Unlock()
+	return len(p.requests)
+}
+
+func (p *testPanel) config(token string) *api.Config {
+	return &api.Config{APIHost: p.URL, Token: token, Timeout: time.Second}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func testBatch() *service.TrafficBatch {
+	return &service.TrafficBatch{
+		ID:    42,
+		Start: time.Unix(1700000000, 0),
+		End:   time.Unix(1700000060, 0),
+		Traffic: []*service.UserTraffic{{
+			UserTraffic: api.UserTraffic{UID: 1, Upload: 100, Download: 200, Count: 3},
+			RawUpload:   50,
+			RawDownload: 100,
+		}},
+	}
+}
+
+// checkBatchParams check the query parameters carrying the id and the window of testBatch
+func checkBatchParams(t *testing.T, r *request) {
+	t.Helper()
+	for key, want := range map[string]string{"batch_id": "42", "window_start": "1700000000", "window_end": "1700000060"} {
+		if got := r.Query[key]; got != want {
+			t.Errorf("query %s of %s = %q, want %q", key, r.Path, got, want)
+		}
+	}
+}
+
+func checkQuery(t *testing.T, r *request, key string, want string) {
+	t.Helper()
+	if got := r.Query[key]; got != want {
+		t.Errorf("query %s of %s = %q, want %q", key, r.Path, got, want)
+	}
+}
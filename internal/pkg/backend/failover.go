@@ -0,0 +1,181 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+)
+
+const (
+	// failureThreshold is the number of failures in a row which opens the circuit of an endpoint
+	failureThreshold = 3
+	// minCooldown and maxCooldown bound how long an open circuit skips the endpoint, it doubles while the endpoint stays down
+	minCooldown = 10 * time.Second
+	maxCooldown = 5 * time.Minute
+)
+
+type endpoint struct {
+	host     string
+	backend  Backend
+	failures int
+	cooldown time.Duration
+	// openUntil is when the endpoint is tried again after its circuit opened
+	openUntil time.Time
+}
+
+// Failover spreads the calls over the endpoints of the same panel, the one which served the last call is
+// tried first and the others in their order, an endpoint failing again and again is skipped for a while
+type Failover struct {
+	access    sync.Mutex
+	endpoints []*endpoint
+	preferred int
+}
+
+// NewFailover return a backend of the hosts, a backend of kind for each one. Their requests aren't retried but
+// the ones of the panel client behind v2board, a failed one goes to the next endpoint and the circuit of each
+// endpoint decides when it is tried again.
+func NewFailover(kind string, config *api.Config, hosts []string) (*Failover, error) {
+	f := &Failover{}
+	for _, host := range hosts {
+		hostConfig := *config
+		hostConfig.APIHost = host
+		b, err := newBackend(kind, &hostConfig, newClient(&hostConfig, 0))
+		if err != nil {
+			return nil, err
+		}
+		f.endpoints = append(f.endpoints, &endpoint{host: host, backend: b})
+	}
+	return f, nil
+}
+
+// splitHosts return the hosts of a comma separated api
+func splitHosts(apiHost string) []string {
+	var hosts []string
+	for _, host := range strings.Split(apiHost, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// order return the endpoints to try, the preferred one and then the others, the open ones last
+func (f *Failover) order(now time.Time) []*endpoint {
+	f.access.Lock()
+	defer f.access.Unlock()
+	var ready, open []*endpoint
+	for i := range f.endpoints {
+		e := f.endpoints[(f.preferred+i)%len(f.endpoints)]
+		if now.Before(e.openUntil) {
+			open = append(open, e)
+		} else {
+			ready = append(ready, e)
+		}
+	}
+	if len(ready) == 0 {
+		// every circuit is open, the calls keep going to the endpoint which recovers first
+		best := open[0]
+		for _, e := range open {
+			if e.openUntil.Before(best.openUntil) {
+				best = e
+			}
+		}
+		return []*endpoint{best}
+	}
+	return ready
+}
+
+func (f *Failover) succeeded(e *endpoint) {
+	f.access.Lock()
+	defer f.access.Unlock()
+	e.failures = 0
+	e.cooldown = 0
+	e.openUntil = time.Time{}
+	for i, item := range f.endpoints {
+		if item == e {
+			f.preferred = i
+		}
+	}
+}
+
+func (f *Failover) failed(e *endpoint, now time.Time, err error) {
+	f.access.Lock()
+	defer f.access.Unlock()
+	e.failures++
+	if e.failures < failureThreshold {
+		return
+	}
+	if e.cooldown == 0 {
+		e.cooldown = minCooldown
+	} else if e.cooldown < maxCooldown {
+		e.cooldown *= 2
+		if e.cooldown > maxCooldown {
+			e.cooldown = maxCooldown
+		}
+	}
+	e.openUntil = now.Add(e.cooldown)
+	log.Warnf("panel %s failed %d times, skip it for %s: %s", e.host, e.failures, e.cooldown, err)
+}
+
+// call run fn on the endpoints until one serves it, the answers of a panel which is up are no failures
+func (f *Failover) call(name string, fn func(Backend) error) error {
+	var errs []string
+	for _, e := range f.order(time.Now()) {
+		err := fn(e.backend)
+		if err == nil || errors.Is(err, api.ErrorUserNotModified) || errors.Is(err, ErrUnsupported) {
+			f.succeeded(e)
+			log.Debugf("%s served by panel %s", name, e.host)
+			return err
+		}
+		f.failed(e, time.Now(), err)
+		log.Debugf("%s failed on panel %s: %s", name, e.host, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", e.host, err))
+	}
+	return fmt.Errorf("%s failed on every panel: %s", name, strings.Join(errs, "; "))
+}
+
+func (f *Failover) Config(nodeId api.NodeId, nodeType api.NodeType) (nodeConfig *service.NodeConfig, err error) {
+	err = f.call("config", func(b Backend) (err error) {
+		nodeConfig, err = b.Config(nodeId, nodeType)
+		return err
+	})
+	return nodeConfig, err
+}
+
+func (f *Failover) Users(nodeId api.NodeId, nodeType api.NodeType) (users *[]service.User, err error) {
+	err = f.call("users", func(b Backend) (err error) {
+		users, err = b.Users(nodeId, nodeType)
+		return err
+	})
+	return users, err
+}
+
+func (f *Failover) Submit(nodeId api.NodeId, nodeType api.NodeType, batch *service.TrafficBatch) error {
+	return f.call("submit", func(b Backend) error {
+		return b.Submit(nodeId, nodeType, batch)
+	})
+}
+
+func (f *Failover) SubmitOnline(nodeId api.NodeId, nodeType api.NodeType, onlineUsers []*OnlineUser) error {
+	return f.call("submit online", func(b Backend) error {
+		return b.SubmitOnline(nodeId, nodeType, onlineUsers)
+	})
+}
+
+func (f *Failover) SubmitStatus(nodeId api.NodeId, nodeType api.NodeType, status *Status) error {
+	return f.call("submit status", func(b Backend) error {
+		return b.SubmitStatus(nodeId, nodeType, status)
+	})
+}
+
+func (f *Failover) SubmitBreakdown(nodeId api.NodeId, nodeType api.NodeType, breakdown []*service.UserBreakdown) error {
+	return f.call("submit breakdown", func(b Backend) error {
+		return b.SubmitBreakdown(nodeId, nodeType, breakdown)
+	})
+}
@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/xflash-panda/server-client/pkg"
+)
+
+func restConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{"id": 1, "server_port": 443, "network": "tcp"})
+}
+
+func failing(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// dropping close the connection of the request without an answer, a failure resty retries
+func dropping(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		_ = conn.Close()
+	}
+}
+
+func newTestFailover(t *testing.T, panels ...*testPanel) *Failover {
+	hosts := make([]string, len(panels))
+	for i, panel := range panels {
+		hosts[i] = panel.URL
+	}
+	f, err := NewFailover(KindREST, &api.Config{APIHost: strings.Join(hosts, ","), Token: "secret", Timeout: time.Second}, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestNewFailover(t *testing.T) {
+	b, err := New(KindREST, &api.Config{APIHost: "http://a.example, http://b.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := b.(*Failover)
+	if !ok || len(f.endpoints) != 2 || f.endpoints[1].host != "http://b.example" {
+		t.Errorf("backend %#v, want a failover of both hosts", b)
+	}
+}
+
+func TestFailoverSwitch(t *testing.T) {
+	primary := newTestPanel(t, failing)
+	secondary := newTestPanel(t, restConfig)
+	f := newTestFailover(t, primary, secondary)
+
+	nodeConfig, err := f.Config(1, api.VMess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeConfig.ServerPort != 443 {
+		t.Errorf("node config %+v not the one of the secondary", nodeConfig.VMessConfig)
+	}
+	if primary.count() != 1 || secondary.count() != 1 {
+		t.Errorf("%d requests to the primary and %d to the secondary, want 1 each", primary.count(), secondary.count())
+	}
+	if got := secondary.last(t).Header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("authorization %q on the secondary, want the token", got)
+	}
+
+	// the endpoint which served the last call is tried first
+	if _, err := f.Config(1, api.VMess); err != nil {
+		t.Fatal(err)
+	}
+	if primary.count() != 1 || secondary.count() != 2 {
+		t.Errorf("%d requests to the primary and %d to the secondary, want 1 and 2", primary.count(), secondary.count())
+	}
+}
+
+func TestFailoverAllFailed(t *testing.T) {
+	primary := newTestPanel(t, failing)
+	secondary := newTestPanel(t, failing)
+	f := newTestFailover(t, primary, secondary)
+
+	_, err := f.Config(1, api.VMess)
+	if err == nil {
+		t.Fatal("failed panels returned no error")
+	}
+	if !strings.Contains(err.Error(), primary.URL) || !strings.Contains(err.Error(), secondary.URL) {
+		t.Errorf("error %q doesn't name both panels", err)
+	}
+}
+
+func TestFailoverNotModified(t *testing.T) {
+	primary := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	})
+	secondary := newTestPanel(t, failing)
+	f := newTestFailover(t, primary, secondary)
+
+	// an unchanged list is an answer of a panel which is up, the next endpoint isn't asked
+	if _, err := f.Users(1, api.VMess); !errors.Is(err, api.ErrorUserNotModified) {
+		t.Errorf("users returned %v, want %v", err, api.ErrorUserNotModified)
+	}
+	if secondary.count() != 0 {
+		t.Errorf("%d requests to the secondary, want none", secondary.count())
+	}
+}
+
+func TestFailoverCircuit(t *testing.T) {
+	f := &Failover{endpoints: []*endpoint{{host: "a"}, {host: "b"}}}
+	now := time.Now()
+	a := f.endpoints[0]
+	for i := 0; i < failureThreshold; i++ {
+		if order := f.order(now); order[0] != a {
+			t.Fatalf("endpoint a skipped after %d failures", i)
+		}
+		f.failed(a, now, errors.New("down"))
+	}
+	if order := f.order(now); len(order) != 1 || order[0].host != "b" {
+		t.Errorf("order %v, want b only once the circuit of a opened", hosts(order))
+	}
+	if order := f.order(now.Add(minCooldown)); len(order) != 2 {
+		t.Errorf("order %v, want a tried again after the cooldown", hosts(order))
+	}
+
+	// a failure after the cooldown opens the circuit for twice as long
+	f.failed(a, now.Add(minCooldown), errors.New("down"))
+	if a.cooldown != 2*minCooldown {
+		t.Errorf("cooldown %s, want %s", a.cooldown, 2*minCooldown)
+	}
+
+	// with every circuit open the endpoint which recovers first is tried
+	for i := 0; i < failureThreshold; i++ {
+		f.failed(f.endpoints[1], now, errors.New("down"))
+	}
+	if order := f.order(now); len(order) != 1 || order[0].host != "b" {
+		t.Errorf("order %v, want b which recovers first", hosts(order))
+	}
+
+	f.succeeded(a)
+	if a.failures != 0 || !a.openUntil.IsZero() || f.preferred != 0 {
+		t.Errorf("endpoint a %+v not closed after a success", *a)
+	}
+}
+
+func TestFailoverNoRetries(t *testing.T) {
+	primary := newTestPanel(t, dropping)
+	secondary := newTestPanel(t, dropping)
+	f := newTestFailover(t, primary, secondary)
+	if _, err := f.Config(1, api.VMess); err == nil {
+		t.Fatal("dropped requests returned no error")
+	}
+	if primary.count() != 1 || secondary.count() != 1 {
+		t.Errorf("%d requests to the primary and %d to the secondary, want 1 each", primary.count(), secondary.count())
+	}
+
+	// a single panel retries
+	single := newTestPanel(t, dropping)
+	if _, err := NewREST(single.config("secret")).Config(1, api.VMess); err == nil {
+		t.Fatal("dropped request returned no error")
+	}
+	if single.count() != retryCount+1 {
+		t.Errorf("%d requests to a single panel, want %d", single.count(), retryCount+1)
+	}
+}
+
+func hosts(endpoints []*endpoint) []string {
+	result := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		result[i] = e.host
+	}
+	return result
+}
@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/go-resty/resty/v2"
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+)
+
+// REST is a panel with plain json resources under the api address, the token is sent as a bearer token:
+// GET config and users, POST traffic, online, status and breakdown, each with the node_id and node_type query parameters.
+// The config and the users have the schema of the node config and the users of the panel client, without an envelope.
+type REST struct {
+	client *resty.Client
+	eTag   sync.Map
+}
+
+func NewREST(config *api.Config) *REST {
+	return newREST(config, newClient(config, retryCount))
+}
+
+func newREST(config *api.Config, client *resty.Client) *REST {
+	client.SetAuthToken(config.Token)
+	return &REST{client: client}
+}
+
+func (r *REST) request(nodeId api.NodeId, nodeType api.NodeType) *resty.Request {
+	return r.client.R().SetQueryParams(map[string]string{
+		"node_id":   strconv.Itoa(int(nodeId)),
+		"node_type": string(nodeType),
+	}).ForceContentType("application/json")
+}
+
+func (r *REST) Config(nodeId api.NodeId, nodeType api.NodeType) (*service.NodeConfig, error) {
+	res, err := r.request(nodeId, nodeType).Get("config")
+	if err := checkResponse("config", res, err); err != nil {
+		return nil, err
+	}
+	nodeConfig := &service.NodeConfig{}
+	if err := json.Unmarshal(res.Body(), nodeConfig); err != nil {
+		return nil, fmt.Errorf("parse node config failed: %s", err)
+	}
+	return nodeConfig, nil
+}
+
+// Users return the users of the node with their limits, the panel may answer 304 to the etag of the last list
+func (r *REST) Users(nodeId api.NodeId, nodeType api.NodeType) (*[]service.User, error) {
+	request := r.request(nodeId, nodeType)
+	if eTag, ok := r.eTag.Load(nodeId); ok {
+		request.SetHeader("If-None-Match", eTag.(string))
+	}
+	res, err := request.Get("users")
+	if err := checkResponse("users", res, err); err != nil {
+		return nil, err
+	}
+	if res.StatusCode() == http.StatusNotModified {
+		return nil, api.ErrorUserNotModified
+	}
+	var users []service.User
+	if err := json.Unmarshal(res.Body(), &users); err != nil {
+		return nil, fmt.Errorf("parse users failed: %s", err)
+	}
+	if eTag := res.Header().Get("ETag"); eTag != "" {
+		r.eTag.Store(nodeId, eTag)
+	}
+	return &users, nil
+}
+
+func (r *REST) post(path string, nodeId api.NodeId, nodeType api.NodeType, body interface{}) error {
+	res, err := r.request(nodeId, nodeType).SetBody(body).Post(path)
+	return checkResponse(path, res, err)
+}
+
+func (r *REST) Submit(nodeId api.NodeId, nodeType api.NodeType, batch *service.TrafficBatch) error {
+	res, err := r.request(nodeId, nodeType).
+		SetHeader(HeaderIdempotencyKey, strconv.FormatUint(batch.ID, 10)).
+		SetBody(batch).
+		Post("traffic")
+	return checkResponse("traffic", res, err)
+}
+
+func (r *REST) SubmitOnline(nodeId api.NodeId, nodeType api.NodeType, onlineUsers []*OnlineUser) error {
+	return r.post("online", nodeId, nodeType, onlineUsers)
+}
+
+func (r *REST) SubmitStatus(nodeId api.NodeId, nodeType api.NodeType, status *Status) error {
+	return r.post("status", nodeId, nodeType, status)
+}
+
+func (r *REST) SubmitBreakdown(nodeId api.NodeId, nodeType api.NodeType, breakdown []*service.UserBreakdown) error {
+	return r.post("breakdown", nodeId, nodeType, breakdown)
+}
@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+)
+
+func TestRESTConfig(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"id": 1, "server_port": 443, "network": "tcp", "tls": 0})
+	})
+	nodeConfig, err := NewREST(panel.config("secret")).Config(1, api.VMess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	if r.Method != http.MethodGet || r.Path != "/config" {
+		t.Errorf("request %s %s, want GET /config", r.Method, r.Path)
+	}
+	checkQuery(t, r, "node_id", "1")
+	checkQuery(t, r, "node_type", "vmess")
+	if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("authorization %q, want the token as a bearer token", got)
+	}
+	if nodeConfig.ServerPort != 443 || nodeConfig.Network != "tcp" {
+		t.Errorf("node config %+v not decoded", nodeConfig.VMessConfig)
+	}
+}
+
+func TestRESTUsers(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		writeJSON(w, []map[string]interface{}{
+			{"id": 1, "uuid": "uuid-1", "conn_limit": 5, "conn_rate": 2},
+			{"id": 2, "uuid": "uuid-2"},
+		})
+	})
+	rest := NewREST(panel.config("secret"))
+	users, err := rest.Users(1, api.VMess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	if r.Path != "/users" || r.Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("request %s with authorization %q", r.Path, r.Header.Get("Authorization"))
+	}
+	if len(*users) != 2 {
+		t.Fatalf("users %+v not decoded", *users)
+	}
+	if user := (*users)[0]; user.ID != 1 || user.UUID != "uuid-1" || user.ConnLimit != 5 || user.ConnRate != 2 {
+		t.Errorf("user %+v, want the limits of the panel", user)
+	}
+
+	if _, err := rest.Users(1, api.VMess); !errors.Is(err, api.ErrorUserNotModified) {
+		t.Errorf("users of the same etag returned %v, want %v", err, api.ErrorUserNotModified)
+	}
+}
+
+func TestRESTSubmit(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if err := NewREST(panel.config("secret")).Submit(1, api.VMess, testBatch()); err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	if r.Method != http.MethodPost || r.Path != "/traffic" {
+		t.Errorf("request %s %s, want POST /traffic", r.Method, r.Path)
+	}
+	checkQuery(t, r, "node_id", "1")
+	if got := r.Header.Get(HeaderIdempotencyKey); got != "42" {
+		t.Errorf("header %s = %q, want 42", HeaderIdempotencyKey, got)
+	}
+	// the batch is the body, with its id, window and the raw traffic
+	var batch service.TrafficBatch
+	r.decode(t, &batch)
+	if batch.ID != 42 || batch.Start.Unix() != 1700000000 || batch.End.Unix() != 1700000060 {
+		t.Errorf("batch %d from %s to %s, want the id and window of the batch", batch.ID, batch.Start, batch.End)
+	}
+	if len(batch.Traffic) != 1 || batch.Traffic[0].Upload != 100 || batch.Traffic[0].RawUpload != 50 {
+		t.Errorf("traffic %+v, want the charged and the raw traffic", batch.Traffic)
+	}
+}
+
+func TestRESTSubmitFailed(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	})
+	if err := NewREST(panel.config("secret")).Submit(1, api.VMess, testBatch()); err == nil {
+		t.Error("rejected batch returned no error")
+	}
+}
+
+func TestRESTReports(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	rest := NewREST(panel.config("secret"))
+	if err := rest.SubmitOnline(1, api.VMess, []*OnlineUser{{UID: 1, IP: "203.0.113.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	var online []OnlineUser
+	r.decode(t, &online)
+	if r.Path != "/online" || len(online) != 1 || online[0].IP != "203.0.113.1" {
+		t.Errorf("online report %s %s", r.Path, r.Body)
+	}
+
+	if err := rest.SubmitStatus(1, api.VMess, &Status{CPU: 12.5, Connections: 3}); err != nil {
+		t.Fatal(err)
+	}
+	r = panel.last(t)
+	var status Status
+	r.decode(t, &status)
+	if r.Path != "/status" || status.CPU != 12.5 || status.Connections != 3 {
+		t.Errorf("status report %s %s", r.Path, r.Body)
+	}
+
+	breakdown := []*service.UserBreakdown{{UID: 1, Traffic: []*service.ClassTraffic{{Class: "http", Network: "tcp", Upload: 1, Download: 2}}}}
+	if err := rest.SubmitBreakdown(1, api.VMess, breakdown); err != nil {
+		t.Fatal(err)
+	}
+	r = panel.last(t)
+	var got []service.UserBreakdown
+	r.decode(t, &got)
+	if r.Path != "/breakdown" || len(got) != 1 || got[0].Traffic[0].Class != "http" {
+		t.Errorf("breakdown report %s %s", r.Path, r.Body)
+	}
+}
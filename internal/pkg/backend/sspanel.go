@@ -0,0 +1,240 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-resty/resty/v2"
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+)
+
+// SSPanel is a panel with the mod_mu API of SSPanel-UIM, the token is the mu key
+type SSPanel struct {
+	access sync.Mutex
+	client *resty.Client
+	users  []service.User
+}
+
+func NewSSPanel(config *api.Config) *SSPanel {
+	return newSSPanel(config, newClient(config, retryCount))
+}
+
+func newSSPanel(config *api.Config, client *resty.Client) *SSPanel {
+	client.SetQueryParam("key", config.Token)
+	return &SSPanel{client: client}
+}
+
+// ssPanelResp is the envelope of the mod_mu API, ret is 1 on success
+type ssPanelResp struct {
+	Ret  int             `json:"ret"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+type ssPanelNode struct {
+	Sort         int                    `json:"sort"`
+	Server       string                 `json:"server"`
+	CustomConfig map[string]interface{} `json:"custom_config"`
+}
+
+type ssPanelUser struct {
+	ID   int    `json:"id"`
+	UUID string `json:"uuid"`
+}
+
+type ssPanelTraffic struct {
+	UID      int    `json:"user_id"`
+	Upload   uint64 `json:"u"`
+	Download uint64 `json:"d"`
+}
+
+type ssPanelStatus struct {
+	Uptime uint64 `json:"uptime"`
+	Load   string `json:"load"`
+}
+
+func (s *SSPanel) get(path string, query map[string]string, data interface{}) error {
+	res, err := s.client.R().SetQueryParams(query).ForceContentType("application/json").Get(path)
+	return s.parse(path, res, err, data)
+}
+
+func (s *SSPanel) post(path string, query map[string]string, body interface{}) error {
+	res, err := s.client.R().SetQueryParams(query).SetBody(body).ForceContentType("application/json").Post(path)
+	return s.parse(path, res, err, nil)
+}
+
+func (s *SSPanel) parse(path string, res *resty.Response, err error, data interface{}) error {
+	if err := checkResponse(path, res, err); err != nil {
+		return err
+	}
+	resp := &ssPanelResp{}
+	if err := json.Unmarshal(res.Body(), resp); err != nil {
+		return fmt.Errorf("parse response of %s failed: %s", path, err)
+	}
+	if resp.Ret != 1 {
+		return fmt.Errorf("request %s failed: %s", path, resp.Msg)
+	}
+	if data != nil {
+		if err := json.Unmarshal(resp.Data, data); err != nil {
+			return fmt.Errorf("parse data of %s failed: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// Config turn the custom_config of the node, or the server of an older panel, into the node config
+func (s *SSPanel) Config(nodeId api.NodeId, nodeType api.NodeType) (*service.NodeConfig, error) {
+	node := &ssPanelNode{}
+	if err := s.get(fmt.Sprintf("/mod_mu/nodes/%d/info", nodeId), nil, node); err != nil {
+		return nil, err
+	}
+	settings := node.CustomConfig
+	if len(settings) == 0 {
+		settings = parseSSPanelServer(node.Server)
+	}
+	port, err := strconv.Atoi(ssPanelString(settings, "offset_port_node", "offset_port_user"))
+	if err != nil {
+		return nil, fmt.Errorf("node %d has no port in sspanel: %s", nodeId, err)
+	}
+	network := ssPanelString(settings, "network")
+	if network == "" {
+		network = service.TCP
+	}
+	host := ssPanelString(settings, "host")
+	path := ssPanelString(settings, "path")
+	config := map[string]interface{}{
+		"id":          int(nodeId),
+		"server_port": port,
+		"network":     network,
+		"tls":         0,
+	}
+	if security := ssPanelString(settings, "security"); security == service.TLS {
+		config["tls"] = 1
+		config["tls_settings"] = map[string]interface{}{"serverName": host}
+	}
+	switch network {
+	case "ws":
+		wsSettings := map[string]interface{}{"path": path}
+		if host != "" {
+			wsSettings["headers"] = map[string]string{"Host": host}
+		}
+		config["ws_settings"] = wsSettings
+	case "grpc":
+		config["grpc_settings"] = map[string]interface{}{"serviceName": ssPanelString(settings, "servicename")}
+	case "h2":
+		h2Config := map[string]interface{}{"path": path}
+		if host != "" {
+			h2Config["host"] = []string{host}
+		}
+		config["h2_config"] = h2Config
+	case "tcp":
+		if header, ok := settings["header"]; ok {
+			config["tcp_settings"] = map[string]interface{}{"header": header}
+		}
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	nodeConfig := &service.NodeConfig{}
+	if err := json.Unmarshal(data, nodeConfig); err != nil {
+		return nil, fmt.Errorf("convert node of sspanel failed: %s", err)
+	}
+	return nodeConfig, nil
+}
+
+// parseSSPanelServer read the server of a node, address;port;alterId;network;tls;path=/ws|host=example.com|inside_port=443
+func parseSSPanelServer(server string) map[string]interface{} {
+	settings := map[string]interface{}{}
+	fields := strings.Split(server, ";")
+	if len(fields) > 1 {
+		settings["offset_port_node"] = fields[1]
+	}
+	if len(fields) > 3 {
+		settings["network"] = fields[3]
+	}
+	if len(fields) > 4 {
+		settings["security"] = fields[4]
+	}
+	if len(fields) > 5 {
+		for _, item := range strings.Split(fields[5], "|") {
+			key, value, ok := strings.Cut(item, "=")
+			if !ok {
+				continue
+			}
+			if key == "inside_port" {
+				// the port behind the relay of the panel
+				key = "offset_port_node"
+			}
+			settings[key] = value
+		}
+	}
+	return settings
+}
+
+// ssPanelString return the first of keys set in settings, sspanel saves numbers as strings or numbers
+func ssPanelString(settings map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		switch value := settings[key].(type) {
+		case string:
+			if value != "" {
+				return value
+			}
+		case float64:
+			return strconv.FormatFloat(value, 'f', -1, 64)
+		}
+	}
+	return ""
+}
+
+// Users return the users of the node, sspanel has no etag so the list is compared with the last one
+func (s *SSPanel) Users(nodeId api.NodeId, nodeType api.NodeType) (*[]service.User, error) {
+	var ssUsers []ssPanelUser
+	if err := s.get("/mod_mu/users", map[string]string{"node_id": strconv.Itoa(int(nodeId))}, &ssUsers); err != nil {
+		return nil, err
+	}
+	users := make([]service.User, len(ssUsers))
+	for i, user := range ssUsers {
+		users[i] = service.User{User: api.User{ID: user.ID, UUID: user.UUID}}
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	if s.users != nil && reflect.DeepEqual(users, s.users) {
+		return nil, api.ErrorUserNotModified
+	}
+	s.users = users
+	return &users, nil
+}
+
+// Submit report the charged traffic, the id of the batch is in the query for the panels which check it
+func (s *SSPanel) Submit(nodeId api.NodeId, nodeType api.NodeType, batch *service.TrafficBatch) error {
+	traffic := make([]*ssPanelTraffic, len(batch.Traffic))
+	for i, t := range batch.Traffic {
+		traffic[i] = &ssPanelTraffic{UID: t.UID, Upload: t.Upload, Download: t.Download}
+	}
+	query := batchParams(batch)
+	query["node_id"] = strconv.Itoa(int(nodeId))
+	return s.post("/mod_mu/users/traffic", query, map[string]interface{}{"data": traffic})
+}
+
+func (s *SSPanel) SubmitOnline(nodeId api.NodeId, nodeType api.NodeType, onlineUsers []*OnlineUser) error {
+	return s.post("/mod_mu/users/aliveip", map[string]string{"node_id": strconv.Itoa(int(nodeId))},
+		map[string]interface{}{"data": onlineUsers})
+}
+
+// SubmitStatus report the uptime and the load, the fields sspanel keeps
+func (s *SSPanel) SubmitStatus(nodeId api.NodeId, nodeType api.NodeType, status *Status) error {
+	return s.post(fmt.Sprintf("/mod_mu/nodes/%d/info", nodeId), nil, &ssPanelStatus{
+		Uptime: status.Uptime,
+		Load:   fmt.Sprintf("%.2f %.2f %.2f", status.Load[0], status.Load[1], status.Load[2]),
+	})
+}
+
+func (s *SSPanel) SubmitBreakdown(nodeId api.NodeId, nodeType api.NodeType, breakdown []*service.UserBreakdown) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	api "github.com/xflash-panda/server-client/pkg"
+)
+
+func ssPanelOK(w http.ResponseWriter, data interface{}) {
+	writeJSON(w, map[string]interface{}{"ret": 1, "data": data})
+}
+
+func TestSSPanelConfig(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		ssPanelOK(w, map[string]interface{}{
+			"sort": 11,
+			"custom_config": map[string]interface{}{
+				"offset_port_node": "443", "network": "ws", "security": "tls", "path": "/ws", "host": "example.com",
+			},
+		})
+	})
+	nodeConfig, err := NewSSPanel(panel.config("mukey")).Config(7, api.VMess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	if r.Method != http.MethodGet || r.Path != "/mod_mu/nodes/7/info" {
+		t.Errorf("request %s %s, want GET /mod_mu/nodes/7/info", r.Method, r.Path)
+	}
+	checkQuery(t, r, "key", "mukey")
+	if nodeConfig.ID != 7 || nodeConfig.ServerPort != 443 || nodeConfig.Network != "ws" || nodeConfig.TLS != 1 {
+		t.Errorf("node config %+v not converted", nodeConfig.VMessConfig)
+	}
+	if nodeConfig.WebSocketConfig == nil || nodeConfig.WebSocketConfig.Path != "/ws" || nodeConfig.WebSocketConfig.Headers["Host"] != "example.com" {
+		t.Errorf("ws settings %+v not converted", nodeConfig.WebSocketConfig)
+	}
+}
+
+func TestSSPanelConfigServer(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		ssPanelOK(w, map[string]interface{}{"sort": 11, "server": "1.2.3.4;10086;0;ws;;path=/ws|host=example.com|inside_port=8443"})
+	})
+	nodeConfig, err := NewSSPanel(panel.config("mukey")).Config(7, api.VMess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the port behind the relay of the panel is the one listened on
+	if nodeConfig.ServerPort != 8443 || nodeConfig.Network != "ws" || nodeConfig.TLS != 0 {
+		t.Errorf("node config %+v not converted from the server", nodeConfig.VMessConfig)
+	}
+}
+
+func TestSSPanelFailed(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"ret": 0, "msg": "wrong key"})
+	})
+	if _, err := NewSSPanel(panel.config("mukey")).Config(7, api.VMess); err == nil {
+		t.Error("ret 0 returned no error")
+	}
+}
+
+func TestSSPanelUsers(t *testing.T) {
+	uuid := "uuid-1"
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		ssPanelOK(w, []map[string]interface{}{{"id": 1, "uuid": uuid, "node_speedlimit": 0}})
+	})
+	s := NewSSPanel(panel.config("mukey"))
+	users, err := s.Users(7, api.VMess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	if r.Path != "/mod_mu/users" {
+		t.Errorf("path %s, want /mod_mu/users", r.Path)
+	}
+	checkQuery(t, r, "node_id", "7")
+	checkQuery(t, r, "key", "mukey")
+	if len(*users) != 1 || (*users)[0].ID != 1 || (*users)[0].UUID != "uuid-1" {
+		t.Errorf("users %+v not decoded", *users)
+	}
+
+	// sspanel has no etag, the same list is reported as not modified
+	if _, err := s.Users(7, api.VMess); !errors.Is(err, api.ErrorUserNotModified) {
+		t.Errorf("same users returned %v, want %v", err, api.ErrorUserNotModified)
+	}
+	uuid = "uuid-2"
+	if users, err = s.Users(7, api.VMess); err != nil || (*users)[0].UUID != "uuid-2" {
+		t.Errorf("changed users returned %v, %v", users, err)
+	}
+}
+
+func TestSSPanelSubmit(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		ssPanelOK(w, "ok")
+	})
+	if err := NewSSPanel(panel.config("mukey")).Submit(7, api.VMess, testBatch()); err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	if r.Method != http.MethodPost || r.Path != "/mod_mu/users/traffic" {
+		t.Errorf("request %s %s, want POST /mod_mu/users/traffic", r.Method, r.Path)
+	}
+	checkQuery(t, r, "node_id", "7")
+	checkQuery(t, r, "key", "mukey")
+	checkBatchParams(t, r)
+	var body struct {
+		Data []ssPanelTraffic `json:"data"`
+	}
+	r.decode(t, &body)
+	if len(body.Data) != 1 || body.Data[0] != (ssPanelTraffic{UID: 1, Upload: 100, Download: 200}) {
+		t.Errorf("traffic %+v, want the charged traffic of the batch", body.Data)
+	}
+}
+
+func TestSSPanelSubmitOnline(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		ssPanelOK(w, "ok")
+	})
+	online := []*OnlineUser{{UID: 1, IP: "203.0.113.1"}}
+	if err := NewSSPanel(panel.config("mukey")).SubmitOnline(7, api.VMess, online); err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	if r.Path != "/mod_mu/users/aliveip" {
+		t.Errorf("path %s, want /mod_mu/users/aliveip", r.Path)
+	}
+	checkQuery(t, r, "node_id", "7")
+	var body struct {
+		Data []OnlineUser `json:"data"`
+	}
+	r.decode(t, &body)
+	if len(body.Data) != 1 || body.Data[0] != *online[0] {
+		t.Errorf("online users %+v, want %+v", body.Data, *online[0])
+	}
+}
+
+func TestSSPanelSubmitStatus(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		ssPanelOK(w, "ok")
+	})
+	status := &Status{Uptime: 3600, Load: [3]float64{0.5, 0.25, 1}}
+	if err := NewSSPanel(panel.config("mukey")).SubmitStatus(7, api.VMess, status); err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	if r.Method != http.MethodPost || r.Path != "/mod_mu/nodes/7/info" {
+		t.Errorf("request %s %s, want POST /mod_mu/nodes/7/info", r.Method, r.Path)
+	}
+	var body ssPanelStatus
+	r.decode(t, &body)
+	if body != (ssPanelStatus{Uptime: 3600, Load: "0.50 0.25 1.00"}) {
+		t.Errorf("status %+v not converted", body)
+	}
+}
@@ -0,0 +1,63 @@
+package backend
+
+import (
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+)
+
+// V2board is the panel of the panel client, it has no endpoint for the online users, the status and the breakdown.
+// The calls are the ones of the panel client, which retries a failed request itself.
+type V2board struct {
+	client *api.Client
+}
+
+func NewV2board(config *api.Config) *V2board {
+	return &V2board{client: api.New(config)}
+}
+
+// Config get the node config with the fields the panel client doesn't parse
+func (v *V2board) Config(nodeId api.NodeId, nodeType api.NodeType) (*service.NodeConfig, error) {
+	raw, err := v.client.RawConfig(nodeId, nodeType)
+	if err != nil {
+		return nil, err
+	}
+	return service.UnmarshalNodeConfig(raw)
+}
+
+// Users return the users of the node, the panel has no limits for them so they take the default of the node
+func (v *V2board) Users(nodeId api.NodeId, nodeType api.NodeType) (*[]service.User, error) {
+	userList, err := v.client.Users(nodeId, nodeType)
+	if err != nil {
+		return nil, err
+	}
+	var users []service.User
+	if userList != nil {
+		users = make([]service.User, len(*userList))
+		for i, user := range *userList {
+			users[i] = service.User{User: user}
+		}
+	}
+	return &users, nil
+}
+
+// Submit report the charged traffic, the panel has no field for the raw one nor the id of the batch,
+// so a batch submitted again after a lost answer is charged again
+func (v *V2board) Submit(nodeId api.NodeId, nodeType api.NodeType, batch *service.TrafficBatch) error {
+	traffic := make([]*api.UserTraffic, len(batch.Traffic))
+	for i, t := range batch.Traffic {
+		traffic[i] = &t.UserTraffic
+	}
+	return v.client.Submit(nodeId, nodeType, traffic)
+}
+
+func (v *V2board) SubmitOnline(nodeId api.NodeId, nodeType api.NodeType, onlineUsers []*OnlineUser) error {
+	return ErrUnsupported
+}
+
+func (v *V2board) SubmitStatus(nodeId api.NodeId, nodeType api.NodeType, status *Status) error {
+	return ErrUnsupported
+}
+
+func (v *V2board) SubmitBreakdown(nodeId api.NodeId, nodeType api.NodeType, breakdown []*service.UserBreakdown) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	api "github.com/xflash-panda/server-client/pkg"
+)
+
+func TestV2boardConfig(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"data": map[string]interface{}{
+				"id": 1, "server_port": 443, "network": "ws", "tls": 1,
+				"ws_settings": map[string]interface{}{"path": "/ws"},
+				"tls_cert":    "cert", "tls_key": "key",
+			},
+		})
+	})
+	nodeConfig, err := NewV2board(panel.config("token")).Config(1, api.VMess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	if r.Method != http.MethodGet || r.Path != "/api/v1/server/vmess/config" {
+		t.Errorf("request %s %s, want GET /api/v1/server/vmess/config", r.Method, r.Path)
+	}
+	checkQuery(t, r, "node_id", "1")
+	checkQuery(t, r, "token", "token")
+	if nodeConfig.ServerPort != 443 || nodeConfig.Network != "ws" || nodeConfig.WebSocketConfig == nil || nodeConfig.WebSocketConfig.Path != "/ws" {
+		t.Errorf("node config %+v not decoded", nodeConfig.VMessConfig)
+	}
+	if !nodeConfig.HasCert() {
+		t.Error("certificate of the panel not decoded")
+	}
+}
+
+func TestV2boardConfigMessage(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"message": "node not found"})
+	})
+	if _, err := NewV2board(panel.config("token")).Config(1, api.VMess); err == nil {
+		t.Error("message of the panel not returned as an error")
+	}
+}
+
+func TestV2boardUsers(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		writeJSON(w, map[string]interface{}{
+			"data": []map[string]interface{}{{"id": 1, "uuid": "uuid-1"}, {"id": 2, "uuid": "uuid-2"}},
+		})
+	})
+	v := NewV2board(panel.config("token"))
+	users, err := v.Users(1, api.VMess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	if r.Path != "/api/v1/server/vmess/users" {
+		t.Errorf("path %s, want /api/v1/server/vmess/users", r.Path)
+	}
+	checkQuery(t, r, "node_id", "1")
+	checkQuery(t, r, "token", "token")
+	if len(*users) != 2 || (*users)[1].ID != 2 || (*users)[1].UUID != "uuid-2" {
+		t.Errorf("users %+v not decoded", *users)
+	}
+	if (*users)[0].ConnLimit != 0 || (*users)[0].ConnRate != 0 {
+		t.Errorf("user %+v has limits, v2board has none", (*users)[0])
+	}
+
+	if _, err := v.Users(1, api.VMess); !errors.Is(err, api.ErrorUserNotModified) {
+		t.Errorf("users of the same etag returned %v, want %v", err, api.ErrorUserNotModified)
+	}
+}
+
+func TestV2boardSubmit(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"data": true})
+	})
+	if err := NewV2board(panel.config("token")).Submit(1, api.VMess, testBatch()); err != nil {
+		t.Fatal(err)
+	}
+	r := panel.last(t)
+	if r.Method != http.MethodPost || r.Path != "/api/v1/server/vmess/submit" {
+		t.Errorf("request %s %s, want POST /api/v1/server/vmess/submit", r.Method, r.Path)
+	}
+	checkQuery(t, r, "node_id", "1")
+	checkQuery(t, r, "token", "token")
+	var traffic []api.UserTraffic
+	r.decode(t, &traffic)
+	if len(traffic) != 1 || traffic[0] != (api.UserTraffic{UID: 1, Upload: 100, Download: 200, Count: 3}) {
+		t.Errorf("traffic %+v, want the charged traffic of the batch", traffic)
+	}
+}
+
+func TestV2boardSubmitFailed(t *testing.T) {
+	panel := newTestPanel(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if err := NewV2board(panel.config("token")).Submit(1, api.VMess, testBatch()); err == nil {
+		t.Error("failed submit returned no error")
+	}
+}
+
+func TestV2boardUnsupported(t *testing.T) {
+	v := NewV2board(&api.Config{APIHost: "http://127.0.0.1:1"})
+	if err := v.SubmitOnline(1, api.VMess, nil); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("submit online returned %v, want %v", err, ErrUnsupported)
+	}
+	if err := v.SubmitStatus(1, api.VMess, &Status{}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("submit status returned %v, want %v", err, ErrUnsupported)
+	}
+	if err := v.SubmitBreakdown(1, api.VMess, nil); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("submit breakdown returned %v, want %v", err, ErrUnsupported)
+	}
+}
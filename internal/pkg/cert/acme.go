@@ -0,0 +1,186 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xtls/xray-core/common/task"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+type ACMEConfig struct {
+	Enabled bool
+	// Domain defaults to the server name of the node config
+	Domain       string
+	Email        string
+	DirectoryURL string
+	// DirectoryCA is a PEM file trusted for the directory, e.g. the root of a local Pebble
+	DirectoryCA string
+	Challenge   string
+	HTTPPort    int
+	TLSPort     int
+	RenewBefore time.Duration
+	CacheDir    string
+}
+
+// ACME obtains and renews the certificate of a single domain, and reports every renewed certificate
+type ACME struct {
+	access        sync.Mutex
+	config        *ACMEConfig
+	manager       *autocert.Manager
+	current       *Pair
+	onRenew       func(*Pair) error
+	server        *http.Server
+	listener      net.Listener
+	renewPeriodic *task.Periodic
+}
+
+// NewACME validate the config and start the challenge listener, so Obtain can be called right away
+func NewACME(config *ACMEConfig) (*ACME, error) {
+	if config.Domain == "" {
+		return nil, errors.New("acme requires a domain")
+	}
+	if config.Challenge != ChallengeHTTP01 && config.Challenge != ChallengeTLSALPN01 {
+		return nil, fmt.Errorf("acme challenge %s not supported", config.Challenge)
+	}
+	client := &acme.Client{DirectoryURL: config.DirectoryURL}
+	if config.DirectoryCA != "" {
+		httpClient, err := caHTTPClient(config.DirectoryCA)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = httpClient
+	}
+	a := &ACME{
+		config: config,
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(config.CacheDir),
+			HostPolicy:  autocert.HostWhitelist(config.Domain),
+			RenewBefore: config.RenewBefore,
+			Client:      client,
+			Email:       config.Email,
+		},
+	}
+	if err := a.listen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// listen serve the challenge, it keeps running for the renewals
+func (a *ACME) listen() error {
+	var err error
+	if a.config.Challenge == ChallengeHTTP01 {
+		a.listener, err = net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(a.config.HTTPPort)))
+		if err != nil {
+			return fmt.Errorf("acme http-01 listen failed: %s", err)
+		}
+		a.server = &http.Server{Handler: a.manager.HTTPHandler(nil), ReadHeaderTimeout: 10 * time.Second}
+	} else {
+		a.listener, err = tls.Listen("tcp", net.JoinHostPort("", strconv.Itoa(a.config.TLSPort)), &tls.Config{
+			GetCertificate: a.manager.GetCertificate,
+			NextProtos:     []string{acme.ALPNProto},
+		})
+		if err != nil {
+			return fmt.Errorf("acme tls-alpn-01 listen failed: %s", err)
+		}
+		a.server = &http.Server{Handler: http.NotFoundHandler(), ReadHeaderTimeout: 10 * time.Second}
+	}
+	go func() {
+		if err := a.server.Serve(a.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("acme challenge server stopped: %s", err)
+		}
+	}()
+	return nil
+}
+
+// Obtain return the certificate from the cache, or request it from the ACME server
+func (a *ACME) Obtain() (*Pair, error) {
+	certificate, err := a.manager.GetCertificate(&tls.ClientHelloInfo{
+		ServerName: a.config.Domain,
+		// ask for an ECDSA certificate
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("acme obtain certificate for %s failed: %s", a.config.Domain, err)
+	}
+	pair, err := pairFromTLS(certificate)
+	if err != nil {
+		return nil, err
+	}
+	a.access.Lock()
+	a.current = pair
+	a.access.Unlock()
+	log.Infof("acme certificate for %s valid until %s", a.config.Domain, pair.Leaf.NotAfter.Format(time.RFC3339))
+	return pair, nil
+}
+
+// Start check for renewed certificates periodically, onRenew is called with every new certificate
+func (a *ACME) Start(onRenew func(*Pair) error) error {
+	a.onRenew = onRenew
+	a.renewPeriodic = &task.Periodic{
+		Interval: time.Hour,
+		Execute:  a.checkRenew,
+	}
+	return a.renewPeriodic.Start()
+}
+
+// checkRenew autocert renews in the background, a different certificate means it did
+func (a *ACME) checkRenew() error {
+	a.access.Lock()
+	previous := a.current
+	a.access.Unlock()
+
+	pair, err := a.Obtain()
+	if err != nil {
+		log.Errorln(err)
+		return nil
+	}
+	if pair.Same(previous) {
+		return nil
+	}
+	log.Infof("acme certificate for %s renewed", a.config.Domain)
+	if err := a.onRenew(pair); err != nil {
+		log.Errorf("apply renewed acme certificate failed: %s", err)
+	}
+	return nil
+}
+
+func (a *ACME) Close() error {
+	if a.renewPeriodic != nil {
+		if err := a.renewPeriodic.Close(); err != nil {
+			return err
+		}
+	}
+	return a.server.Close()
+}
+
+func caHTTPClient(caFile string) (*http.Client, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read acme directory ca failed: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}, nil
+}
@@ -0,0 +1,48 @@
+package cert
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	cacheCertFile = "server.crt"
+	cacheKeyFile  = "server.key"
+)
+
+// SaveCache write the pair into dir, readable by the owner only
+func SaveCache(dir string, pair *Pair) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create certificate cache failed: %s", err)
+	}
+	if err := writeFile(filepath.Join(dir, cacheKeyFile), pair.KeyPEM); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, cacheCertFile), pair.CertPEM)
+}
+
+// LoadCache return the pair saved in dir
+func LoadCache(dir string) (*Pair, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, cacheCertFile))
+	if err != nil {
+		return nil, fmt.Errorf("read cached certificate failed: %s", err)
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, cacheKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("read cached key failed: %s", err)
+	}
+	return ParsePair(certPEM, keyPEM)
+}
+
+// writeFile replace the file by a rename, so a crash never leaves half of it
+func writeFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write %s failed: %s", tmp, err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("rename %s failed: %s", tmp, err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package cert
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xtls/xray-core/common/task"
+)
+
+// Status describes the certificate in use, the expiry is the earliest of the whole chain
+type Status struct {
+	Subject    string    `json:"subject"`
+	Issuer     string    `json:"issuer"`
+	DNSNames   []string  `json:"dns_names"`
+	NotAfter   time.Time `json:"not_after"`
+	ExpiringCN string    `json:"expiring_cn"`
+	DaysLeft   int       `json:"days_left"`
+	ServerName string    `json:"server_name"`
+	NameMatch  bool      `json:"name_match"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Monitor checks the expiry of the certificate in use and warns at each threshold
+type Monitor struct {
+	access     sync.Mutex
+	serverName string
+	warnDays   []int
+	load       func() (*Pair, error)
+	onStatus   func(*Status)
+	status     *Status
+	// warned is the smallest threshold warned about, so each one is logged once
+	warned   int
+	periodic *task.Periodic
+}
+
+// NewMonitor return a monitor of the pair returned by load, warnDays is a comma separated list of days, e.g. 30,7,1
+func NewMonitor(serverName string, warnDays string, load func() (*Pair, error), onStatus func(*Status)) (*Monitor, error) {
+	m := &Monitor{
+		serverName: serverName,
+		load:       load,
+		onStatus:   onStatus,
+		warned:     -1,
+	}
+	for _, item := range strings.Split(warnDays, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		days, err := strconv.Atoi(item)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid certificate warning days %s", item)
+		}
+		m.warnDays = append(m.warnDays, days)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(m.warnDays)))
+	m.periodic = &task.Periodic{
+		Interval: time.Hour,
+		Execute: func() error {
+			m.Check()
+			return nil
+		},
+	}
+	return m, nil
+}
+
+func (m *Monitor) Start() error {
+	return m.periodic.Start()
+}
+
+// Check inspect the certificate now, e.g. after it has been replaced
+func (m *Monitor) Check() {
+	m.access.Lock()
+	defer m.access.Unlock()
+
+	status := &Status{ServerName: m.serverName}
+	pair, err := m.load()
+	if err != nil {
+		status.Error = err.Error()
+		log.Errorf("certificate status unknown: %s", err)
+	} else {
+		m.inspect(pair, status)
+	}
+	m.status = status
+	m.onStatus(status)
+}
+
+func (m *Monitor) inspect(pair *Pair, status *Status) {
+	status.Subject = pair.Leaf.Subject.String()
+	status.Issuer = pair.Leaf.Issuer.String()
+	status.DNSNames = pair.Leaf.DNSNames
+	status.NotAfter = pair.Leaf.NotAfter
+	status.ExpiringCN = pair.Leaf.Subject.CommonName
+	for _, c := range chain(pair.CertPEM) {
+		if c.NotAfter.Before(status.NotAfter) {
+			status.NotAfter = c.NotAfter
+			status.ExpiringCN = c.Subject.CommonName
+		}
+	}
+	// floor, so a certificate which expired an hour ago is -1 days left
+	status.DaysLeft = int(math.Floor(time.Until(status.NotAfter).Hours() / 24))
+	status.NameMatch = m.serverName == "" || pair.Leaf.VerifyHostname(m.serverName) == nil
+
+	if !status.NameMatch {
+		log.Warnf("certificate %s doesn't cover the server name %s", status.Subject, m.serverName)
+	}
+	if status.DaysLeft < 0 {
+		log.Errorf("certificate %s expired at %s", status.ExpiringCN, status.NotAfter.Format(time.RFC3339))
+		return
+	}
+	threshold := -1
+	for _, days := range m.warnDays {
+		if status.DaysLeft <= days {
+			threshold = days
+		}
+	}
+	if threshold < 0 {
+		// renewed, warn again next time
+		m.warned = -1
+		return
+	}
+	if m.warned < 0 || threshold < m.warned {
+		m.warned = threshold
+		log.Warnf("certificate %s expires in %d days at %s", status.ExpiringCN, status.DaysLeft, status.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// Status return the result of the last check
+func (m *Monitor) Status() *Status {
+	m.access.Lock()
+	defer m.access.Unlock()
+	return m.status
+}
+
+func (m *Monitor) Close() error {
+	return m.periodic.Close()
+}
+
+// chain parse every certificate of the PEM, the unparsable ones are skipped
+func chain(certPEM []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if c, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, c)
+		}
+	}
+}
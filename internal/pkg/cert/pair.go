@@ -0,0 +1,48 @@
+// Package cert provides the certificate of the TLS inbound
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// Pair is a certificate chain and its private key which are known to match
+type Pair struct {
+	CertPEM []byte
+	KeyPEM  []byte
+	Leaf    *x509.Certificate
+}
+
+// ParsePair validate that the key matches the certificate
+func ParsePair(certPEM []byte, keyPEM []byte) (*Pair, error) {
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key pair: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %s", err)
+	}
+	return &Pair{CertPEM: certPEM, KeyPEM: keyPEM, Leaf: leaf}, nil
+}
+
+// pairFromTLS encode a tls.Certificate into PEM
+func pairFromTLS(certificate *tls.Certificate) (*Pair, error) {
+	var certPEM []byte
+	for _, der := range certificate.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("marshal private key failed: %s", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return ParsePair(certPEM, keyPEM)
+}
+
+// Same report whether both pairs hold the same certificate
+func (p *Pair) Same(other *Pair) bool {
+	return other != nil && p.Leaf.Equal(other.Leaf)
+}
@@ -0,0 +1,29 @@
+package cert
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync/atomic"
+)
+
+// Store holds the certificate the TLS listeners of the node hand out, a new one is used from the next handshake
+// on while the listeners and their connections stay up
+type Store struct {
+	current atomic.Pointer[tls.Certificate]
+}
+
+// Set replace the certificate for the next handshakes
+func (s *Store) Set(pair *Pair) error {
+	certificate, err := tls.X509KeyPair(pair.CertPEM, pair.KeyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid key pair: %s", err)
+	}
+	certificate.Leaf = pair.Leaf
+	s.current.Store(&certificate)
+	return nil
+}
+
+// Certificate return the current certificate, nil before the first Set
+func (s *Store) Certificate() *tls.Certificate {
+	return s.current.Load()
+}
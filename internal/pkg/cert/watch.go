@@ -0,0 +1,114 @@
+package cert
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xtls/xray-core/common/task"
+)
+
+// settle is how long the files must stay untouched after a change, a renewal writes the cert and the key one by one
+const settle = 2 * time.Second
+
+// Watcher reloads the certificate files when they change, on inotify events, periodically and on demand
+type Watcher struct {
+	access   sync.Mutex
+	certFile string
+	keyFile  string
+	current  *Pair
+	onChange func(*Pair) error
+	onError  func(error)
+	periodic *task.Periodic
+	done     chan struct{}
+}
+
+func NewWatcher(certFile string, keyFile string, interval time.Duration) *Watcher {
+	w := &Watcher{
+		certFile: certFile,
+		keyFile:  keyFile,
+		done:     make(chan struct{}),
+	}
+	w.periodic = &task.Periodic{
+		Interval: interval,
+		Execute: func() error {
+			w.Check()
+			return nil
+		},
+	}
+	return w
+}
+
+// Start watch the files, onChange is called with every new valid pair and onError with every pair which can't be loaded
+func (w *Watcher) Start(onChange func(*Pair) error, onError func(error)) error {
+	w.onChange = onChange
+	w.onError = onError
+	// the inbound was built from the files, so they are the current pair
+	if pair, err := w.load(); err == nil {
+		w.current = pair
+	}
+
+	events := make(chan struct{}, 1)
+	if err := watchFiles([]string{w.certFile, w.keyFile}, events, w.done); err != nil {
+		log.Warnf("certificate files are checked every %s only: %s", w.periodic.Interval, err)
+	} else {
+		go w.settleEvents(events)
+	}
+	return w.periodic.Start()
+}
+
+// settleEvents check the files once the events stop coming
+func (w *Watcher) settleEvents(events <-chan struct{}) {
+	timer := time.NewTimer(settle)
+	timer.Stop()
+	for {
+		select {
+		case <-w.done:
+			timer.Stop()
+			return
+		case <-events:
+			timer.Reset(settle)
+		case <-timer.C:
+			w.Check()
+		}
+	}
+}
+
+// Check load the files and apply them if they hold a new valid pair, otherwise the current one stays
+func (w *Watcher) Check() {
+	w.access.Lock()
+	defer w.access.Unlock()
+
+	pair, err := w.load()
+	if err != nil {
+		w.onError(err)
+		return
+	}
+	if pair.Same(w.current) {
+		return
+	}
+	if err := w.onChange(pair); err != nil {
+		log.Errorf("apply certificate failed, keep the current one: %s", err)
+		return
+	}
+	w.current = pair
+}
+
+func (w *Watcher) load() (*Pair, error) {
+	certPEM, err := os.ReadFile(w.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("read certificate failed: %s", err)
+	}
+	keyPEM, err := os.ReadFile(w.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read key failed: %s", err)
+	}
+	return ParsePair(certPEM, keyPEM)
+}
+
+func (w *Watcher) Close() error {
+	close(w.done)
+	return w.periodic.Close()
+}
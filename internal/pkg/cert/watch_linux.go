@@ -0,0 +1,65 @@
+package cert
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE | unix.IN_ATTRIB
+
+// watchFiles send to events on every change in the directories of the files, and of their symlink targets,
+// since certbot and friends replace the files or the links instead of writing them in place
+func watchFiles(files []string, events chan<- struct{}, done <-chan struct{}) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("inotify init failed: %s", err)
+	}
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		dirs[filepath.Dir(file)] = true
+		if target, err := filepath.EvalSymlinks(file); err == nil {
+			dirs[filepath.Dir(target)] = true
+		}
+	}
+	for dir := range dirs {
+		if _, err := unix.InotifyAddWatch(fd, dir, inotifyMask); err != nil {
+			_ = unix.Close(fd)
+			return fmt.Errorf("inotify watch %s failed: %s", dir, err)
+		}
+	}
+
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 4096)
+		pollFds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// poll with a timeout, so done is noticed
+			n, err := unix.Poll(pollFds, int(time.Second/time.Millisecond))
+			if err != nil && err != unix.EINTR {
+				log.Errorf("inotify poll failed: %s", err)
+				return
+			}
+			if n <= 0 {
+				continue
+			}
+			if _, err := unix.Read(fd, buf); err != nil && err != unix.EAGAIN {
+				log.Errorf("inotify read failed: %s", err)
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return nil
+}
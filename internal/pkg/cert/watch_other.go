@@ -0,0 +1,9 @@
+//go:build !linux
+
+package cert
+
+import "errors"
+
+func watchFiles(files []string, events chan<- struct{}, done <-chan struct{}) error {
+	return errors.New("file events are not supported on this platform")
+}
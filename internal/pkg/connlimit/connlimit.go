@@ -0,0 +1,182 @@
+// Package connlimit limits the links a user may have at once and the new links it may open a second,
+// so a client opening thousands of sockets can't exhaust the file descriptors of the node
+package connlimit
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-vmess/internal/pkg/admin"
+	"github.com/xflash-panda/server-vmess/internal/pkg/metrics"
+	"github.com/xtls/xray-core/features/stats"
+	"golang.org/x/time/rate"
+)
+
+// Limits are the limits of a user, 0 for no limit
+type Limits struct {
+	// Links is the links the user may have at once
+	Links int `json:"links"`
+	// Rate is the new links the user may open a second
+	Rate int `json:"rate"`
+}
+
+// Config is the default limits of the users, the ones the panel doesn't set
+type Config Limits
+
+type user struct {
+	links   int
+	limits  Limits
+	limiter *rate.Limiter
+	// limited is set once a link is refused, to warn once until one is accepted again
+	limited        bool
+	linkViolations uint64
+	rateViolations uint64
+}
+
+// User is the state of the limits of a user
+type User struct {
+	Email          string `json:"email"`
+	Links          int    `json:"links"`
+	Limits         Limits `json:"limits"`
+	LinkViolations uint64 `json:"link_violations"`
+	RateViolations uint64 `json:"rate_violations"`
+}
+
+type Limiter struct {
+	access sync.Mutex
+	config *Config
+	// limits are the ones the panel sets for each user email
+	limits      map[string]Limits
+	users       map[string]*user
+	linkRefused stats.Counter
+	rateRefused stats.Counter
+}
+
+// New return a limiter of the default limits of config, the refused links are counted into the node metrics of m
+func New(config *Config, m stats.Manager) (*Limiter, error) {
+	if config.Links < 0 {
+		return nil, fmt.Errorf("invalid user link limit %d", config.Links)
+	}
+	if config.Rate < 0 {
+		return nil, fmt.Errorf("invalid user link rate limit %d", config.Rate)
+	}
+	return &Limiter{
+		config:      config,
+		limits:      make(map[string]Limits),
+		users:       make(map[string]*user),
+		linkRefused: metrics.Counter(m, "limit", "links_refused"),
+		rateRefused: metrics.Counter(m, "limit", "rate_refused"),
+	}, nil
+}
+
+// SetLimits replace the limits set by the panel with the ones of the users of the node, by user email,
+// a limit left 0 takes the default
+func (l *Limiter) SetLimits(limits map[string]Limits) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	l.limits = limits
+	// the users gone are forgotten once their links are closed
+	for email, u := range l.users {
+		if _, ok := limits[email]; !ok && u.links == 0 {
+			delete(l.users, email)
+		}
+	}
+}
+
+func (l *Limiter) limitsOf(email string) Limits {
+	limits := l.limits[email]
+	if limits.Links == 0 {
+		limits.Links = l.config.Links
+	}
+	if limits.Rate == 0 {
+		limits.Rate = l.config.Rate
+	}
+	return limits
+}
+
+// Acquire count a new link of the user email, it returns an error if the link goes over a limit of the user,
+// or else the func to call once the link is closed
+func (l *Limiter) Acquire(email string) (func(), error) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	limits := l.limitsOf(email)
+	u, ok := l.users[email]
+	if !ok {
+		if limits.Links == 0 && limits.Rate == 0 {
+			return func() {}, nil
+		}
+		u = &user{}
+		l.users[email] = u
+	}
+	if u.limits != limits {
+		u.limits = limits
+		u.limiter = nil
+		if limits.Rate > 0 {
+			u.limiter = rate.NewLimiter(rate.Limit(limits.Rate), limits.Rate)
+		}
+	}
+
+	if limits.Links > 0 && u.links >= limits.Links {
+		u.linkViolations++
+		l.linkRefused.Add(1)
+		l.warn(email, u, fmt.Sprintf("%d links open", u.links))
+		return nil, fmt.Errorf("user %s has %d links, the limit", email, u.links)
+	}
+	if u.limiter != nil && !u.limiter.Allow() {
+		u.rateViolations++
+		l.rateRefused.Add(1)
+		l.warn(email, u, fmt.Sprintf("more than %d new links a second", limits.Rate))
+		return nil, fmt.Errorf("user %s opens more than %d links a second", email, limits.Rate)
+	}
+	u.limited = false
+	u.links++
+	return func() {
+		l.access.Lock()
+		defer l.access.Unlock()
+		u.links--
+	}, nil
+}
+
+// warn log the first link refused to u until one is accepted again
+func (l *Limiter) warn(email string, u *user, reason string) {
+	if !u.limited {
+		u.limited = true
+		log.Warnf("links of user %s refused: %s", email, reason)
+	}
+}
+
+// Users return the users with a limit, the ones with the most violations first
+func (l *Limiter) Users() []User {
+	l.access.Lock()
+	users := make([]User, 0, len(l.users))
+	for email, u := range l.users {
+		users = append(users, User{
+			Email:          email,
+			Links:          u.links,
+			Limits:         l.limitsOf(email),
+			LinkViolations: u.linkViolations,
+			RateViolations: u.rateViolations,
+		})
+	}
+	l.access.Unlock()
+	sort.Slice(users, func(i, j int) bool {
+		vi, vj := users[i].LinkViolations+users[i].RateViolations, users[j].LinkViolations+users[j].RateViolations
+		if vi != vj {
+			return vi > vj
+		}
+		return users[i].Email < users[j].Email
+	})
+	return users
+}
+
+// ServeUsers list the users with a limit and their violations on GET
+func (l *Limiter) ServeUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		admin.WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	admin.WriteJSON(w, l.Users())
+}
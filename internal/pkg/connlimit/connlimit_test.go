@@ -0,0 +1,174 @@
+package connlimit
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/xtls/xray-core/app/stats"
+	statsFeature "github.com/xtls/xray-core/features/stats"
+)
+
+func newLimiter(t *testing.T, config *Config) (*Limiter, statsFeature.Manager) {
+	t.Helper()
+	manager, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := New(config, manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return limiter, manager
+}
+
+// acquire open n links of email, it fails the test once one is refused
+func acquire(t *testing.T, l *Limiter, email string, n int) []func() {
+	t.Helper()
+	releases := make([]func(), 0, n)
+	for i := 0; i < n; i++ {
+		release, err := l.Acquire(email)
+		if err != nil {
+			t.Fatalf("link %d of %s refused: %s", i+1, email, err)
+		}
+		releases = append(releases, release)
+	}
+	return releases
+}
+
+func userOf(l *Limiter, email string) *User {
+	for _, u := range l.Users() {
+		if u.Email == email {
+			return &u
+		}
+	}
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	for _, config := range []*Config{{Links: -1}, {Rate: -1}} {
+		if _, err := New(config, nil); err == nil {
+			t.Errorf("limits %+v accepted", *config)
+		}
+	}
+}
+
+func TestLinks(t *testing.T) {
+	l, manager := newLimiter(t, &Config{Links: 2})
+	releases := acquire(t, l, "a", 2)
+	if _, err := l.Acquire("a"); err == nil {
+		t.Fatal("link over the limit accepted")
+	}
+	// the limit is of each user
+	acquire(t, l, "b", 2)
+
+	releases[0]()
+	release := acquire(t, l, "a", 1)[0]
+	if _, err := l.Acquire("a"); err == nil {
+		t.Fatal("link over the limit accepted once another is closed")
+	}
+	release()
+	releases[1]()
+	if u := userOf(l, "a"); u == nil || u.Links != 0 || u.LinkViolations != 2 || u.RateViolations != 0 {
+		t.Errorf("user a %+v, want no links and 2 link violations", u)
+	}
+	if c := manager.GetCounter("node>>>limit>>>links_refused"); c == nil || c.Value() != 2 {
+		t.Error("the refused links aren't counted into the node metrics")
+	}
+}
+
+func TestRate(t *testing.T) {
+	l, manager := newLimiter(t, &Config{Rate: 3})
+	// the burst is the rate, the links closed at once count all the same
+	for _, release := range acquire(t, l, "a", 3) {
+		release()
+	}
+	if _, err := l.Acquire("a"); err == nil {
+		t.Fatal("link over the rate accepted")
+	}
+	acquire(t, l, "b", 3)
+	if u := userOf(l, "a"); u == nil || u.RateViolations != 1 || u.LinkViolations != 0 {
+		t.Errorf("user a %+v, want 1 rate violation", u)
+	}
+	if c := manager.GetCounter("node>>>limit>>>rate_refused"); c == nil || c.Value() != 1 {
+		t.Error("the refused links aren't counted into the node metrics")
+	}
+}
+
+func TestNoLimit(t *testing.T) {
+	l, _ := newLimiter(t, &Config{})
+	acquire(t, l, "a", 100)
+	if users := l.Users(); len(users) != 0 {
+		t.Errorf("users %+v kept without a limit", users)
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	l, _ := newLimiter(t, &Config{Links: 1})
+	l.SetLimits(map[string]Limits{
+		"a": {Links: 3},
+		// a limit left 0 takes the default
+		"b": {Rate: 100},
+	})
+	acquire(t, l, "a", 3)
+	if _, err := l.Acquire("a"); err == nil {
+		t.Error("link over the limit of the panel accepted")
+	}
+	acquire(t, l, "b", 1)
+	if _, err := l.Acquire("b"); err == nil {
+		t.Error("link over the default limit accepted")
+	}
+	if u := userOf(l, "b"); u == nil || u.Limits != (Limits{Links: 1, Rate: 100}) {
+		t.Errorf("user b %+v, want the links of the default and the rate of the panel", u)
+	}
+
+	// the new limits apply to the next link
+	l.SetLimits(map[string]Limits{"a": {Links: 4}, "b": {Rate: 100}})
+	acquire(t, l, "a", 1)
+	if _, err := l.Acquire("a"); err == nil {
+		t.Error("link over the updated limit accepted")
+	}
+	l.SetLimits(map[string]Limits{"a": {Links: 2}, "b": {Rate: 100}})
+	if _, err := l.Acquire("a"); err == nil {
+		t.Error("link accepted over the lowered limit")
+	}
+}
+
+func TestSetLimitsForget(t *testing.T) {
+	l, _ := newLimiter(t, &Config{Links: 1})
+	l.SetLimits(map[string]Limits{"a": {}, "b": {}})
+	release := acquire(t, l, "a", 1)[0]
+	acquire(t, l, "b", 1)[0]()
+
+	// b is gone with no link, a is kept until its link is closed
+	l.SetLimits(map[string]Limits{})
+	if userOf(l, "b") != nil {
+		t.Error("user b gone with no link is kept")
+	}
+	if userOf(l, "a") == nil {
+		t.Fatal("user a forgotten with a link open")
+	}
+	release()
+	l.SetLimits(map[string]Limits{})
+	if userOf(l, "a") != nil {
+		t.Error("user a gone is kept once its link is closed")
+	}
+}
+
+func TestUsersOrder(t *testing.T) {
+	l, _ := newLimiter(t, &Config{Links: 1})
+	for email, violations := range map[string]int{"a": 1, "b": 3, "c": 0, "d": 1} {
+		acquire(t, l, email, 1)
+		for i := 0; i < violations; i++ {
+			l.Acquire(email)
+		}
+	}
+	var emails []string
+	for _, u := range l.Users() {
+		emails = append(emails, u.Email)
+	}
+	// the most violations first, then by email
+	if got, want := strings.Join(emails, ","), "b,a,d,c"; got != want {
+		t.Errorf("users %s, want %s", got, want)
+	}
+}
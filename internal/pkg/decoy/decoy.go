@@ -0,0 +1,50 @@
+// Package decoy serves a website to the requests on the websocket, h2 and grpc inbounds which are not for the proxy,
+// the front of the inbounds passes them on, see front.Config
+package decoy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+)
+
+type Config struct {
+	// Dir is a directory of static content
+	Dir string
+	// Upstream is the address of a web server the requests are proxied to, like http://127.0.0.1:8080
+	Upstream string
+}
+
+// Enabled report whether a site is configured
+func (c *Config) Enabled() bool {
+	return c.Dir != "" || c.Upstream != ""
+}
+
+// New return the handler of the site
+func New(config *Config) (http.Handler, error) {
+	if config.Dir != "" && config.Upstream != "" {
+		return nil, fmt.Errorf("decoy dir and decoy upstream can't be used together")
+	}
+	if config.Dir != "" {
+		info, err := os.Stat(config.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("decoy dir unavailable: %s", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("decoy dir %s is not a directory", config.Dir)
+		}
+		return http.FileServer(http.Dir(config.Dir)), nil
+	}
+	upstream, err := url.Parse(config.Upstream)
+	if err != nil || upstream.Host == "" || (upstream.Scheme != "http" && upstream.Scheme != "https") {
+		return nil, fmt.Errorf("decoy upstream %s is not a http or https url", config.Upstream)
+	}
+	// the host the client asked for is kept, like behind any other reverse proxy
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, err error) {
+		writer.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy, nil
+}
@@ -49,6 +49,7 @@ import (
 	_ "github.com/xtls/xray-core/transport/internet/websocket"
 
 	// Transport headers
+	_ "github.com/xtls/xray-core/transport/internet/headers/dns"
 	_ "github.com/xtls/xray-core/transport/internet/headers/http"
 	_ "github.com/xtls/xray-core/transport/internet/headers/noop"
 	_ "github.com/xtls/xray-core/transport/internet/headers/srtp"
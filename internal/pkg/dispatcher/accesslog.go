@@ -0,0 +1,109 @@
+package dispatcher
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xflash-panda/server-vmess/internal/pkg/accesslog"
+	"github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/transport"
+)
+
+// connTrace collects what the access log needs to know about a single link.
+type connTrace struct {
+	start    time.Time
+	domain   string
+	uplink   *stats.Counter
+	downlink *stats.Counter
+}
+
+// SetAccessLogger enables per-connection access records, it must be called before the instance starts.
+func (d *DefaultDispatcher) SetAccessLogger(logger *accesslog.Logger) {
+	d.accessLog = logger
+}
+
+func (d *DefaultDispatcher) newConnTrace() *connTrace {
+	if d.accessLog == nil {
+		return nil
+	}
+	return &connTrace{
+		start:    time.Now(),
+		uplink:   new(stats.Counter),
+		downlink: new(stats.Counter),
+	}
+}
+
+func (t *connTrace) sniffed(result SniffResult) {
+	if t != nil {
+		t.domain = result.Domain()
+	}
+}
+
+// logAccess write the record of the link of ctx, outboundTag is empty for a link refused before an outbound is chosen
+func (d *DefaultDispatcher) logAccess(ctx context.Context, trace *connTrace, outboundTag string, status string) {
+	if trace == nil {
+		return
+	}
+	end := time.Now()
+	record := &accesslog.Record{
+		Time:        end,
+		Start:       trace.start,
+		Duration:    end.Sub(trace.start).Milliseconds(),
+		Domain:      trace.domain,
+		OutboundTag: outboundTag,
+		Status:      status,
+		Upload:      trace.uplink.Value(),
+		Download:    trace.downlink.Value(),
+	}
+	if inbound := session.InboundFromContext(ctx); inbound != nil {
+		record.InboundTag = inbound.Tag
+		if inbound.Source.IsValid() {
+			record.Source = inbound.Source.Address.String()
+		}
+		if inbound.User != nil {
+			record.UserID, _ = userIDFromEmail(inbound.User.Email)
+		}
+	}
+	if ob := session.OutboundFromContext(ctx); ob != nil {
+		record.Network = ob.OriginalTarget.Network.SystemString()
+		record.Destination = ob.OriginalTarget.NetAddr()
+		if ob.Conn != nil {
+			record.Local = ob.Conn.LocalAddr().String()
+			record.Remote = ob.Conn.RemoteAddr().String()
+		}
+	}
+	if content := session.ContentFromContext(ctx); content != nil {
+		record.Protocol = content.Protocol
+	}
+	if err := d.accessLog.Log(record); err != nil {
+		newError("failed to write access log").Base(err).AtWarning().WriteToLog(session.ExportIDToError(ctx))
+	}
+}
+
+// userIDFromEmail parse the user id from the inbound email, which is in the form tag|id|uuid.
+func userIDFromEmail(email string) (int, bool) {
+	parts := strings.Split(email, "|")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// countUplink wraps the reader of a caller supplied link, the sniffer needs the raw pipe reader so this happens after sniffing.
+func countUplink(link *transport.Link, trace *connTrace) *transport.Link {
+	if trace == nil {
+		return link
+	}
+	link.Reader = &SizeStatReader{
+		Counter: trace.uplink,
+		Reader:  link.Reader,
+	}
+	return link
+}
@@ -0,0 +1,96 @@
+package dispatcher
+
+import (
+	"context"
+	"sync"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/transport"
+)
+
+// activity counts the links being dispatched and the users they belong to
+type activity struct {
+	access sync.Mutex
+	links  int
+	// users is the links of each user email with their source address
+	users map[string]map[*transport.Link]string
+}
+
+// track count the link of ctx until the returned func is called
+func (d *DefaultDispatcher) track(ctx context.Context, link *transport.Link) func() {
+	email, source := "", ""
+	if inbound := session.InboundFromContext(ctx); inbound != nil && inbound.User != nil {
+		email = inbound.User.Email
+		if inbound.Source.IsValid() {
+			source = inbound.Source.Address.String()
+		}
+	}
+	a := &d.activity
+	a.access.Lock()
+	a.links++
+	if email != "" {
+		if a.users == nil {
+			a.users = make(map[string]map[*transport.Link]string)
+		}
+		if a.users[email] == nil {
+			a.users[email] = make(map[*transport.Link]string)
+		}
+		a.users[email][link] = source
+	}
+	a.access.Unlock()
+	return func() {
+		a.access.Lock()
+		defer a.access.Unlock()
+		a.links--
+		if email == "" {
+			return
+		}
+		if delete(a.users[email], link); len(a.users[email]) == 0 {
+			delete(a.users, email)
+		}
+	}
+}
+
+// Activity return the links being dispatched and the number of users with at least one of them
+func (d *DefaultDispatcher) Activity() (links int, users int) {
+	d.activity.access.Lock()
+	defer d.activity.access.Unlock()
+	return d.activity.links, len(d.activity.users)
+}
+
+// OnlineUsers return the source addresses of the users with a link, by user id
+func (d *DefaultDispatcher) OnlineUsers() map[int][]string {
+	d.activity.access.Lock()
+	defer d.activity.access.Unlock()
+	online := make(map[int][]string, len(d.activity.users))
+	for email, links := range d.activity.users {
+		uid, ok := userIDFromEmail(email)
+		if !ok {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, source := range links {
+			if source != "" && !seen[source] {
+				seen[source] = true
+				online[uid] = append(online[uid], source)
+			}
+		}
+	}
+	return online
+}
+
+// InterruptUser close both directions of the links of the user email and return how many there were
+func (d *DefaultDispatcher) InterruptUser(email string) int {
+	d.activity.access.Lock()
+	links := make([]*transport.Link, 0, len(d.activity.users[email]))
+	for link := range d.activity.users[email] {
+		links = append(links, link)
+	}
+	d.activity.access.Unlock()
+	for _, link := range links {
+		common.Interrupt(link.Writer)
+		common.Interrupt(link.Reader)
+	}
+	return len(links)
+}
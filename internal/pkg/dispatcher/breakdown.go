@@ -0,0 +1,146 @@
+package dispatcher
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/xflash-panda/server-vmess/internal/pkg/metrics"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/stats"
+	"github.com/xtls/xray-core/transport"
+)
+
+// the protocol classes the traffic is broken down by
+const (
+	ClassTLS        = "tls"
+	ClassHTTP       = "http"
+	ClassQUIC       = "quic"
+	ClassBitTorrent = "bittorrent"
+	ClassUnknown    = "unknown"
+)
+
+var (
+	Classes  = []string{ClassTLS, ClassHTTP, ClassQUIC, ClassBitTorrent, ClassUnknown}
+	Networks = []string{"tcp", "udp"}
+)
+
+// BreakdownCounterName return the name of the counter of the traffic of a user in class and network, direction is uplink or downlink
+func BreakdownCounterName(email string, class string, network string, direction string) string {
+	return "user>>>" + email + ">>>breakdown>>>" + class + ">>>" + network + ">>>" + direction
+}
+
+// SetTrafficBreakdown counts the traffic of each user by class and network besides the one of the node,
+// it must be called before the instance starts.
+func (d *DefaultDispatcher) SetTrafficBreakdown(enabled bool) {
+	d.userBreakdown = enabled
+}
+
+// protocolClass return the class of a sniffed protocol
+func protocolClass(protocol string) string {
+	switch {
+	case protocol == "tls":
+		return ClassTLS
+	case strings.HasPrefix(protocol, "http"):
+		return ClassHTTP
+	case protocol == "quic":
+		return ClassQUIC
+	case protocol == "bittorrent":
+		return ClassBitTorrent
+	default:
+		return ClassUnknown
+	}
+}
+
+// classTrace counts the bytes of a link, they are held until the link is routed and its class is known
+type classTrace struct {
+	access   sync.Mutex
+	uplink   []stats.Counter
+	downlink []stats.Counter
+	// pending is the bytes written before the link was classified
+	pendingUplink   int64
+	pendingDownlink int64
+	classified      bool
+}
+
+func (t *classTrace) add(uplink bool, n int64) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if !t.classified {
+		if uplink {
+			t.pendingUplink += n
+		} else {
+			t.pendingDownlink += n
+		}
+		return
+	}
+	counters := t.downlink
+	if uplink {
+		counters = t.uplink
+	}
+	for _, c := range counters {
+		c.Add(n)
+	}
+}
+
+// counter return the counter of one direction of the link, to wrap its writer or reader
+func (t *classTrace) counter(uplink bool) stats.Counter {
+	return &classCounter{trace: t, uplink: uplink}
+}
+
+type classCounter struct {
+	trace  *classTrace
+	uplink bool
+}
+
+func (c *classCounter) Value() int64    { return 0 }
+func (c *classCounter) Set(int64) int64 { return 0 }
+func (c *classCounter) Add(n int64) int64 {
+	c.trace.add(c.uplink, n)
+	return 0
+}
+
+// classify route the bytes of the link to the counters of the node and the user for its class and network,
+// the bytes written before are counted at once
+func (d *DefaultDispatcher) classify(ctx context.Context, trace *classTrace, network net.Network) {
+	class := ClassUnknown
+	if content := session.ContentFromContext(ctx); content != nil {
+		class = protocolClass(content.Protocol)
+	}
+	networkName := "tcp"
+	if network == net.Network_UDP {
+		networkName = "udp"
+	}
+	uplink := []stats.Counter{metrics.Counter(d.stats, "traffic", class, networkName, "uplink")}
+	downlink := []stats.Counter{metrics.Counter(d.stats, "traffic", class, networkName, "downlink")}
+	if inbound := session.InboundFromContext(ctx); d.userBreakdown && inbound != nil && inbound.User != nil && inbound.User.Email != "" {
+		email := inbound.User.Email
+		if c, _ := stats.GetOrRegisterCounter(d.stats, BreakdownCounterName(email, class, networkName, "uplink")); c != nil {
+			uplink = append(uplink, c)
+		}
+		if c, _ := stats.GetOrRegisterCounter(d.stats, BreakdownCounterName(email, class, networkName, "downlink")); c != nil {
+			downlink = append(downlink, c)
+		}
+	}
+
+	trace.access.Lock()
+	defer trace.access.Unlock()
+	trace.uplink, trace.downlink, trace.classified = uplink, downlink, true
+	for _, c := range uplink {
+		c.Add(trace.pendingUplink)
+	}
+	for _, c := range downlink {
+		c.Add(trace.pendingDownlink)
+	}
+	trace.pendingUplink, trace.pendingDownlink = 0, 0
+}
+
+// countClassUplink count the bytes read from the link of DispatchLink as its uplink
+func countClassUplink(link *transport.Link, trace *classTrace) *transport.Link {
+	link.Reader = &SizeStatReader{
+		Counter: trace.counter(true),
+		Reader:  link.Reader,
+	}
+	return link
+}
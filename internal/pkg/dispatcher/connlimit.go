@@ -0,0 +1,27 @@
+package dispatcher
+
+import (
+	"context"
+
+	"github.com/xflash-panda/server-vmess/internal/pkg/connlimit"
+	"github.com/xtls/xray-core/common/session"
+)
+
+// SetConnLimiter refuses the links of a user over its limits before an outbound is chosen,
+// it must be called before the instance starts.
+func (d *DefaultDispatcher) SetConnLimiter(limiter *connlimit.Limiter) {
+	d.connLimiter = limiter
+}
+
+// acquireLink count the link of the user of ctx against its limits, the returned func is called once the link is closed
+func (d *DefaultDispatcher) acquireLink(ctx context.Context) (func(), error) {
+	inbound := session.InboundFromContext(ctx)
+	if d.connLimiter == nil || inbound == nil || inbound.User == nil || inbound.User.Email == "" {
+		return func() {}, nil
+	}
+	release, err := d.connLimiter.Acquire(inbound.User.Email)
+	if err != nil {
+		return nil, newError("link refused").Base(err)
+	}
+	return release, nil
+}
@@ -0,0 +1,215 @@
+package dispatcher
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/xflash-panda/server-vmess/internal/pkg/connlimit"
+	"github.com/xflash-panda/server-vmess/internal/pkg/egress"
+	"github.com/xflash-panda/server-vmess/internal/pkg/transfer"
+	"github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+// fakeOutbounds is an outbound manager of the handlers of its map, the one of the empty tag is the default
+type fakeOutbounds map[string]outbound.Handler
+
+func (f fakeOutbounds) Type() interface{} {
+	return outbound.ManagerType()
+}
+
+func (f fakeOutbounds) Start() error {
+	return nil
+}
+
+func (f fakeOutbounds) Close() error {
+	return nil
+}
+
+func (f fakeOutbounds) GetHandler(tag string) outbound.Handler {
+	return f[tag]
+}
+
+func (f fakeOutbounds) GetDefaultHandler() outbound.Handler {
+	return f[""]
+}
+
+func (f fakeOutbounds) AddHandler(ctx context.Context, handler outbound.Handler) error {
+	f[handler.Tag()] = handler
+	return nil
+}
+
+func (f fakeOutbounds) RemoveHandler(ctx context.Context, tag string) error {
+	delete(f, tag)
+	return nil
+}
+
+// closeHandler closes the links it is given
+type closeHandler struct {
+	tag   string
+	links int
+}
+
+func (h *closeHandler) Start() error {
+	return nil
+}
+
+func (h *closeHandler) Close() error {
+	return nil
+}
+
+func (h *closeHandler) Tag() string {
+	return h.tag
+}
+
+func (h *closeHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	h.links++
+	common.Close(link.Writer)
+	common.Interrupt(link.Reader)
+}
+
+func newLimitedDispatcher(t *testing.T, limits *connlimit.Config) *DefaultDispatcher {
+	t.Helper()
+	manager, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := connlimit.New(limits, manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &DefaultDispatcher{stats: manager, ohm: fakeOutbounds{}}
+	d.SetConnLimiter(limiter)
+	return d
+}
+
+func userContext(email string, target net.Destination) context.Context {
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{User: &protocol.MemoryUser{Email: email}})
+	return session.ContextWithOutbound(ctx, &session.Outbound{OriginalTarget: target, Target: target})
+}
+
+func newLink() *transport.Link {
+	reader, _ := pipe.New()
+	_, writer := pipe.New()
+	return &transport.Link{Reader: reader, Writer: writer}
+}
+
+func linksOf(d *DefaultDispatcher, email string) int {
+	for _, u := range d.connLimiter.Users() {
+		if u.Email == email {
+			return u.Links
+		}
+	}
+	return 0
+}
+
+func TestAcquireLink(t *testing.T) {
+	target := net.TCPDestination(net.ParseAddress("93.184.216.34"), 443)
+	d := newLimitedDispatcher(t, &connlimit.Config{Links: 1})
+	release, err := d.acquireLink(userContext("a", target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.acquireLink(userContext("a", target)); err == nil {
+		t.Error("link over the limit accepted")
+	}
+	if _, err := d.Dispatch(userContext("a", target), target); err == nil {
+		t.Error("link over the limit dispatched")
+	}
+	// the links without a user aren't limited
+	for i := 0; i < 2; i++ {
+		if _, err := d.acquireLink(session.ContextWithInbound(context.Background(), &session.Inbound{})); err != nil {
+			t.Errorf("link without a user refused: %s", err)
+		}
+	}
+	release()
+	if _, err := d.acquireLink(userContext("a", target)); err != nil {
+		t.Errorf("link refused once the other is closed: %s", err)
+	}
+
+	d = &DefaultDispatcher{}
+	if _, err := d.acquireLink(userContext("a", target)); err != nil {
+		t.Errorf("link refused without a limiter: %s", err)
+	}
+}
+
+// TestReleaseLink checks that the link is released whatever way routedDispatch ends
+func TestReleaseLink(t *testing.T) {
+	public := net.TCPDestination(net.ParseAddress("93.184.216.34"), 443)
+	tests := []struct {
+		name   string
+		target net.Destination
+		// setup prepare d and the context of the link
+		setup func(t *testing.T, d *DefaultDispatcher, ctx context.Context) context.Context
+		// relayed is whether the link reaches the default handler
+		relayed bool
+	}{
+		{"relayed", public, func(t *testing.T, d *DefaultDispatcher, ctx context.Context) context.Context {
+			return ctx
+		}, true},
+		{"transfer cap", public, func(t *testing.T, d *DefaultDispatcher, ctx context.Context) context.Context {
+			meter, err := transfer.New(&transfer.Config{Cap: 1, ResetDay: 1, Action: transfer.ActionStop}, d.stats, filepath.Join(t.TempDir(), "transfer.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			counter, err := d.stats.RegisterCounter("inbound>>>vmess>>>traffic>>>downlink")
+			if err != nil {
+				t.Fatal(err)
+			}
+			counter.Add(1 << 30)
+			if err := meter.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !meter.Blocked() {
+				t.Fatal("transfer cap not reached")
+			}
+			d.transfer = meter
+			return ctx
+		}, false},
+		{"egress blocked", net.TCPDestination(net.ParseAddress("10.0.0.1"), 80), func(t *testing.T, d *DefaultDispatcher, ctx context.Context) context.Context {
+			guard, err := egress.New(&egress.Config{Enabled: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.egress = guard
+			return ctx
+		}, false},
+		{"forced outbound missing", public, func(t *testing.T, d *DefaultDispatcher, ctx context.Context) context.Context {
+			return session.SetForcedOutboundTagToContext(ctx, "missing")
+		}, false},
+		{"no default outbound", public, func(t *testing.T, d *DefaultDispatcher, ctx context.Context) context.Context {
+			delete(d.ohm.(fakeOutbounds), "")
+			return ctx
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newLimitedDispatcher(t, &connlimit.Config{Links: 1})
+			handler := &closeHandler{}
+			d.ohm.(fakeOutbounds)[""] = handler
+			ctx := test.setup(t, d, userContext("a", test.target))
+
+			release, err := d.acquireLink(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.routedDispatch(ctx, newLink(), test.target, nil, new(classTrace), release)
+			if relayed := handler.links == 1; relayed != test.relayed {
+				t.Errorf("relayed %t, want %t", relayed, test.relayed)
+			}
+			if links := linksOf(d, "a"); links != 0 {
+				t.Errorf("%d links left open", links)
+			}
+			if _, err := d.acquireLink(ctx); err != nil {
+				t.Errorf("link refused once the other is closed: %s", err)
+			}
+		})
+	}
+}
@@ -8,6 +8,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/xflash-panda/server-vmess/internal/pkg/accesslog"
+	"github.com/xflash-panda/server-vmess/internal/pkg/connlimit"
+	"github.com/xflash-panda/server-vmess/internal/pkg/egress"
+	"github.com/xflash-panda/server-vmess/internal/pkg/transfer"
 	"github.com/xtls/xray-core/common"
 	"github.com/xtls/xray-core/common/buf"
 	"github.com/xtls/xray-core/common/log"
@@ -94,6 +98,14 @@ type DefaultDispatcher struct {
 	stats  stats.Manager
 	dns    dns.Client
 	fdns   dns.FakeDNSEngine
+
+	accessLog *accesslog.Logger
+	egress    *egress.Guard
+	activity  activity
+	// userBreakdown counts the traffic of each user by class and network
+	userBreakdown bool
+	transfer      *transfer.Meter
+	connLimiter   *connlimit.Limiter
 }
 
 func init() {
@@ -134,7 +146,7 @@ func (*DefaultDispatcher) Start() error {
 // Close implements common.Closable.
 func (*DefaultDispatcher) Close() error { return nil }
 
-func (d *DefaultDispatcher) getLink(ctx context.Context) (*transport.Link, *transport.Link) {
+func (d *DefaultDispatcher) getLink(ctx context.Context, trace *connTrace, class *classTrace) (*transport.Link, *transport.Link) {
 	opt := pipe.OptionsFromContext(ctx)
 	uplinkReader, uplinkWriter := pipe.New(opt...)
 	downlinkReader, downlinkWriter := pipe.New(opt...)
@@ -149,6 +161,27 @@ func (d *DefaultDispatcher) getLink(ctx context.Context) (*transport.Link, *tran
 		Writer: downlinkWriter,
 	}
 
+	if trace != nil {
+		inboundLink.Writer = &SizeStatWriter{
+			Counter: trace.uplink,
+			Writer:  inboundLink.Writer,
+		}
+		outboundLink.Writer = &SizeStatWriter{
+			Counter: trace.downlink,
+			Writer:  outboundLink.Writer,
+		}
+	}
+	inboundLink.Writer = &SizeStatWriter{
+		Counter: class.counter(true),
+		Writer:  inboundLink.Writer,
+	}
+	outboundLink.Writer = &SizeStatWriter{
+		Counter: class.counter(false),
+		Writer:  outboundLink.Writer,
+	}
+	d.throttle(ctx, inboundLink)
+	d.throttle(ctx, outboundLink)
+
 	sessionInbound := session.InboundFromContext(ctx)
 	var user *protocol.MemoryUser
 	if sessionInbound != nil {
@@ -229,15 +262,22 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 	}
 	ob.OriginalTarget = destination
 	ob.Target = destination
+	release, err := d.acquireLink(ctx)
+	if err != nil {
+		d.logAccess(ctx, d.newConnTrace(), "", accesslog.StatusLimited)
+		return nil, err
+	}
 	content := session.ContentFromContext(ctx)
 	if content == nil {
 		content = new(session.Content)
 		ctx = session.ContextWithContent(ctx, content)
 	}
 	sniffingRequest := content.SniffingRequest
-	inbound, outbound := d.getLink(ctx)
+	trace := d.newConnTrace()
+	class := new(classTrace)
+	inbound, outbound := d.getLink(ctx, trace, class)
 	if !sniffingRequest.Enabled {
-		go d.routedDispatch(ctx, outbound, destination)
+		go d.routedDispatch(ctx, outbound, destination, trace, class, release)
 	} else {
 		go func() {
 			cReader := &cachedReader{
@@ -247,6 +287,7 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 			result, err := sniffer(ctx, cReader, sniffingRequest.MetadataOnly, destination.Network)
 			if err == nil {
 				content.Protocol = result.Protocol()
+				trace.sniffed(result)
 			}
 			if err == nil && d.shouldOverride(ctx, result, sniffingRequest, destination) {
 				domain := result.Domain()
@@ -266,7 +307,7 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 					ob.Target = destination
 				}
 			}
-			d.routedDispatch(ctx, outbound, destination)
+			d.routedDispatch(ctx, outbound, destination, trace, class, release)
 		}()
 	}
 	return inbound, nil
@@ -284,14 +325,32 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 	}
 	ob.OriginalTarget = destination
 	ob.Target = destination
+	release, err := d.acquireLink(ctx)
+	if err != nil {
+		d.logAccess(ctx, d.newConnTrace(), "", accesslog.StatusLimited)
+		return err
+	}
 	content := session.ContentFromContext(ctx)
 	if content == nil {
 		content = new(session.Content)
 		ctx = session.ContextWithContent(ctx, content)
 	}
 	sniffingRequest := content.SniffingRequest
+	trace := d.newConnTrace()
+	if trace != nil {
+		outbound.Writer = &SizeStatWriter{
+			Counter: trace.downlink,
+			Writer:  outbound.Writer,
+		}
+	}
+	class := new(classTrace)
+	outbound.Writer = &SizeStatWriter{
+		Counter: class.counter(false),
+		Writer:  outbound.Writer,
+	}
+	d.throttle(ctx, outbound)
 	if !sniffingRequest.Enabled {
-		d.routedDispatch(ctx, outbound, destination)
+		d.routedDispatch(ctx, d.throttleUplink(ctx, countClassUplink(countUplink(outbound, trace), class)), destination, trace, class, release)
 	} else {
 		cReader := &cachedReader{
 			reader: outbound.Reader.(*pipe.Reader),
@@ -300,6 +359,7 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 		result, err := sniffer(ctx, cReader, sniffingRequest.MetadataOnly, destination.Network)
 		if err == nil {
 			content.Protocol = result.Protocol()
+			trace.sniffed(result)
 		}
 		if err == nil && d.shouldOverride(ctx, result, sniffingRequest, destination) {
 			domain := result.Domain()
@@ -319,7 +379,7 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 				ob.Target = destination
 			}
 		}
-		d.routedDispatch(ctx, outbound, destination)
+		d.routedDispatch(ctx, d.throttleUplink(ctx, countClassUplink(countUplink(outbound, trace), class)), destination, trace, class, release)
 	}
 
 	return nil
@@ -371,7 +431,10 @@ func sniffer(ctx context.Context, cReader *cachedReader, metadataOnly bool, netw
 	return contentResult, contentErr
 }
 
-func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.Link, destination net.Destination) {
+func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.Link, destination net.Destination, trace *connTrace, class *classTrace, release func()) {
+	defer release()
+	defer d.track(ctx, link)()
+	d.classify(ctx, class, destination.Network)
 	ob := session.OutboundFromContext(ctx)
 	if hosts, ok := d.dns.(dns.HostsLookup); ok && destination.Address.Family().IsDomain() {
 		proxied := hosts.LookupHosts(ob.Target.String())
@@ -386,6 +449,19 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 		}
 	}
 
+	if d.transferBlocked() {
+		common.Close(link.Writer)
+		common.Interrupt(link.Reader)
+		d.logAccess(ctx, trace, "", accesslog.StatusTransferCap)
+		return
+	}
+	if !d.egressAllowed(ctx, ob) {
+		common.Close(link.Writer)
+		common.Interrupt(link.Reader)
+		d.logAccess(ctx, trace, "", accesslog.StatusEgressBlocked)
+		return
+	}
+
 	var handler outbound.Handler
 
 	routingLink := routing_session.AsRoutingContext(ctx)
@@ -401,6 +477,7 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 			newError("non existing tag for platform initialized detour: ", forcedOutboundTag).AtError().WriteToLog(session.ExportIDToError(ctx))
 			common.Close(link.Writer)
 			common.Interrupt(link.Reader)
+			d.logAccess(ctx, trace, "", accesslog.StatusNoOutbound)
 			return
 		}
 	} else if d.router != nil {
@@ -426,6 +503,7 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 		newError("default outbound handler not exist").WriteToLog(session.ExportIDToError(ctx))
 		common.Close(link.Writer)
 		common.Interrupt(link.Reader)
+		d.logAccess(ctx, trace, "", accesslog.StatusNoOutbound)
 		return
 	}
 
@@ -445,4 +523,5 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 	}
 
 	handler.Dispatch(ctx, link)
+	d.logAccess(ctx, trace, handler.Tag(), accesslog.StatusRelayed)
 }
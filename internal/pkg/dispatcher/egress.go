@@ -0,0 +1,55 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-vmess/internal/pkg/egress"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/dns"
+)
+
+// SetEgressGuard blocks the links to private networks, it must be called before the instance starts.
+func (d *DefaultDispatcher) SetEgressGuard(guard *egress.Guard) {
+	d.egress = guard
+}
+
+// egressAllowed checks the final target, domains are resolved so names pointing to private networks are caught too.
+// Every address of a domain must be allowed, the target keeps the domain so the outbound picks one of them by
+// its domainStrategy.
+func (d *DefaultDispatcher) egressAllowed(ctx context.Context, ob *session.Outbound) bool {
+	if d.egress == nil {
+		return true
+	}
+	target := ob.Target
+	var ips []net.IP
+	if target.Address.Family().IsDomain() {
+		resolved, err := d.dns.LookupIP(target.Address.Domain(), dns.IPOption{IPv4Enable: true, IPv6Enable: true})
+		if err == nil && len(resolved) == 0 {
+			err = errors.New("no address")
+		}
+		if err != nil {
+			// a name which can't be checked isn't dialed
+			log.Warnf("egress guard: %s not resolved, link refused: %s", target, err)
+			return false
+		}
+		ips = resolved
+	} else {
+		ips = []net.IP{target.Address.IP()}
+	}
+
+	for _, ip := range ips {
+		if !d.egress.Blocked(ip) {
+			continue
+		}
+		userID := 0
+		if inbound := session.InboundFromContext(ctx); inbound != nil && inbound.User != nil {
+			userID, _ = userIDFromEmail(inbound.User.Email)
+		}
+		log.Warnf("egress guard: user %d blocked from %s (%s)", userID, target, ip)
+		return false
+	}
+	return true
+}
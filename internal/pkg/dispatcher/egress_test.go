@@ -0,0 +1,86 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/xflash-panda/server-vmess/internal/pkg/egress"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/features/dns"
+)
+
+// fakeDNS answers the names of its map, the others aren't found
+type fakeDNS map[string][]net.IP
+
+func (f fakeDNS) Type() interface{} {
+	return dns.ClientType()
+}
+
+func (f fakeDNS) Start() error {
+	return nil
+}
+
+func (f fakeDNS) Close() error {
+	return nil
+}
+
+func (f fakeDNS) LookupIP(domain string, option dns.IPOption) ([]net.IP, error) {
+	ips, ok := f[domain]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return ips, nil
+}
+
+func TestEgressAllowed(t *testing.T) {
+	guard, err := egress.New(&egress.Config{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &DefaultDispatcher{egress: guard, dns: fakeDNS{
+		"public.test":   {net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800:220:1::1")},
+		"private.test":  {net.ParseIP("10.0.0.5")},
+		"metadata.test": {net.ParseIP("169.254.169.254")},
+		"mapped.test":   {net.ParseIP("::ffff:127.0.0.1")},
+		// a name with one private address among public ones
+		"mixed.test": {net.ParseIP("93.184.216.34"), net.ParseIP("192.168.0.1")},
+		"empty.test": {},
+	}}
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{})
+	tests := []struct {
+		address net.Address
+		allowed bool
+	}{
+		{net.ParseAddress("93.184.216.34"), true},
+		{net.ParseAddress("169.254.169.254"), false},
+		{net.ParseAddress("::ffff:10.0.0.1"), false},
+		{net.DomainAddress("public.test"), true},
+		{net.DomainAddress("private.test"), false},
+		{net.DomainAddress("metadata.test"), false},
+		{net.DomainAddress("mapped.test"), false},
+		{net.DomainAddress("mixed.test"), false},
+		// a name which can't be checked isn't dialed
+		{net.DomainAddress("unknown.test"), false},
+		{net.DomainAddress("empty.test"), false},
+	}
+	for _, test := range tests {
+		target := net.TCPDestination(test.address, 443)
+		ob := &session.Outbound{Target: target}
+		if allowed := d.egressAllowed(ctx, ob); allowed != test.allowed {
+			t.Errorf("%s allowed %t, want %t", test.address, allowed, test.allowed)
+		}
+		if ob.Target != target {
+			t.Errorf("target %s rewritten to %s, the outbound resolves it by its domain strategy", target, ob.Target)
+		}
+	}
+}
+
+func TestEgressDisabled(t *testing.T) {
+	d := &DefaultDispatcher{}
+	ob := &session.Outbound{Target: net.TCPDestination(net.ParseAddress("127.0.0.1"), 80)}
+	if !d.egressAllowed(context.Background(), ob) {
+		t.Error("link refused without a guard")
+	}
+}
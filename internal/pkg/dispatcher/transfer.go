@@ -0,0 +1,76 @@
+package dispatcher
+
+import (
+	"context"
+
+	"github.com/xflash-panda/server-vmess/internal/pkg/transfer"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/transport"
+)
+
+// SetTransferMeter refuses or throttles the links once the transfer cap of the node is reached,
+// it must be called before the instance starts.
+func (d *DefaultDispatcher) SetTransferMeter(meter *transfer.Meter) {
+	d.transfer = meter
+}
+
+func (d *DefaultDispatcher) transferBlocked() bool {
+	return d.transfer != nil && d.transfer.Blocked()
+}
+
+// throttle pace the writer of link by the meter
+func (d *DefaultDispatcher) throttle(ctx context.Context, link *transport.Link) {
+	if d.transfer != nil {
+		link.Writer = &throttleWriter{ctx: ctx, meter: d.transfer, Writer: link.Writer}
+	}
+}
+
+// throttleUplink pace the reader of the link of DispatchLink by the meter
+func (d *DefaultDispatcher) throttleUplink(ctx context.Context, link *transport.Link) *transport.Link {
+	if d.transfer != nil {
+		link.Reader = &throttleReader{ctx: ctx, meter: d.transfer, Reader: link.Reader}
+	}
+	return link
+}
+
+type throttleWriter struct {
+	ctx   context.Context
+	meter *transfer.Meter
+	buf.Writer
+}
+
+func (w *throttleWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	if err := w.meter.Wait(w.ctx, int(mb.Len())); err != nil {
+		buf.ReleaseMulti(mb)
+		return err
+	}
+	return w.Writer.WriteMultiBuffer(mb)
+}
+
+func (w *throttleWriter) Close() error {
+	return common.Close(w.Writer)
+}
+
+func (w *throttleWriter) Interrupt() {
+	common.Interrupt(w.Writer)
+}
+
+type throttleReader struct {
+	ctx   context.Context
+	meter *transfer.Meter
+	buf.Reader
+}
+
+func (r *throttleReader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	mb, err := r.Reader.ReadMultiBuffer()
+	if waitErr := r.meter.Wait(r.ctx, int(mb.Len())); waitErr != nil {
+		buf.ReleaseMulti(mb)
+		return nil, waitErr
+	}
+	return mb, err
+}
+
+func (r *throttleReader) Interrupt() {
+	common.Interrupt(r.Reader)
+}
@@ -0,0 +1,151 @@
+package dispatcher
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xflash-panda/server-vmess/internal/pkg/transfer"
+	"github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common/buf"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/pipe"
+)
+
+// clock is a fake clock of a meter, sleeping moves it forward at once
+type clock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.now = c.now.Add(d)
+	c.slept += d
+	return nil
+}
+
+// cappedDispatcher return a dispatcher with a meter of a 1 GB cap reached and the fake clock of the meter
+func cappedDispatcher(t *testing.T, config *transfer.Config) (*DefaultDispatcher, *transfer.Meter, *clock) {
+	t.Helper()
+	manager, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meter, err := transfer.New(config, manager, filepath.Join(t.TempDir(), "transfer.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &clock{now: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)}
+	meter.SetClock(c)
+	counter, err := manager.RegisterCounter("inbound>>>vmess>>>traffic>>>downlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter.Add(1 << 30)
+	// Close collects the counters
+	if err := meter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !meter.Status().Capped {
+		t.Fatal("transfer cap not reached")
+	}
+	d := &DefaultDispatcher{stats: manager, ohm: fakeOutbounds{}}
+	d.SetTransferMeter(meter)
+	return d, meter, c
+}
+
+func TestTransferCap(t *testing.T) {
+	d, meter, c := cappedDispatcher(t, &transfer.Config{Cap: 1, ResetDay: 15, Action: transfer.ActionStop})
+	handler := &closeHandler{}
+	d.ohm.(fakeOutbounds)[""] = handler
+	target := net.TCPDestination(net.ParseAddress("93.184.216.34"), 443)
+	dispatch := func() {
+		d.routedDispatch(userContext("a", target), newLink(), target, nil, new(classTrace), func() {})
+	}
+
+	dispatch()
+	if handler.links != 0 {
+		t.Fatal("link relayed over the cap")
+	}
+	// the links are relayed again once the period resets
+	c.now = time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	if err := meter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dispatch()
+	if handler.links != 1 {
+		t.Error("link refused once the period reset")
+	}
+}
+
+func TestTransferThrottle(t *testing.T) {
+	d, _, c := cappedDispatcher(t, &transfer.Config{Cap: 1, ResetDay: 1, Action: transfer.ActionThrottle, ThrottleRate: 1})
+	ctx := context.Background()
+	downlinkReader, downlinkWriter := pipe.New()
+	uplinkReader, uplinkWriter := pipe.New()
+	link := &transport.Link{Reader: uplinkReader, Writer: downlinkWriter}
+	d.throttle(ctx, link)
+	link = d.throttleUplink(ctx, link)
+
+	// the burst of a second passes at once, the rest at 1 KB/s
+	if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, make([]byte, 3*1024))); err != nil {
+		t.Fatal(err)
+	}
+	if c.slept != 2*time.Second {
+		t.Errorf("downlink waited %s for 3 KB, want 2s", c.slept)
+	}
+	mb, err := downlinkReader.ReadMultiBuffer()
+	if err != nil || mb.Len() != 3*1024 {
+		t.Errorf("downlink read %d bytes, %v", mb.Len(), err)
+	}
+	buf.ReleaseMulti(mb)
+
+	c.slept = 0
+	if err := uplinkWriter.WriteMultiBuffer(buf.MergeBytes(nil, make([]byte, 2*1024))); err != nil {
+		t.Fatal(err)
+	}
+	mb, err = link.Reader.ReadMultiBuffer()
+	if err != nil || mb.Len() != 2*1024 {
+		t.Errorf("uplink read %d bytes, %v", mb.Len(), err)
+	}
+	buf.ReleaseMulti(mb)
+	if c.slept != 2*time.Second {
+		t.Errorf("uplink waited %s for 2 KB, want 2s", c.slept)
+	}
+
+	// the link ends once its context is done
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	writer := &throttleWriter{ctx: canceled, meter: d.transfer, Writer: downlinkWriter}
+	if err := writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte("hello"))); err == nil {
+		t.Error("write of a link ended accepted")
+	}
+	if err := uplinkWriter.WriteMultiBuffer(buf.MergeBytes(nil, []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	reader := &throttleReader{ctx: canceled, meter: d.transfer, Reader: uplinkReader}
+	if _, err := reader.ReadMultiBuffer(); err == nil {
+		t.Error("read of a link ended accepted")
+	}
+}
+
+func TestTransferUncapped(t *testing.T) {
+	d := &DefaultDispatcher{}
+	if d.transferBlocked() {
+		t.Error("blocked without a meter")
+	}
+	link := &transport.Link{}
+	d.throttle(context.Background(), link)
+	if d.throttleUplink(context.Background(), link).Reader != nil || link.Writer != nil {
+		t.Error("link throttled without a meter")
+	}
+}
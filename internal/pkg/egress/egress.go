@@ -0,0 +1,108 @@
+// Package egress keeps users away from private, loopback and link-local networks and the node itself
+package egress
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// privateNetworks are blocked unless listed in Config.Allow
+var privateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+type Config struct {
+	Enabled bool
+	// Allow lists the networks or addresses which stay reachable, comma separated
+	Allow string
+}
+
+type Guard struct {
+	blocked []*net.IPNet
+	allow   []*net.IPNet
+}
+
+// New return a guard of the private networks and the addresses of the local interfaces
+func New(config *Config) (*Guard, error) {
+	g := &Guard{}
+	for _, cidr := range privateNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		g.blocked = append(g.blocked, network)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("list interface addresses failed: %s", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			g.blocked = append(g.blocked, hostNetwork(ipNet.IP))
+		}
+	}
+
+	for _, item := range strings.Split(config.Allow, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		network, err := parseNetwork(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress allow %s: %s", item, err)
+		}
+		g.allow = append(g.allow, network)
+	}
+	return g, nil
+}
+
+// Blocked report whether connecting to ip is forbidden
+func (g *Guard) Blocked(ip net.IP) bool {
+	for _, network := range g.allow {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	for _, network := range g.blocked {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("not an ip address")
+	}
+	return hostNetwork(ip), nil
+}
+
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,73 @@
+package egress
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBlocked(t *testing.T) {
+	guard, err := New(&Config{Enabled: true, Allow: "10.1.0.0/16, 192.168.1.5, fd00::53"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+		{"0.0.0.0", true},
+		{"10.0.0.1", true},
+		{"100.64.0.1", true},
+		{"127.0.0.1", true},
+		{"172.16.0.1", true},
+		{"192.168.0.1", true},
+		{"198.18.0.1", true},
+		{"224.0.0.1", true},
+		{"::", true},
+		{"::1", true},
+		{"fc00::1", true},
+		{"fe80::1", true},
+		{"ff02::1", true},
+		// the metadata service of the clouds
+		{"169.254.169.254", true},
+		{"::ffff:169.254.169.254", true},
+		{"::ffff:127.0.0.1", true},
+		// the exceptions win over the blocked ranges, in either notation
+		{"10.1.2.3", false},
+		{"::ffff:10.1.2.3", false},
+		{"192.168.1.5", false},
+		{"192.168.1.6", true},
+		{"fd00::53", false},
+		{"fd00::54", true},
+	}
+	for _, test := range tests {
+		if blocked := guard.Blocked(net.ParseIP(test.ip)); blocked != test.blocked {
+			t.Errorf("%s blocked %t, want %t", test.ip, blocked, test.blocked)
+		}
+	}
+}
+
+func TestBlockedLocalAddresses(t *testing.T) {
+	guard, err := New(&Config{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !guard.Blocked(ipNet.IP) {
+			t.Errorf("address %s of the node not blocked", ipNet.IP)
+		}
+	}
+}
+
+func TestInvalidAllow(t *testing.T) {
+	for _, allow := range []string{"10.0.0.0/33", "example.com", "10.0.0.256"} {
+		if _, err := New(&Config{Enabled: true, Allow: allow}); err == nil {
+			t.Errorf("allow %s accepted", allow)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// Package front accepts the connections of an inbound in place of xray, which listens on a unix socket behind it.
+// The front reads the PROXY protocol header of the load balancers, then it passes the client address on to the inbound
+// in a header of its own. With a decoy site it terminates TLS and serves the site to the requests which aren't
+// for the inbound.
+package front
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-vmess/internal/pkg/proxyprotocol"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/transport/internet"
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// handshakeTimeout bounds the time a client has to send what the front reads before the relay starts
+	handshakeTimeout = 10 * time.Second
+	dialTimeout      = 4 * time.Second
+	socketSuffix     = ".sock"
+)
+
+// Config is an inbound the front listens for
+type Config struct {
+	Tag string
+	// Network is the transport name of the inbound as xray builds it
+	Network string
+	// Listen is the address listened on, all addresses when nil
+	Listen  xnet.Address
+	Ports   *xnet.PortList
+	Sockopt *internet.SocketConfig
+	// Backend is the unix socket the inbound listens on
+	Backend string
+	// ProxyProtocol requires the PROXY protocol header from trusted peers
+	ProxyProtocol bool
+	// TLS is terminated by the front when set, with the certificate of the node besides the ones it holds,
+	// only the inbounds with a decoy have it as the front must read their requests
+	TLS *xtls.Config
+	// Decoy serves the site to the requests which aren't for the inbound: the websocket upgrades on the path
+	// of Paths, the h2 requests under it for one of Hosts, or the grpc requests for one of the methods of Paths
+	Decoy bool
+	Paths []string
+	Hosts []string
+}
+
+// Backend return the unix socket in dir of the inbound tagged tag
+func Backend(dir string, tag string) string {
+	return filepath.Join(dir, tag+socketSuffix)
+}
+
+// PrepareDir create dir for the unix sockets of the inbounds, only the node may connect to them,
+// the stale sockets of a previous run are removed as xray would fail to listen on them
+func PrepareDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("create front dir %s failed: %s", dir, err)
+	}
+	if err := os.Chmod(dir, 0o700); err != nil {
+		return fmt.Errorf("chmod front dir %s failed: %s", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read front dir %s failed: %s", dir, err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), socketSuffix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove stale socket %s failed: %s", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Sources decides which clients the front accepts, the banned ones are dropped before their handshake
+type Sources interface {
+	Allowed(ip net.IP) bool
+}
+
+type Front struct {
+	config     *Config
+	guard      *proxyprotocol.Guard
+	sources    Sources
+	tlsConfig  *tls.Config
+	site       http.Handler
+	siteServer *http.Server
+	h2Server   *http2.Server
+	access     sync.Mutex
+	listeners  []net.Listener
+}
+
+// New return the front of the inbound of config, guard must be set if it requires the PROXY protocol,
+// certificates if it terminates TLS and site if it serves a decoy, sources may be nil to accept every client
+func New(config *Config, guard *proxyprotocol.Guard, sources Sources, certificates Certificates, site http.Handler) (*Front, error) {
+	if config.ProxyProtocol && guard == nil {
+		return nil, fmt.Errorf("front %s: proxy protocol requires trusted sources", config.Tag)
+	}
+	f := &Front{config: config, guard: guard, sources: sources}
+	if config.Decoy {
+		if site == nil {
+			return nil, fmt.Errorf("front %s: decoy requires a site", config.Tag)
+		}
+		f.site = site
+		f.siteServer = &http.Server{Handler: site, ReadHeaderTimeout: handshakeTimeout, IdleTimeout: siteIdleTimeout}
+		f.h2Server = &http2.Server{IdleTimeout: siteIdleTimeout}
+		if err := http2.ConfigureServer(f.siteServer, f.h2Server); err != nil {
+			return nil, fmt.Errorf("front %s: configure h2 of the site failed: %s", config.Tag, err)
+		}
+	}
+	if config.TLS != nil {
+		if certificates == nil {
+			return nil, fmt.Errorf("front %s: tls requires the certificate of the node", config.Tag)
+		}
+		f.tlsConfig = tlsConfig(config, certificates)
+	}
+	return f, nil
+}
+
+// Start listen on the ports of the inbound with its socket options
+func (f *Front) Start() error {
+	f.access.Lock()
+	defer f.access.Unlock()
+	ip := xnet.AnyIP.IP()
+	if f.config.Listen != nil {
+		ip = f.config.Listen.IP()
+	}
+	for _, portRange := range f.config.Ports.Range {
+		for port := portRange.From; port <= portRange.To; port++ {
+			addr := &net.TCPAddr{IP: ip, Port: int(port)}
+			listener, err := internet.ListenSystem(context.Background(), addr, f.config.Sockopt)
+			if err != nil {
+				f.closeListeners()
+				return fmt.Errorf("front %s: listen on %s failed: %s", f.config.Tag, addr, err)
+			}
+			f.listeners = append(f.listeners, listener)
+			go f.accept(listener)
+		}
+	}
+	log.Infof("front %s listening on %d ports for %s", f.config.Tag, len(f.listeners), f.config.Backend)
+	return nil
+}
+
+func (f *Front) Close() error {
+	f.access.Lock()
+	defer f.access.Unlock()
+	f.closeListeners()
+	if f.siteServer != nil {
+		// the shutdown sends the h2 connections of the site a GOAWAY without waiting for them, the close ends the rest
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_ = f.siteServer.Shutdown(ctx)
+		_ = f.siteServer.Close()
+	}
+	return nil
+}
+
+func (f *Front) closeListeners() {
+	for _, listener := range f.listeners {
+		_ = listener.Close()
+	}
+	f.listeners = nil
+}
+
+func (f *Front) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Warnf("front %s: accept failed: %s", f.config.Tag, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go f.serve(conn)
+	}
+}
+
+// serve pass conn on to the inbound once its client is known
+func (f *Front) serve(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if f.config.ProxyProtocol {
+		proxyConn, err := f.guard.Accept(conn)
+		if err != nil {
+			log.Warnf("front %s: %s", f.config.Tag, err)
+			_ = conn.Close()
+			return
+		}
+		conn = proxyConn
+	}
+	if f.sources != nil {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !f.sources.Allowed(addr.IP) {
+			log.Debugf("front %s: %s is banned", f.config.Tag, addr.IP)
+			_ = conn.Close()
+			return
+		}
+	}
+	if f.tlsConfig != nil {
+		tlsConn := tls.Server(conn, f.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			log.Debugf("front %s: tls handshake with %s failed: %s", f.config.Tag, conn.RemoteAddr(), err)
+			_ = conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+	if f.config.Decoy {
+		if conn = f.route(conn); conn == nil {
+			return
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	f.relay(conn)
+}
+
+// relay copy conn to the inbound and back, the inbound reads the client address from the PROXY protocol header
+func (f *Front) relay(conn net.Conn) {
+	defer conn.Close()
+	backend, err := net.DialTimeout("unix", f.config.Backend, dialTimeout)
+	if err != nil {
+		log.Errorf("front %s: connect to the inbound failed: %s", f.config.Tag, err)
+		return
+	}
+	defer backend.Close()
+	if _, err := proxyprotocol.Header(conn).WriteTo(backend); err != nil {
+		log.Errorf("front %s: write proxy protocol header failed: %s", f.config.Tag, err)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(backend, conn)
+		// the client is done sending, the answer of the inbound may still be on its way
+		closeWrite(backend)
+	}()
+	_, _ = io.Copy(conn, backend)
+	// the inbound closed the link, the client side isn't waited for
+	_ = conn.Close()
+	<-done
+}
+
+func closeWrite(conn net.Conn) {
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = closer.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
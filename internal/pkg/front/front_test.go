@@ -0,0 +1,368 @@
+package front
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/xflash-panda/server-vmess/internal/pkg/cert"
+	xnet "github.com/xtls/xray-core/common/net"
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// echoBackend listen like the inbound behind the front, it answers the client address of the PROXY protocol header
+// and echoes the rest
+func echoBackend(t *testing.T) string {
+	t.Helper()
+	backend := Backend(t.TempDir(), "test")
+	listener, err := net.Listen("unix", backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				header, err := proxyproto.Read(reader)
+				if err != nil {
+					return
+				}
+				source, _, _ := header.TCPAddrs()
+				_, _ = fmt.Fprintf(conn, "%s\n", source.IP)
+				_, _ = io.Copy(conn, reader)
+			}()
+		}
+	}()
+	return backend
+}
+
+func freePort(t *testing.T) uint32 {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return uint32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func startFront(t *testing.T, config *Config, certificates Certificates) string {
+	t.Helper()
+	return startSite(t, config, certificates, nil)
+}
+
+func startSite(t *testing.T, config *Config, certificates Certificates, site http.Handler) string {
+	t.Helper()
+	return startGuarded(t, config, nil, certificates, site)
+}
+
+func startGuarded(t *testing.T, config *Config, sources Sources, certificates Certificates, site http.Handler) string {
+	t.Helper()
+	port := freePort(t)
+	config.Tag = "test"
+	config.Listen = xnet.LocalHostIP
+	config.Ports = &xnet.PortList{Range: []*xnet.PortRange{{From: port, To: port}}}
+	config.Backend = echoBackend(t)
+	f, err := New(config, nil, sources, certificates, site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+// roundTrip send line on conn and return the client address and the echo the backend answered
+func roundTrip(t *testing.T, reader *bufio.Reader, conn net.Conn, line string, readSource bool) (string, string) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, line+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	var source string
+	if readSource {
+		var err error
+		if source, err = reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	echo, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source, echo
+}
+
+func TestRelay(t *testing.T) {
+	addr := startFront(t, &Config{}, nil)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	source, echo := roundTrip(t, bufio.NewReader(conn), conn, "hello", true)
+	if source != "127.0.0.1\n" || echo != "hello\n" {
+		t.Errorf("backend answered %q and %q, want the client address and the echo", source, echo)
+	}
+}
+
+// sourcesFunc is the decision of the reputation tracker
+type sourcesFunc func(ip net.IP) bool
+
+func (f sourcesFunc) Allowed(ip net.IP) bool {
+	return f(ip)
+}
+
+func TestBannedSource(t *testing.T) {
+	var banned atomic.Bool
+	banned.Store(true)
+	addr := startGuarded(t, &Config{}, sourcesFunc(func(ip net.IP) bool { return !banned.Load() || !ip.IsLoopback() }), nil, nil)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("banned source read %v, want the connection closed", err)
+	}
+
+	banned.Store(false)
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if source, echo := roundTrip(t, bufio.NewReader(conn), conn, "hello", true); echo != "hello\n" {
+		t.Errorf("backend answered %q and %q once the ban is lifted, want the echo", source, echo)
+	}
+}
+
+func selfSigned(t *testing.T, serial int64) *cert.Pair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "node.test"},
+		DNSNames:     []string{"node.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := cert.ParsePair(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func dialTLS(t *testing.T, addr string, serverName string) (*tls.Conn, error) {
+	t.Helper()
+	return tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+}
+
+func TestTLSCertificateSwap(t *testing.T) {
+	store := &cert.Store{}
+	if err := store.Set(selfSigned(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	addr := startFront(t, &Config{TLS: &xtls.Config{}}, store)
+
+	held, err := dialTLS(t, addr, "node.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	reader := bufio.NewReader(held)
+	if _, echo := roundTrip(t, reader, held, "before", true); echo != "before\n" {
+		t.Fatalf("echo %q before the swap", echo)
+	}
+	if serial := held.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 1 {
+		t.Errorf("certificate %d, want 1", serial)
+	}
+
+	if err := store.Set(selfSigned(t, 2)); err != nil {
+		t.Fatal(err)
+	}
+	// the connection of the old certificate stays up
+	if _, echo := roundTrip(t, reader, held, "after", false); echo != "after\n" {
+		t.Errorf("echo %q on the held connection after the swap", echo)
+	}
+	conn, err := dialTLS(t, addr, "node.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("certificate %d after the swap, want 2", serial)
+	}
+}
+
+func TestTLSRejectUnknownSNI(t *testing.T) {
+	store := &cert.Store{}
+	if err := store.Set(selfSigned(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	addr := startFront(t, &Config{TLS: &xtls.Config{RejectUnknownSni: true}}, store)
+	if conn, err := dialTLS(t, addr, "other.test"); err == nil {
+		conn.Close()
+		t.Error("handshake for a name the certificate doesn't cover succeeded")
+	}
+	conn, err := dialTLS(t, addr, "node.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+var site = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+	_, _ = io.WriteString(writer, "site")
+})
+
+func TestDecoyWebSocket(t *testing.T) {
+	addr := startSite(t, &Config{Network: "websocket", Decoy: true, Paths: []string{"/ws"}}, nil, site)
+
+	response, err := http.Get("http://" + addr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "site" {
+		t.Errorf("plain request on the path answered %q, want the site", body)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	upgrade := "GET /ws HTTP/1.1\r\nHost: node.test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	source, echo := roundTrip(t, bufio.NewReader(conn), conn, upgrade+"hello", true)
+	if source != "127.0.0.1\n" || echo != "GET /ws HTTP/1.1\r\n" {
+		t.Errorf("upgrade reached the inbound as %q and %q, want the client address and the request", source, echo)
+	}
+}
+
+// h2Request write the preface and a request for host and path on conn like a grpc client, which acks the settings
+// of the server before the request
+func h2Request(t *testing.T, conn net.Conn, host string, path string) {
+	t.Helper()
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatal(err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings, ok := frame.(*http2.SettingsFrame); !ok || settings.IsAck() {
+		t.Fatalf("server sent %v first, want its settings", frame.Header())
+	}
+	if err := framer.WriteSettingsAck(); err != nil {
+		t.Fatal(err)
+	}
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	for _, field := range [][2]string{{":method", "GET"}, {":scheme", "https"}, {":authority", host}, {":path", path}} {
+		_ = encoder.WriteField(hpack.HeaderField{Name: field[0], Value: field[1]})
+	}
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndStream: true, EndHeaders: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecoyH2(t *testing.T) {
+	addr := startSite(t, &Config{Network: "http", Decoy: true, Paths: []string{"/h2"}, Hosts: []string{"node.test"}}, nil, site)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	h2Request(t, conn, "node.test", "/h2/stream")
+	reader := bufio.NewReader(conn)
+	source, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(reader, preface); err != nil || source != "127.0.0.1\n" || string(preface) != http2.ClientPreface {
+		t.Errorf("request reached the inbound as %q and %q, %v, want the client address and the preface", source, preface, err)
+	}
+	// the ack of the front settings is not for the inbound
+	framer := http2.NewFramer(io.Discard, reader)
+	for _, want := range []http2.FrameType{http2.FrameSettings, http2.FrameHeaders} {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Header().Type != want || frame.Header().Flags.Has(http2.FlagSettingsAck) && want == http2.FrameSettings {
+			t.Errorf("inbound read %v, want %v", frame.Header(), want)
+		}
+	}
+
+	for _, request := range [][2]string{{"other.test", "/h2/stream"}, {"node.test", "/"}} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		h2Request(t, conn, request[0], request[1])
+		framer := http2.NewFramer(io.Discard, conn)
+		var body string
+		for body == "" {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				t.Fatalf("request for %s%s: %s", request[0], request[1], err)
+			}
+			if data, ok := frame.(*http2.DataFrame); ok {
+				body = string(data.Data())
+			}
+		}
+		if body != "site" {
+			t.Errorf("request for %s%s answered %q, want the site", request[0], request[1], body)
+		}
+		conn.Close()
+	}
+}
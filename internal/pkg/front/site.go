@@ -0,0 +1,221 @@
+package front
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// maxFrames bounds the h2 frames read before the first request and the ack of the front settings
+	maxFrames = 64
+	// maxFrameSize is the largest h2 frame a client sends before the settings of the server raise it
+	maxFrameSize = 1 << 14
+	// siteIdleTimeout closes the keep-alive connections of the site like a web server would
+	siteIdleTimeout = 2 * time.Minute
+)
+
+// emptySettings is a settings frame of the server with the defaults, clients like grpc wait for it before a request
+var emptySettings = []byte{0, 0, 0, byte(http2.FrameSettings), 0, 0, 0, 0, 0}
+
+// route read the first request of conn and return conn with the bytes read put back if the request is for the inbound,
+// the site is served on conn otherwise and nil is returned. The first request decides for the whole connection.
+func (f *Front) route(conn net.Conn) net.Conn {
+	reader := bufio.NewReader(conn)
+	prefix, err := reader.Peek(len("PRI"))
+	if err != nil {
+		log.Debugf("front %s: read the first request of %s failed: %s", f.config.Tag, conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return nil
+	}
+	h2 := string(prefix) == "PRI"
+	var forInbound bool
+	var read []byte
+	if h2 {
+		forInbound, read, err = f.matchH2(conn, reader)
+	} else {
+		captured := &bytes.Buffer{}
+		forInbound, err = f.matchHTTP1(bufio.NewReader(io.TeeReader(reader, captured)))
+		read = captured.Bytes()
+	}
+	if err != nil {
+		log.Debugf("front %s: read the first request of %s failed: %s", f.config.Tag, conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return nil
+	}
+	replay := &replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(read), reader)}
+	if forInbound {
+		return replay
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if h2 {
+		f.h2Server.ServeConn(replay, &http2.ServeConnOpts{Handler: f.site, BaseConfig: f.siteServer})
+	} else {
+		if err := f.siteServer.Serve(&connListener{conn: replay, addr: conn.LocalAddr()}); errors.Is(err, http.ErrServerClosed) {
+			// the front closed before the server took the connection
+			_ = conn.Close()
+		}
+	}
+	return nil
+}
+
+// matchHTTP1 report whether the HTTP/1 request on reader is the websocket upgrade of the inbound
+func (f *Front) matchHTTP1(reader *bufio.Reader) (bool, error) {
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return false, err
+	}
+	return f.config.Network == "websocket" && contains(f.config.Paths, request.URL.Path) && websocket.IsWebSocketUpgrade(request), nil
+}
+
+// matchH2 report whether the first h2 request on reader is for the inbound, by its path and host or its grpc method
+// like xray, and return the frames read. The front sends empty settings first as grpc waits for them before the
+// request; the ack of the client is left out of the frames since the inbound or the site sends settings of its own.
+func (f *Front) matchH2(conn net.Conn, reader *bufio.Reader) (bool, []byte, error) {
+	read := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(reader, read); err != nil {
+		return false, nil, err
+	}
+	if string(read) != http2.ClientPreface {
+		return false, nil, fmt.Errorf("invalid h2 preface")
+	}
+	if _, err := conn.Write(emptySettings); err != nil {
+		return false, nil, err
+	}
+	var block []byte
+	var matched, decided, acked bool
+	for i := 0; i < maxFrames && !(decided && acked); i++ {
+		frame, err := readFrame(reader)
+		if err != nil {
+			return false, nil, err
+		}
+		frameType, flags := http2.FrameType(frame[3]), http2.Flags(frame[4])
+		if !acked && frameType == http2.FrameSettings && flags.Has(http2.FlagSettingsAck) {
+			acked = true
+			continue
+		}
+		read = append(read, frame...)
+		if decided || frameType != http2.FrameHeaders && (block == nil || frameType != http2.FrameContinuation) {
+			continue
+		}
+		block = append(block, frame...)
+		if flags.Has(http2.FlagHeadersEndHeaders) {
+			matched, decided = f.matchHeaders(block), true
+		}
+	}
+	if !(decided && acked) {
+		return false, nil, fmt.Errorf("no request in the first %d frames", maxFrames)
+	}
+	return matched, read, nil
+}
+
+// matchHeaders report whether the header block of the first h2 request is for the inbound
+func (f *Front) matchHeaders(block []byte) bool {
+	framer := http2.NewFramer(io.Discard, bytes.NewReader(block))
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		// the site rejects the malformed request
+		return false
+	}
+	headers := frame.(*http2.MetaHeadersFrame)
+	switch f.config.Network {
+	case "http":
+		target, err := url.ParseRequestURI(headers.PseudoValue("path"))
+		if err != nil {
+			return false
+		}
+		host := headers.PseudoValue("authority")
+		if host == "" {
+			host = field(headers, "host")
+		}
+		return len(f.config.Paths) > 0 && strings.HasPrefix(target.Path, f.config.Paths[0]) && contains(f.config.Hosts, host)
+	case "grpc":
+		// the methods are compared escaped as grpc sends them
+		return contains(f.config.Paths, headers.PseudoValue("path")) &&
+			strings.HasPrefix(field(headers, "content-type"), "application/grpc")
+	default:
+		return false
+	}
+}
+
+// readFrame read the next h2 frame of reader as it was sent
+func readFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	if length > maxFrameSize {
+		return nil, fmt.Errorf("h2 frame of %d bytes too large", length)
+	}
+	frame := append(header, make([]byte, length)...)
+	if _, err := io.ReadFull(reader, frame[len(header):]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// field return the value of the regular header field name of headers
+func field(headers *http2.MetaHeadersFrame, name string) string {
+	for _, f := range headers.RegularFields() {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// replayConn is a connection which reads the bytes already read from it first
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// connListener hands its connection to the http server once
+type connListener struct {
+	conn net.Conn
+	addr net.Addr
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if l.conn == nil {
+		return nil, io.EOF
+	}
+	conn := l.conn
+	l.conn = nil
+	return conn, nil
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
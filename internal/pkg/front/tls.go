@@ -0,0 +1,43 @@
+package front
+
+import (
+	"crypto/tls"
+	"errors"
+
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+)
+
+var errNoCertificate = errors.New("no certificate for the server name")
+
+// Certificates hand out the certificate of the node, it is read on every handshake so a new one
+// applies without listening again
+type Certificates interface {
+	Certificate() *tls.Certificate
+}
+
+// tlsConfig return the TLS config of the inbound of config. The certificate of the node is preferred
+// for the names it covers, the certificates of the node config answer the others like xray would.
+func tlsConfig(config *Config, certificates Certificates) *tls.Config {
+	var opts []xtls.Option
+	if config.Network == "http" || config.Network == "grpc" {
+		opts = append(opts, xtls.WithNextProto("h2"))
+	}
+	tlsConfig := config.TLS.GetTLSConfig(opts...)
+	configured := tlsConfig.GetCertificate
+	hasConfigured := len(config.TLS.Certificate) > 0
+	rejectUnknown := config.TLS.RejectUnknownSni
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		certificate := certificates.Certificate()
+		if certificate != nil && hello.ServerName != "" && certificate.Leaf.VerifyHostname(hello.ServerName) == nil {
+			return certificate, nil
+		}
+		if hasConfigured {
+			return configured(hello)
+		}
+		if certificate == nil || rejectUnknown {
+			return nil, errNoCertificate
+		}
+		return certificate, nil
+	}
+	return tlsConfig
+}
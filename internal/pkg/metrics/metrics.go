@@ -0,0 +1,54 @@
+// Package metrics keeps the node metrics in the xray stats counters and exports them in the Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/xtls/xray-core/features/stats"
+)
+
+// prefix marks the counters which are node metrics, the user traffic counters are not exported
+const prefix = "node>>>"
+
+type visitor interface {
+	VisitCounters(func(string, stats.Counter) bool)
+}
+
+// Counter return the counter of the metric, e.g. Counter(m, "cert", "reload_failed") is node>>>cert>>>reload_failed
+func Counter(m stats.Manager, names ...string) stats.Counter {
+	counter, err := stats.GetOrRegisterCounter(m, prefix+strings.Join(names, ">>>"))
+	if err != nil {
+		// only a NoopManager fails, count into nothing
+		return &noopCounter{}
+	}
+	return counter
+}
+
+// Handler write every node metric as vmess_node_<names>
+func Handler(m stats.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lines := make([]string, 0)
+		if v, ok := m.(visitor); ok {
+			v.VisitCounters(func(name string, counter stats.Counter) bool {
+				if strings.HasPrefix(name, prefix) {
+					lines = append(lines, fmt.Sprintf("vmess_node_%s %d", strings.ReplaceAll(strings.TrimPrefix(name, prefix), ">>>", "_"), counter.Value()))
+				}
+				return true
+			})
+		}
+		sort.Strings(lines)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, line := range lines {
+			_, _ = fmt.Fprintln(w, line)
+		}
+	}
+}
+
+type noopCounter struct{}
+
+func (*noopCounter) Value() int64    { return 0 }
+func (*noopCounter) Set(int64) int64 { return 0 }
+func (*noopCounter) Add(int64) int64 { return 0 }
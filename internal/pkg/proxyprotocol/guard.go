@@ -0,0 +1,122 @@
+// Package proxyprotocol rejects the PROXY protocol headers of peers which are not trusted to send them
+package proxyprotocol
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// Guard only lets the load balancers send the client address
+type Guard struct {
+	trusted []*net.IPNet
+}
+
+// New return a guard trusting the networks or addresses of trusted, comma separated
+func New(trusted string) (*Guard, error) {
+	g := &Guard{}
+	for _, item := range strings.Split(trusted, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy protocol trusted source %s: %s", item, err)
+		}
+		g.trusted = append(g.trusted, network)
+	}
+	if len(g.trusted) == 0 {
+		return nil, fmt.Errorf("proxy protocol requires trusted sources")
+	}
+	return g, nil
+}
+
+// Trusted report whether addr may send a PROXY protocol header
+func (g *Guard) Trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range g.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection of a trusted peer, its remote address is the client address of the PROXY protocol header
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	source net.Addr
+}
+
+// Accept read the PROXY protocol header of conn, which is refused unless its peer is trusted and sends a header.
+// A header of the LOCAL command, e.g. from a health check, leaves the address of the peer.
+func (g *Guard) Accept(conn net.Conn) (*Conn, error) {
+	peer := conn.RemoteAddr()
+	if !g.Trusted(peer) {
+		return nil, fmt.Errorf("proxy protocol from untrusted peer %s rejected", peer)
+	}
+	reader := bufio.NewReader(conn)
+	header, err := proxyproto.Read(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read proxy protocol header from %s failed: %s", peer, err)
+	}
+	c := &Conn{Conn: conn, reader: reader, source: peer}
+	if header.Command.IsProxy() {
+		if source, _, ok := header.TCPAddrs(); ok {
+			c.source = source
+		}
+	}
+	return c, nil
+}
+
+// Read read the bytes after the header, some may already be buffered
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr return the client address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.source
+}
+
+// Peer return the address of the load balancer
+func (c *Conn) Peer() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite shut down the writing side, if the connection under it supports it
+func (c *Conn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// Header return the PROXY protocol header which passes the client address of conn on
+func Header(conn net.Conn) *proxyproto.Header {
+	source, _ := conn.RemoteAddr().(*net.TCPAddr)
+	dest, _ := conn.LocalAddr().(*net.TCPAddr)
+	if source == nil || dest == nil {
+		return &proxyproto.Header{Version: 2, Command: proxyproto.LOCAL, TransportProtocol: proxyproto.UNSPEC}
+	}
+	if source.IP.To4() != nil && dest.IP.To4() == nil {
+		// an IPv4 client on an IPv6 only address, the header holds addresses of one family
+		dest = &net.TCPAddr{IP: net.IPv4zero, Port: dest.Port}
+	}
+	return proxyproto.HeaderProxyFromAddrs(2, source, dest)
+}
@@ -0,0 +1,118 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// accepted return the server side of a loopback connection the client wrote data on
+func accepted(t *testing.T, data string) net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	if _, err := io.WriteString(client, data); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestNew(t *testing.T) {
+	g, err := New("10.0.0.0/8, 127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.Trusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) || !g.Trusted(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}) {
+		t.Error("listed sources not trusted")
+	}
+	if g.Trusted(&net.TCPAddr{IP: net.ParseIP("127.0.0.2")}) {
+		t.Error("127.0.0.2 trusted, only 127.0.0.1 is listed")
+	}
+	if _, err := New(" , "); err == nil {
+		t.Error("no trusted sources returned no error")
+	}
+}
+
+func TestAccept(t *testing.T) {
+	g, _ := New("127.0.0.1")
+	conn := accepted(t, "PROXY TCP4 203.0.113.7 192.0.2.1 5555 443\r\nhello")
+	proxyConn, err := g.Accept(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := proxyConn.RemoteAddr().String(); got != "203.0.113.7:5555" {
+		t.Errorf("remote address %s, want the client of the header", got)
+	}
+	if proxyConn.Peer().String() != conn.RemoteAddr().String() {
+		t.Errorf("peer %s, want the load balancer %s", proxyConn.Peer(), conn.RemoteAddr())
+	}
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(proxyConn, data); err != nil || string(data) != "hello" {
+		t.Errorf("read %q, %v after the header, want hello", data, err)
+	}
+}
+
+func TestAcceptRejected(t *testing.T) {
+	untrusted, _ := New("10.0.0.0/8")
+	if _, err := untrusted.Accept(accepted(t, "PROXY TCP4 203.0.113.7 192.0.2.1 5555 443\r\n")); err == nil {
+		t.Error("header of an untrusted peer accepted")
+	}
+	trusted, _ := New("127.0.0.1")
+	if _, err := trusted.Accept(accepted(t, "GET / HTTP/1.1\r\n\r\n")); err == nil {
+		t.Error("connection without a header accepted")
+	}
+}
+
+func TestAcceptLocal(t *testing.T) {
+	g, _ := New("127.0.0.1")
+	header := &proxyproto.Header{Version: 2, Command: proxyproto.LOCAL, TransportProtocol: proxyproto.UNSPEC}
+	data, err := header.Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := accepted(t, string(data))
+	proxyConn, err := g.Accept(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyConn.RemoteAddr().String() != conn.RemoteAddr().String() {
+		t.Errorf("remote address %s of a health check, want the peer %s", proxyConn.RemoteAddr(), conn.RemoteAddr())
+	}
+}
+
+func TestHeader(t *testing.T) {
+	g, _ := New("127.0.0.1")
+	proxyConn, err := g.Accept(accepted(t, "PROXY TCP4 203.0.113.7 192.0.2.1 5555 443\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Header(proxyConn).Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := proxyproto.Read(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, _, ok := header.TCPAddrs()
+	if !ok || source.String() != "203.0.113.7:5555" {
+		t.Errorf("header source %v, want the client", header.SourceAddr)
+	}
+}
@@ -0,0 +1,72 @@
+// Package reality generates the keys of the REALITY security
+package reality
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// MaxShortIDLen is the longest short id in bytes, xray reads 8 bytes
+const MaxShortIDLen = 8
+
+// KeyPair is an x25519 key pair encoded like the xray config expects it
+type KeyPair struct {
+	PrivateKey string
+	PublicKey  string
+}
+
+// GenerateKey return a random key pair
+func GenerateKey() (*KeyPair, error) {
+	privateKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(privateKey); err != nil {
+		return nil, err
+	}
+	return keyPair(privateKey)
+}
+
+// KeyFromPrivate return the pair of an existing private key
+func KeyFromPrivate(privateKey string) (*KeyPair, error) {
+	key, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil || len(key) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("invalid private key %s", privateKey)
+	}
+	return keyPair(key)
+}
+
+func keyPair(privateKey []byte) (*KeyPair, error) {
+	// clamp as described at https://cr.yp.to/ecdh.html, the same as xray x25519
+	privateKey[0] &= 248
+	privateKey[31] &= 127
+	privateKey[31] |= 64
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{
+		PrivateKey: base64.RawURLEncoding.EncodeToString(privateKey),
+		PublicKey:  base64.RawURLEncoding.EncodeToString(publicKey),
+	}, nil
+}
+
+// ShortIDs return count random short ids of size bytes in hex
+func ShortIDs(count int, size int) ([]string, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("short id count must be at least 1, not %d", count)
+	}
+	if size < 1 || size > MaxShortIDLen {
+		return nil, fmt.Errorf("short id length must be between 1 and %d bytes", MaxShortIDLen)
+	}
+	ids := make([]string, count)
+	for i := range ids {
+		b := make([]byte, size)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		ids[i] = hex.EncodeToString(b)
+	}
+	return ids, nil
+}
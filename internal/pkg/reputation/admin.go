@@ -0,0 +1,20 @@
+package reputation
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/xflash-panda/server-vmess/internal/pkg/admin"
+)
+
+// ServeBans list the bans on GET, and clear the ban of the ip query parameter (or every ban) on DELETE
+func (t *Tracker) ServeBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		admin.WriteJSON(w, t.Bans())
+	case http.MethodDelete:
+		admin.WriteJSON(w, map[string]int{"cleared": t.Clear(r.URL.Query().Get("ip"))})
+	default:
+		admin.WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
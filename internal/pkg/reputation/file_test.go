@@ -0,0 +1,34 @@
+package reputation
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLoadCIDRFile(t *testing.T) {
+	networks, err := loadCIDRFile(writeList(t, "# bad actors\n198.51.100.0/24\n\n  203.0.113.9  # a single host\n2001:db8::/32\n2001:db8:1::1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, network := range networks {
+		got = append(got, network.String())
+	}
+	want := "198.51.100.0/24 203.0.113.9/32 2001:db8::/32 2001:db8:1::1/128"
+	if strings.Join(got, " ") != want {
+		t.Errorf("networks %v, want %s", got, want)
+	}
+	if !containsIP(networks, net.ParseIP("::ffff:203.0.113.9")) {
+		t.Error("IPv4-mapped address of a listed host not contained")
+	}
+
+	for _, content := range []string{"203.0.113.300\n", "198.51.100.0/33\n"} {
+		if _, err := loadCIDRFile(writeList(t, "# header\n"+content)); err == nil || !strings.Contains(err.Error(), ":2:") {
+			t.Errorf("%q loaded with %v, want an error at line 2", content, err)
+		}
+	}
+	if _, err := loadCIDRFile(t.TempDir() + "/missing"); err == nil {
+		t.Error("missing file loaded")
+	}
+}
@@ -0,0 +1,44 @@
+package reputation
+
+import (
+	"net"
+
+	"github.com/xtls/xray-core/common/log"
+)
+
+// recorder counts the handshakes the inbounds reject as failures of their source, xray logs them as rejected
+// access before it drops the connection
+type recorder struct {
+	next    log.Handler
+	tracker *Tracker
+}
+
+// Recorder return the log handler of xray which records the failed handshakes and hands every message on to next,
+// the front of an inbound rejects the banned sources before the handshake, see front.Sources
+func (t *Tracker) Recorder(next log.Handler) log.Handler {
+	return &recorder{next: next, tracker: t}
+}
+
+func (r *recorder) Handle(msg log.Message) {
+	if access, ok := msg.(*log.AccessMessage); ok && access.Status == log.AccessRejected {
+		if ip := sourceIP(access.From); ip != nil {
+			r.tracker.Failure(ip)
+		}
+	}
+	if r.next != nil {
+		r.next.Handle(msg)
+	}
+}
+
+// sourceIP return the address of the client from of a rejected access, nil if it has none
+func sourceIP(from interface{}) net.IP {
+	addr, ok := from.(net.Addr)
+	if !ok {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
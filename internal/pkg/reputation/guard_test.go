@@ -0,0 +1,47 @@
+package reputation
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/common/log"
+)
+
+type handled struct {
+	messages []log.Message
+}
+
+func (h *handled) Handle(msg log.Message) {
+	h.messages = append(h.messages, msg)
+}
+
+func TestRecorder(t *testing.T) {
+	tracker, _ := newTracker(t, &Config{Threshold: 2, Window: time.Minute, BanDuration: time.Hour})
+	next := &handled{}
+	recorder := tracker.Recorder(next)
+	source := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40000}
+	messages := []log.Message{
+		&log.AccessMessage{From: source, Status: log.AccessAccepted, To: "example.com:443"},
+		&log.AccessMessage{From: source, Status: log.AccessRejected, Reason: errors.New("invalid user")},
+		&log.GeneralMessage{Severity: log.Severity_Info, Content: "started"},
+		// a rejection without a source address isn't counted
+		&log.AccessMessage{From: "unknown", Status: log.AccessRejected},
+	}
+	for _, msg := range messages {
+		recorder.Handle(msg)
+	}
+	if len(next.messages) != len(messages) {
+		t.Errorf("%d messages handed on, want %d", len(next.messages), len(messages))
+	}
+	if !tracker.Allowed(source.IP) {
+		t.Fatal("banned after one rejected handshake")
+	}
+	recorder.Handle(&log.AccessMessage{From: source, Status: log.AccessRejected})
+	if tracker.Allowed(source.IP) {
+		t.Error("not banned after two rejected handshakes")
+	}
+	// without the log of xray the failures are still recorded
+	tracker.Recorder(nil).Handle(&log.AccessMessage{From: source, Status: log.AccessRejected})
+}
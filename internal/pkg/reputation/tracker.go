@@ -0,0 +1,205 @@
+// Package reputation bans the source addresses which keep failing the handshake
+package reputation
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xtls/xray-core/common/task"
+)
+
+type Config struct {
+	// Threshold of failures within Window before a source is banned, 0 disables banning
+	Threshold      int
+	Window         time.Duration
+	BanDuration    time.Duration
+	MaxBanDuration time.Duration
+	AllowFile      string
+	DenyFile       string
+}
+
+// Enabled report whether the tracker bans any source, the inbounds are fronted to reject them on accept then
+func (c *Config) Enabled() bool {
+	return c.Threshold > 0 || c.DenyFile != ""
+}
+
+// Ban is the state of a banned source
+type Ban struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+	Level int       `json:"level"`
+}
+
+type source struct {
+	windowStart time.Time
+	failures    int
+	bannedUntil time.Time
+	level       int
+}
+
+type Tracker struct {
+	access        sync.RWMutex
+	config        *Config
+	allow         []*net.IPNet
+	deny          []*net.IPNet
+	sources       map[string]*source
+	cleanPeriodic *task.Periodic
+	// now is the clock of the windows and the bans
+	now func() time.Time
+}
+
+// New return a tracker with the static lists loaded
+func New(config *Config) (*Tracker, error) {
+	t := &Tracker{
+		config:  config,
+		sources: make(map[string]*source),
+		now:     time.Now,
+	}
+	var err error
+	if config.AllowFile != "" {
+		if t.allow, err = loadCIDRFile(config.AllowFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.DenyFile != "" {
+		if t.deny, err = loadCIDRFile(config.DenyFile); err != nil {
+			return nil, err
+		}
+	}
+	log.Infof("reputation: %d allowed, %d denied networks loaded", len(t.allow), len(t.deny))
+	return t, nil
+}
+
+func (t *Tracker) Start() error {
+	t.cleanPeriodic = &task.Periodic{
+		Interval: time.Minute,
+		Execute:  t.clean,
+	}
+	return t.cleanPeriodic.Start()
+}
+
+func (t *Tracker) Close() error {
+	if t.cleanPeriodic != nil {
+		return t.cleanPeriodic.Close()
+	}
+	return nil
+}
+
+// Allowed report whether a new connection from ip is accepted
+func (t *Tracker) Allowed(ip net.IP) bool {
+	if containsIP(t.deny, ip) {
+		return false
+	}
+	if containsIP(t.allow, ip) {
+		return true
+	}
+	t.access.RLock()
+	defer t.access.RUnlock()
+	s, ok := t.sources[ip.String()]
+	return !ok || !t.now().Before(s.bannedUntil)
+}
+
+// Failure record a failed or timed out handshake of ip, and ban it once the threshold is reached
+func (t *Tracker) Failure(ip net.IP) {
+	if t.config.Threshold <= 0 || containsIP(t.allow, ip) {
+		return
+	}
+	now := t.now()
+	key := ip.String()
+
+	t.access.Lock()
+	defer t.access.Unlock()
+	s, ok := t.sources[key]
+	if !ok {
+		s = &source{}
+		t.sources[key] = s
+	}
+	if now.Sub(s.windowStart) > t.config.Window {
+		s.windowStart = now
+		s.failures = 0
+	}
+	s.failures++
+	if s.failures < t.config.Threshold {
+		return
+	}
+
+	s.level++
+	s.failures = 0
+	s.bannedUntil = now.Add(t.banDuration(s.level))
+	log.Warnf("reputation: %s banned until %s after %d handshake failures", key, s.bannedUntil.Format(time.RFC3339), t.config.Threshold)
+}
+
+// banDuration doubles the ban for every repeated offence
+func (t *Tracker) banDuration(level int) time.Duration {
+	d := t.config.BanDuration
+	for i := 1; i < level && d < t.config.MaxBanDuration; i++ {
+		d *= 2
+	}
+	if t.config.MaxBanDuration > 0 && d > t.config.MaxBanDuration {
+		d = t.config.MaxBanDuration
+	}
+	return d
+}
+
+// Bans return the sources which are currently banned
+func (t *Tracker) Bans() []Ban {
+	now := t.now()
+	t.access.RLock()
+	bans := make([]Ban, 0)
+	for ip, s := range t.sources {
+		if now.Before(s.bannedUntil) {
+			bans = append(bans, Ban{IP: ip, Until: s.bannedUntil, Level: s.level})
+		}
+	}
+	t.access.RUnlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// Clear lift the ban of ip and forget its history, an empty ip clears every source
+func (t *Tracker) Clear(ip string) int {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if ip == "" {
+		n := len(t.sources)
+		t.sources = make(map[string]*source)
+		return n
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	if _, ok := t.sources[ip]; !ok {
+		return 0
+	}
+	delete(t.sources, ip)
+	return 1
+}
+
+// clean drop the sources that are neither banned nor counting, the ban level is kept for MaxBanDuration after a ban
+func (t *Tracker) clean() error {
+	now := t.now()
+	t.access.Lock()
+	defer t.access.Unlock()
+	for ip, s := range t.sources {
+		if now.Sub(s.windowStart) <= t.config.Window {
+			continue
+		}
+		if s.level > 0 && now.Before(s.bannedUntil.Add(t.config.MaxBanDuration)) {
+			continue
+		}
+		delete(t.sources, ip)
+	}
+	return nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
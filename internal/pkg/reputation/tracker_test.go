@@ -0,0 +1,180 @@
+package reputation
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// clock is the time of a tracker under test
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTracker(t *testing.T, config *Config) (*Tracker, *clock) {
+	t.Helper()
+	tracker, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tracker.now = c.Now
+	return tracker, c
+}
+
+func writeList(t *testing.T, lines string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(path, []byte(lines), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestThreshold(t *testing.T) {
+	tracker, c := newTracker(t, &Config{Threshold: 3, Window: time.Minute, BanDuration: time.Hour, MaxBanDuration: 8 * time.Hour})
+	ip := net.ParseIP("203.0.113.1")
+
+	tracker.Failure(ip)
+	tracker.Failure(ip)
+	if !tracker.Allowed(ip) {
+		t.Fatal("banned below the threshold")
+	}
+	// the failures of an old window don't add up
+	c.Advance(2 * time.Minute)
+	tracker.Failure(ip)
+	tracker.Failure(ip)
+	if !tracker.Allowed(ip) {
+		t.Fatal("banned with the failures of an expired window")
+	}
+	tracker.Failure(ip)
+	if tracker.Allowed(ip) {
+		t.Fatal("not banned at the threshold")
+	}
+	if !tracker.Allowed(net.ParseIP("203.0.113.2")) {
+		t.Error("another source banned")
+	}
+	bans := tracker.Bans()
+	if len(bans) != 1 || bans[0].IP != "203.0.113.1" || bans[0].Level != 1 || !bans[0].Until.Equal(c.now.Add(time.Hour)) {
+		t.Errorf("bans %+v, want 203.0.113.1 at level 1 for an hour", bans)
+	}
+}
+
+func TestBanEscalation(t *testing.T) {
+	tracker, c := newTracker(t, &Config{Threshold: 1, Window: time.Minute, BanDuration: time.Hour, MaxBanDuration: 5 * time.Hour})
+	ip := net.ParseIP("2001:db8::1")
+	for level, want := range []time.Duration{time.Hour, 2 * time.Hour, 4 * time.Hour, 5 * time.Hour, 5 * time.Hour} {
+		tracker.Failure(ip)
+		bans := tracker.Bans()
+		if len(bans) != 1 || bans[0].Level != level+1 || bans[0].Until.Sub(c.now) != want {
+			t.Fatalf("offence %d banned %+v, want level %d for %s", level+1, bans, level+1, want)
+		}
+		// the ban expires and the source offends again
+		c.Advance(want)
+		if !tracker.Allowed(ip) {
+			t.Fatalf("offence %d still banned once the ban expired", level+1)
+		}
+		c.Advance(2 * time.Minute)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	tracker, c := newTracker(t, &Config{Threshold: 2, Window: time.Minute, BanDuration: time.Hour, MaxBanDuration: 4 * time.Hour})
+	banned, counting := net.ParseIP("203.0.113.1"), net.ParseIP("203.0.113.2")
+	tracker.Failure(banned)
+	tracker.Failure(banned)
+
+	c.Advance(time.Hour - time.Second)
+	if tracker.Allowed(banned) {
+		t.Fatal("ban lifted before it expired")
+	}
+	c.Advance(time.Second)
+	if !tracker.Allowed(banned) || len(tracker.Bans()) != 0 {
+		t.Fatal("ban not lifted once it expired")
+	}
+
+	// the level of the ban is kept for MaxBanDuration after it, a counting source only for its window
+	tracker.Failure(counting)
+	c.Advance(2 * time.Minute)
+	_ = tracker.clean()
+	if _, ok := tracker.sources["203.0.113.2"]; ok {
+		t.Error("source kept after its window")
+	}
+	if _, ok := tracker.sources["203.0.113.1"]; !ok {
+		t.Fatal("level of an expired ban dropped before MaxBanDuration")
+	}
+	c.Advance(4 * time.Hour)
+	_ = tracker.clean()
+	if _, ok := tracker.sources["203.0.113.1"]; ok {
+		t.Error("level of an expired ban kept after MaxBanDuration")
+	}
+	tracker.Failure(banned)
+	tracker.Failure(banned)
+	if bans := tracker.Bans(); len(bans) != 1 || bans[0].Level != 1 {
+		t.Errorf("bans %+v after the level is forgotten, want level 1", bans)
+	}
+}
+
+func TestAllowDeny(t *testing.T) {
+	tracker, _ := newTracker(t, &Config{
+		Threshold:   1,
+		Window:      time.Minute,
+		BanDuration: time.Hour,
+		AllowFile:   writeList(t, "10.0.0.0/8\n192.0.2.7\n"),
+		DenyFile:    writeList(t, "10.1.0.0/16\n"),
+	})
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		// the deny list wins over the allow list
+		{"10.1.2.3", false},
+		// the failures of an allowed source aren't counted
+		{"10.2.3.4", true},
+		{"192.0.2.7", true},
+		{"192.0.2.8", false},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		tracker.Failure(ip)
+		if allowed := tracker.Allowed(ip); allowed != test.allowed {
+			t.Errorf("%s allowed %t after a failure, want %t", test.ip, allowed, test.allowed)
+		}
+	}
+	if bans := tracker.Bans(); len(bans) != 1 || bans[0].IP != "192.0.2.8" {
+		t.Errorf("bans %+v, want the unlisted source only", bans)
+	}
+}
+
+func TestClear(t *testing.T) {
+	tracker, _ := newTracker(t, &Config{Threshold: 1, Window: time.Minute, BanDuration: time.Hour})
+	tracker.Failure(net.ParseIP("203.0.113.1"))
+	tracker.Failure(net.ParseIP("2001:db8::1"))
+	if n := tracker.Clear("2001:0db8::1"); n != 1 || !tracker.Allowed(net.ParseIP("2001:db8::1")) {
+		t.Errorf("clear of the ban in another notation cleared %d", n)
+	}
+	if n := tracker.Clear(""); n != 1 || len(tracker.Bans()) != 0 {
+		t.Errorf("clear of every ban cleared %d, left %+v", n, tracker.Bans())
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	tracker, _ := newTracker(t, &Config{Window: time.Minute, BanDuration: time.Hour})
+	ip := net.ParseIP("203.0.113.1")
+	for i := 0; i < 100; i++ {
+		tracker.Failure(ip)
+	}
+	if !tracker.Allowed(ip) {
+		t.Error("banned with a threshold of 0")
+	}
+}
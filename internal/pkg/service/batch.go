@@ -0,0 +1,132 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxPendingBatches bounds the batches kept while the panel is down, the oldest ones are dropped beyond it
+const maxPendingBatches = 1000
+
+// TrafficBatch is a report of the traffic of the users between Start and End, the ids of the batches of
+// a node only grow, so the panel can drop a batch it has already stored when the node retries it
+type TrafficBatch struct {
+	ID      uint64         `json:"batch_id"`
+	Start   time.Time      `json:"window_start"`
+	End     time.Time      `json:"window_end"`
+	Traffic []*UserTraffic `json:"traffic"`
+}
+
+// batchState is the sequence of the batch ids and the batches the panel hasn't acknowledged, kept across restarts
+type batchState struct {
+	Sequence uint64 `json:"sequence"`
+	// WindowEnd is the end of the last batch, the start of the next one
+	WindowEnd time.Time       `json:"window_end"`
+	Pending   []*TrafficBatch `json:"pending"`
+}
+
+type batchQueue struct {
+	access sync.Mutex
+	// path is the file of the state, empty to keep it in memory
+	path       string
+	state      batchState
+	saveFailed bool
+}
+
+func loadBatchQueue(path string, now time.Time) (*batchQueue, error) {
+	q := &batchQueue{path: path}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("read traffic batches failed: %s", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &q.state); err != nil {
+				return nil, fmt.Errorf("parse traffic batches %s failed: %s", path, err)
+			}
+		}
+	}
+	if q.state.WindowEnd.IsZero() {
+		q.state.WindowEnd = now
+	}
+	if len(q.state.Pending) > 0 {
+		log.Infof("%d traffic batches from the last run to report", len(q.state.Pending))
+	}
+	return q, nil
+}
+
+// add queue the traffic up to now as the next batch
+func (q *batchQueue) add(traffic []*UserTraffic, now time.Time) {
+	q.access.Lock()
+	defer q.access.Unlock()
+	q.state.Sequence++
+	q.state.Pending = append(q.state.Pending, &TrafficBatch{
+		ID:      q.state.Sequence,
+		Start:   q.state.WindowEnd,
+		End:     now,
+		Traffic: traffic,
+	})
+	q.state.WindowEnd = now
+	if dropped := len(q.state.Pending) - maxPendingBatches; dropped > 0 {
+		log.Errorf("%d traffic batches dropped, the panel hasn't acknowledged the last %d", dropped, maxPendingBatches)
+		q.state.Pending = q.state.Pending[dropped:]
+	}
+	q.save()
+}
+
+// flush submit the pending batches in order, a batch is kept until submit succeeds
+func (q *batchQueue) flush(submit func(*TrafficBatch) error) error {
+	q.access.Lock()
+	defer q.access.Unlock()
+	defer q.save()
+	for len(q.state.Pending) > 0 {
+		batch := q.state.Pending[0]
+		if err := submit(batch); err != nil {
+			return fmt.Errorf("report traffic batch %d failed, %d batches kept: %s", batch.ID, len(q.state.Pending), err)
+		}
+		q.state.Pending = q.state.Pending[1:]
+	}
+	return nil
+}
+
+// save replace the file by a rename, so a crash never leaves half of it, a failure is logged once
+func (q *batchQueue) save() {
+	if q.path == "" {
+		return
+	}
+	err := q.write()
+	if err != nil && !q.saveFailed {
+		log.Errorf("traffic batches not saved, they are kept in memory: %s", err)
+	}
+	q.saveFailed = err != nil
+}
+
+func (q *batchQueue) write() error {
+	data, err := json.Marshal(&q.state)
+	if err != nil {
+		return err
+	}
+	return writeFile(q.path, data)
+}
+
+// writeFile replace the file at path by a rename, so a crash never leaves half of it
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create dir of %s failed: %s", path, err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write %s failed: %s", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename %s failed: %s", tmp, err)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/xflash-panda/server-client/pkg"
+)
+
+var batchStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func testTraffic(uid int, upload uint64) []*UserTraffic {
+	return []*UserTraffic{{UserTraffic: api.UserTraffic{UID: uid, Upload: upload, Download: 2 * upload, Count: 1}, RawUpload: upload, RawDownload: 2 * upload}}
+}
+
+func loadQueue(t *testing.T, path string, now time.Time) *batchQueue {
+	t.Helper()
+	q, err := loadBatchQueue(path, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// collect return a submit which records the batches, failing with err
+func collect(submitted *[]*TrafficBatch, err error) func(*TrafficBatch) error {
+	return func(batch *TrafficBatch) error {
+		*submitted = append(*submitted, batch)
+		return err
+	}
+}
+
+func batchIDs(batches []*TrafficBatch) []uint64 {
+	ids := make([]uint64, len(batches))
+	for i, batch := range batches {
+		ids[i] = batch.ID
+	}
+	return ids
+}
+
+func equalIDs(a []uint64, b ...uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBatchSequenceRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "traffic-1.json")
+	q := loadQueue(t, path, batchStart)
+	q.add(testTraffic(1, 100), batchStart.Add(time.Minute))
+	q.add(testTraffic(1, 200), batchStart.Add(2*time.Minute))
+	var submitted []*TrafficBatch
+	if err := q.flush(collect(&submitted, errors.New("panel down"))); err == nil {
+		t.Fatal("failed submit flushed")
+	}
+
+	// the node restarts with the batches the panel hasn't acknowledged
+	q = loadQueue(t, path, batchStart.Add(time.Hour))
+	if got := batchIDs(q.state.Pending); !equalIDs(got, 1, 2) {
+		t.Fatalf("pending batches %v after a restart, want 1 and 2", got)
+	}
+	q.add(testTraffic(2, 300), batchStart.Add(3*time.Minute))
+	submitted = nil
+	if err := q.flush(collect(&submitted, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := batchIDs(submitted); !equalIDs(got, 1, 2, 3) {
+		t.Fatalf("submitted batches %v, want 1, 2 and 3 in order", got)
+	}
+	// the windows follow each other across the restart
+	if !submitted[0].Start.Equal(batchStart) || !submitted[2].Start.Equal(batchStart.Add(2*time.Minute)) ||
+		!submitted[2].End.Equal(batchStart.Add(3*time.Minute)) {
+		t.Errorf("windows %s-%s and %s-%s, want them to follow each other", submitted[0].Start, submitted[0].End, submitted[2].Start, submitted[2].End)
+	}
+	if submitted[1].Traffic[0].Upload != 200 || submitted[1].Traffic[0].RawDownload != 400 {
+		t.Errorf("traffic %+v of batch 2 not kept across the restart", submitted[1].Traffic[0])
+	}
+
+	// the sequence goes on after every batch is acknowledged
+	q = loadQueue(t, path, batchStart.Add(2*time.Hour))
+	if len(q.state.Pending) != 0 {
+		t.Errorf("%d batches pending after they were acknowledged", len(q.state.Pending))
+	}
+	q.add(nil, batchStart.Add(4*time.Minute))
+	if id := q.state.Pending[0].ID; id != 4 {
+		t.Errorf("batch id %d after a restart, want 4", id)
+	}
+}
+
+func TestBatchFileRecovery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "traffic-1.json")
+	q := loadQueue(t, path, batchStart)
+	q.add(testTraffic(1, 100), batchStart.Add(time.Minute))
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary file left after a save: %v", err)
+	}
+
+	// a crash while writing leaves the temporary file only, the last state is read
+	if err := os.WriteFile(path+".tmp", []byte(`{"sequence":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	q = loadQueue(t, path, batchStart.Add(time.Hour))
+	if got := batchIDs(q.state.Pending); !equalIDs(got, 1) {
+		t.Fatalf("pending batches %v beside a half written file, want 1", got)
+	}
+	q.add(nil, batchStart.Add(2*time.Minute))
+	q = loadQueue(t, path, batchStart.Add(time.Hour))
+	if got := batchIDs(q.state.Pending); !equalIDs(got, 1, 2) {
+		t.Errorf("pending batches %v after the half written file was replaced, want 1 and 2", got)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBatchQueue(path, batchStart); err == nil {
+		t.Error("corrupt state loaded")
+	}
+}
+
+func TestBatchSaveFailed(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	q := loadQueue(t, filepath.Join(dir, "traffic-1.json"), batchStart)
+	// the dir of the state can't be created
+	if err := os.WriteFile(dir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	q.add(testTraffic(1, 100), batchStart.Add(time.Minute))
+	if !q.saveFailed {
+		t.Error("failed save not noticed")
+	}
+	var submitted []*TrafficBatch
+	if err := q.flush(collect(&submitted, nil)); err != nil || len(submitted) != 1 {
+		t.Errorf("batches %v, %v kept in memory, want batch 1", batchIDs(submitted), err)
+	}
+}
+
+func TestBatchCap(t *testing.T) {
+	// the batches are added in memory and saved once
+	q := loadQueue(t, "", batchStart)
+	for i := 1; i <= maxPendingBatches+5; i++ {
+		q.add(testTraffic(1, uint64(i)), batchStart.Add(time.Duration(i)*time.Minute))
+	}
+	q.path = filepath.Join(t.TempDir(), "traffic-1.json")
+	q.save()
+	q = loadQueue(t, q.path, batchStart)
+	pending := q.state.Pending
+	if len(pending) != maxPendingBatches || pending[0].ID != 6 || pending[len(pending)-1].ID != maxPendingBatches+5 {
+		t.Fatalf("%d batches from %d to %d kept, want the last %d", len(pending), pending[0].ID, pending[len(pending)-1].ID, maxPendingBatches)
+	}
+	q.add(nil, batchStart.Add(time.Hour*24))
+	if id := q.state.Pending[len(q.state.Pending)-1].ID; id != maxPendingBatches+6 {
+		t.Errorf("batch id %d after the oldest were dropped, want %d", id, maxPendingBatches+6)
+	}
+}
+
+func TestBatchResubmit(t *testing.T) {
+	q := loadQueue(t, "", batchStart)
+	q.add(testTraffic(1, 100), batchStart.Add(time.Minute))
+	q.add(testTraffic(2, 200), batchStart.Add(2*time.Minute))
+
+	// the panel stores batch 1 but its answer is lost
+	var submitted []*TrafficBatch
+	if err := q.flush(collect(&submitted, errors.New("timeout"))); err == nil {
+		t.Fatal("lost answer flushed")
+	}
+	first := *submitted[0]
+	submitted = nil
+	if err := q.flush(collect(&submitted, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := batchIDs(submitted); !equalIDs(got, 1, 2) {
+		t.Fatalf("resubmitted batches %v, want 1 and 2", got)
+	}
+	// the panel drops the retry by its id and window
+	retry := submitted[0]
+	if retry.ID != first.ID || !retry.Start.Equal(first.Start) || !retry.End.Equal(first.End) || retry.Traffic[0] != first.Traffic[0] {
+		t.Errorf("retry %+v differs from the first submit %+v", retry, first)
+	}
+	submitted = nil
+	if err := q.flush(collect(&submitted, nil)); err != nil || len(submitted) != 0 {
+		t.Errorf("acknowledged batches %v submitted again, %v", batchIDs(submitted), err)
+	}
+}
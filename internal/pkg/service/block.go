@@ -0,0 +1,214 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// blockCheckInterval is how often the expired blocks are lifted
+const blockCheckInterval = 5 * time.Second
+
+// Block is a user cut off on this node by the operator, the user is kept out of the inbounds
+// whatever the panel returns until the block expires or is lifted
+type Block struct {
+	UID   int       `json:"user_id"`
+	Since time.Time `json:"since"`
+	// Until is when the block expires, zero for a block kept until it is lifted
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func (b *Block) expired(now time.Time) bool {
+	return !b.Until.IsZero() && !now.Before(b.Until)
+}
+
+// loadBlocks read the blocks kept in the file at path, the expired ones are dropped
+func loadBlocks(path string, now time.Time) (map[int]*Block, error) {
+	blocks := make(map[int]*Block)
+	if path == "" {
+		return blocks, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return blocks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read user blocks failed: %s", err)
+	}
+	var list []*Block
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse user blocks %s failed: %s", path, err)
+	}
+	for _, block := range list {
+		if !block.expired(now) {
+			blocks[block.UID] = block
+		}
+	}
+	if len(blocks) > 0 {
+		log.Infof("%d users blocked from the last run", len(blocks))
+	}
+	return blocks, nil
+}
+
+// saveBlocks write the blocks to the block file, a failure is logged once, it is called with the lock held
+func (b *Builder) saveBlocks() {
+	if b.config.BlockFile == "" {
+		return
+	}
+	data, err := json.Marshal(b.blockList())
+	if err == nil {
+		err = writeFile(b.config.BlockFile, data)
+	}
+	if err != nil && !b.blockSaveFailed {
+		log.Errorf("user blocks not saved, they are lost on restart: %s", err)
+	}
+	b.blockSaveFailed = err != nil
+}
+
+func (b *Builder) blockList() []Block {
+	list := make([]Block, 0, len(b.blocks))
+	for _, block := range b.blocks {
+		list = append(list, *block)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UID < list[j].UID })
+	return list
+}
+
+// unblocked return the users of users which aren't blocked, the ones to keep in the inbounds
+func (b *Builder) unblocked(users []User) []User {
+	if len(b.blocks) == 0 {
+		return users
+	}
+	result := make([]User, 0, len(users))
+	for _, user := range users {
+		if _, ok := b.blocks[user.ID]; !ok {
+			result = append(result, user)
+		}
+	}
+	return result
+}
+
+// findUser return the user uid of the users of the panel
+func (b *Builder) findUser(uid int) (User, bool) {
+	for _, user := range *b.userList {
+		if user.ID == uid {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// SetUserInterrupter close the links of a blocked user email and return how many there were, it must be called before Start
+func (b *Builder) SetUserInterrupter(interrupt func(email string) int) {
+	b.interruptUser = interrupt
+}
+
+// BlockUser cut off the user uid on this node for d, or until it is lifted if d is 0: the user is removed
+// from the inbounds and its links are interrupted. Blocking a blocked user replaces its block.
+func (b *Builder) BlockUser(uid int, d time.Duration, reason string) (*Block, error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.userList == nil {
+		return nil, fmt.Errorf("users not fetched yet")
+	}
+
+	now := time.Now()
+	block := &Block{UID: uid, Since: now, Reason: reason}
+	if d > 0 {
+		block.Until = now.Add(d)
+	}
+	_, blocked := b.blocks[uid]
+	b.blocks[uid] = block
+	b.saveBlocks()
+	if blocked {
+		log.Warnf("block of user %d replaced, until %s", uid, formatUntil(block.Until))
+		return block, nil
+	}
+
+	user, ok := b.findUser(uid)
+	if !ok {
+		log.Warnf("user %d blocked until %s before it is a user of the node", uid, formatUntil(block.Until))
+		return block, nil
+	}
+	email := buildUserEmail(b.userTag(), user.ID, user.UUID)
+	// the user is removed first, so it can't open a new link once its links are interrupted
+	err := b.removeUsers([]string{email})
+	links := 0
+	if b.interruptUser != nil {
+		links = b.interruptUser(email)
+	}
+	if err != nil {
+		return block, fmt.Errorf("user %d blocked but not removed from the inbounds: %s", uid, err)
+	}
+	log.Warnf("user %d blocked until %s, %d links interrupted", uid, formatUntil(block.Until), links)
+	return block, nil
+}
+
+// UnblockUser lift the block of the user uid and add it back if the panel still returns it,
+// it reports whether the user was blocked
+func (b *Builder) UnblockUser(uid int) (bool, error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if _, ok := b.blocks[uid]; !ok {
+		return false, nil
+	}
+	delete(b.blocks, uid)
+	b.saveBlocks()
+	log.Infof("block of user %d lifted", uid)
+	return true, b.restoreUser(uid)
+}
+
+// Blocks return the users blocked on this node
+func (b *Builder) Blocks() []Block {
+	b.access.Lock()
+	defer b.access.Unlock()
+	return b.blockList()
+}
+
+// restoreUser add the user uid back to the inbounds once its block is gone
+func (b *Builder) restoreUser(uid int) error {
+	user, ok := b.findUser(uid)
+	if !ok {
+		return nil
+	}
+	if err := b.addUsers(buildUser(b.userTag(), []User{user})); err != nil {
+		return fmt.Errorf("add unblocked user %d failed: %s", uid, err)
+	}
+	return nil
+}
+
+// expireBlocks lift the blocks which expired
+func (b *Builder) expireBlocks() error {
+	b.access.Lock()
+	defer b.access.Unlock()
+	now := time.Now()
+	expired := 0
+	for uid, block := range b.blocks {
+		if !block.expired(now) {
+			continue
+		}
+		delete(b.blocks, uid)
+		expired++
+		log.Infof("block of user %d expired", uid)
+		if err := b.restoreUser(uid); err != nil {
+			log.Errorln(err)
+		}
+	}
+	if expired > 0 {
+		b.saveBlocks()
+	}
+	return nil
+}
+
+func formatUntil(until time.Time) string {
+	if until.IsZero() {
+		return "lifted"
+	}
+	return until.Format(time.RFC3339)
+}
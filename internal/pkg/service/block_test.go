@@ -0,0 +1,310 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/dispatcher"
+	"github.com/xtls/xray-core/app/proxyman"
+	"github.com/xtls/xray-core/common/buf"
+	xnet "github.com/xtls/xray-core/common/net"
+	cProtocol "github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy/freedom"
+)
+
+var blockUsers = []User{
+	{User: api.User{ID: 1, UUID: testUUID}},
+	{User: api.User{ID: 2, UUID: "5783a3e7-e373-51cd-8642-c83782b807c5"}},
+}
+
+// blockBuilder return a builder of blockUsers in the vmess inbound of a running instance, the blocked users
+// are interrupted by the dispatcher of the instance and the blocks kept in blockFile
+func blockBuilder(t *testing.T, blockFile string) (*Builder, *dispatcher.DefaultDispatcher) {
+	t.Helper()
+	var nodeInfo NodeConfig
+	if err := json.Unmarshal([]byte(fmt.Sprintf(`{"server_port":%d,"network":"tcp"}`, freePort(t))), &nodeInfo); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{BlockFile: blockFile}
+	inboundConfig, err := buildInbound(config, &nodeInfo, "vmess_test", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := core.New(&core.Config{
+		App: []*serial.TypedMessage{
+			serial.ToTypedMessage(&dispatcher.Config{}),
+			serial.ToTypedMessage(&proxyman.InboundConfig{}),
+			serial.ToTypedMessage(&proxyman.OutboundConfig{}),
+		},
+		Inbound:  []*core.InboundHandlerConfig{inboundConfig.InboundHandlerConfig},
+		Outbound: []*core.OutboundHandlerConfig{{ProxySettings: serial.ToTypedMessage(&freedom.Config{})}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = instance.Close() })
+
+	users := append([]User(nil), blockUsers...)
+	blocks, err := loadBlocks(blockFile, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Builder{instance: instance, config: config, inboundTags: []string{"vmess_test"}, userList: &users, blocks: blocks}
+	if err := b.addNewUser(b.unblocked(users)); err != nil {
+		t.Fatal(err)
+	}
+	d := instance.GetFeature(routing.DispatcherType()).(*dispatcher.DefaultDispatcher)
+	b.SetUserInterrupter(d.InterruptUser)
+	return b, d
+}
+
+// inInbound report whether user is in the inbound of b, the user found is removed and added back
+// since the lookup of the vmess inbound adds the users it doesn't find
+func inInbound(t *testing.T, b *Builder, user User) bool {
+	t.Helper()
+	userManager, err := b.getUserManager("vmess_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userManager.RemoveUser(context.Background(), buildUserEmail("vmess_test", user.ID, user.UUID)); err != nil {
+		return false
+	}
+	if err := addUsersTo(userManager, buildUser("vmess_test", []User{user})); err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+// openLink dispatch a link of user to an echo server and wait for the echo, so the link is live
+func openLink(t *testing.T, d *dispatcher.DefaultDispatcher, user User) buf.TimeoutReader {
+	t.Helper()
+	echo := echoServer(t)
+	ctx := session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag:  "vmess_test",
+		User: &cProtocol.MemoryUser{Email: buildUserEmail("vmess_test", user.ID, user.UUID)},
+	})
+	link, err := d.Dispatch(ctx, xnet.TCPDestination(xnet.LocalHostIP, xnet.Port(echo.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := link.Writer.WriteMultiBuffer(buf.MergeBytes(nil, []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	reader := link.Reader.(buf.TimeoutReader)
+	mb, err := reader.ReadMultiBufferTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatalf("no echo through the link: %s", err)
+	}
+	buf.ReleaseMulti(mb)
+	return reader
+}
+
+func savedBlocks(t *testing.T, path string) []Block {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []Block
+	if err := json.Unmarshal(data, &list); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestLoadBlocks(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	write := func(name string, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	list, _ := json.Marshal([]Block{
+		{UID: 1, Since: now.Add(-time.Hour), Until: now.Add(-time.Minute)},
+		{UID: 2, Since: now.Add(-time.Hour), Until: now.Add(time.Hour), Reason: "abuse"},
+		{UID: 3, Since: now.Add(-time.Hour)},
+	})
+	tests := []struct {
+		name string
+		path string
+		uids []int
+		err  bool
+	}{
+		{"no file", "", nil, false},
+		{"missing", filepath.Join(dir, "missing.json"), nil, false},
+		// the expired block is dropped
+		{"blocks", write("blocks.json", string(list)), []int{2, 3}, false},
+		{"invalid", write("invalid.json", "{"), nil, true},
+	}
+	for _, test := range tests {
+		blocks, err := loadBlocks(test.path, now)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v, want error %t", test.name, err, test.err)
+			continue
+		}
+		if len(blocks) != len(test.uids) {
+			t.Errorf("%s: %d blocks, want %v", test.name, len(blocks), test.uids)
+		}
+		for _, uid := range test.uids {
+			if blocks[uid] == nil {
+				t.Errorf("%s: block of user %d not loaded", test.name, uid)
+			}
+		}
+	}
+}
+
+func TestBlockUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.json")
+	b, d := blockBuilder(t, path)
+	blocked, other := blockUsers[0], blockUsers[1]
+	link := openLink(t, d, blocked)
+	otherLink := openLink(t, d, other)
+
+	block, err := b.BlockUser(blocked.ID, time.Hour, "abuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Until.Sub(block.Since) != time.Hour || block.Reason != "abuse" {
+		t.Errorf("block %+v, want one of an hour for abuse", block)
+	}
+	if inInbound(t, b, blocked) {
+		t.Error("blocked user left in the inbound")
+	}
+	if _, err := link.ReadMultiBufferTimeout(5 * time.Second); err == nil {
+		t.Error("link of the blocked user not interrupted")
+	}
+	if !inInbound(t, b, other) {
+		t.Error("other user removed")
+	}
+	if _, err := otherLink.ReadMultiBufferTimeout(100 * time.Millisecond); err != buf.ErrReadTimeout {
+		t.Errorf("link of the other user ended with %v", err)
+	}
+	if list := savedBlocks(t, path); len(list) != 1 || list[0].UID != blocked.ID || !list[0].Until.Equal(block.Until) {
+		t.Errorf("blocks saved %+v, want the block of user %d", list, blocked.ID)
+	}
+
+	// the user stays out whatever the panel returns
+	blocked.UUID = "c9f1e2d4-6a7b-4c3d-8e9f-0a1b2c3d4e5f"
+	if err := b.UpdateUsers([]User{blocked}, nil); err != nil {
+		t.Fatal(err)
+	}
+	b.fetchUsers = func(api.NodeId, api.NodeType) (*[]User, error) {
+		return &[]User{blocked, other}, nil
+	}
+	if err := b.fetchUsersMonitor(); err != nil {
+		t.Fatal(err)
+	}
+	if inInbound(t, b, blocked) {
+		t.Error("blocked user added back by the panel")
+	}
+
+	lifted, err := b.UnblockUser(blocked.ID)
+	if err != nil || !lifted {
+		t.Fatalf("unblock %t, %v", lifted, err)
+	}
+	if !inInbound(t, b, blocked) {
+		t.Error("unblocked user not added back")
+	}
+	if list := savedBlocks(t, path); len(list) != 0 {
+		t.Errorf("blocks saved %+v, want none", list)
+	}
+	if lifted, err := b.UnblockUser(blocked.ID); err != nil || lifted {
+		t.Errorf("unblock of a user not blocked %t, %v", lifted, err)
+	}
+}
+
+func TestBlockPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.json")
+	b, _ := blockBuilder(t, path)
+	if _, err := b.BlockUser(blockUsers[0].ID, 0, "abuse"); err != nil {
+		t.Fatal(err)
+	}
+	// a user not of the node yet is blocked all the same
+	if _, err := b.BlockUser(9, time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the blocks are restored on restart, the user isn't added to the inbound
+	b, _ = blockBuilder(t, path)
+	blocks := b.Blocks()
+	if len(blocks) != 2 || blocks[0].UID != blockUsers[0].ID || !blocks[0].Until.IsZero() || blocks[0].Reason != "abuse" || blocks[1].UID != 9 {
+		t.Errorf("blocks %+v, want the ones of users %d and 9", blocks, blockUsers[0].ID)
+	}
+	if inInbound(t, b, blockUsers[0]) {
+		t.Error("user blocked from the last run added to the inbound")
+	}
+}
+
+func TestBlockSaveFailed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := blockBuilder(t, "")
+	b.config.BlockFile = filepath.Join(file, "blocks.json")
+	if _, err := b.BlockUser(blockUsers[0].ID, time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !b.blockSaveFailed {
+		t.Error("failed save not recorded")
+	}
+	// the block applies though it is lost on restart
+	if len(b.Blocks()) != 1 || inInbound(t, b, blockUsers[0]) {
+		t.Error("block not applied once its save failed")
+	}
+}
+
+func TestExpireBlocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.json")
+	b, _ := blockBuilder(t, path)
+	expiring, kept := blockUsers[0], blockUsers[1]
+	if _, err := b.BlockUser(expiring.ID, time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.BlockUser(kept.ID, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.BlockUser(9, time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.expireBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Blocks()) != 3 {
+		t.Fatalf("blocks %+v expired before their time", b.Blocks())
+	}
+
+	b.blocks[expiring.ID].Until = time.Now().Add(-time.Second)
+	b.blocks[9].Until = time.Now()
+	if err := b.expireBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	if blocks := b.Blocks(); len(blocks) != 1 || blocks[0].UID != kept.ID {
+		t.Errorf("blocks %+v, want the one kept until it is lifted", blocks)
+	}
+	if !inInbound(t, b, expiring) {
+		t.Error("user of the expired block not added back")
+	}
+	if inInbound(t, b, kept) {
+		t.Error("blocked user added back")
+	}
+	if list := savedBlocks(t, path); len(list) != 1 || list[0].UID != kept.ID {
+		t.Errorf("blocks saved %+v, want the one of user %d", list, kept.ID)
+	}
+}
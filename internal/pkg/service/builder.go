@@ -6,12 +6,17 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/connlimit"
+	"github.com/xflash-panda/server-vmess/internal/pkg/dispatcher"
+	"github.com/xflash-panda/server-vmess/internal/pkg/sockopt"
+	"github.com/xtls/xray-core/common"
 	cProtocol "github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/task"
 	"github.com/xtls/xray-core/core"
 	"github.com/xtls/xray-core/features/inbound"
 	"github.com/xtls/xray-core/features/stats"
 	"github.com/xtls/xray-core/proxy"
+	"sync"
 	"time"
 )
 
@@ -20,51 +25,140 @@ type Config struct {
 	ReportTrafficsInterval time.Duration
 	Cert                   *CertConfig
 	NodeID                 int
+	// ProxyProtocol accepts the PROXY protocol on the inbound on server_port, besides the transport settings of the node
+	ProxyProtocol bool
+	Sockopt       *sockopt.Config
+	// ExtraPorts are listened on by the inbound on server_port besides the extra_ports of the node, comma separated
+	ExtraPorts string
+	// TrafficBreakdown reports the traffic of the users by protocol class and network besides their totals
+	TrafficBreakdown bool
+	// BatchFile keeps the sequence of the traffic batches and the ones not reported yet across restarts
+	BatchFile string
+	// BlockFile keeps the users blocked by the operator across restarts
+	BlockFile string
+	// FrontDir holds the unix sockets of the inbounds the node listens for, see front.Config
+	FrontDir string
+	// Decoy fronts the websocket, h2 and grpc inbounds, the front serves the decoy site to the requests which aren't for them
+	Decoy bool
+	// Guard fronts the inbounds of network tcp, ws, h2 and grpc so the banned sources are rejected on accept
+	Guard bool
+}
+
+// User is a user of the node with the fields the panel client doesn't know about, a limit left 0 takes the default of the node
+type User struct {
+	api.User
+	// ConnLimit is the links the user may have at once
+	ConnLimit int `json:"conn_limit,omitempty"`
+	// ConnRate is the new links the user may open a second
+	ConnRate int `json:"conn_rate,omitempty"`
+}
+
+// UserTraffic is the traffic of a user to report, Upload and Download are charged with the traffic multiplier
+// of the node, RawUpload and RawDownload are the bytes relayed
+type UserTraffic struct {
+	api.UserTraffic
+	RawUpload   uint64 `json:"raw_u"`
+	RawDownload uint64 `json:"raw_d"`
+}
+
+// UserBreakdown is the traffic of a user by protocol class and network
+type UserBreakdown struct {
+	UID     int             `json:"user_id"`
+	Traffic []*ClassTraffic `json:"traffic"`
+}
+
+type ClassTraffic struct {
+	Class    string `json:"class"`
+	Network  string `json:"network"`
+	Upload   uint64 `json:"u"`
+	Download uint64 `json:"d"`
 }
 
 type Builder struct {
+	access                        sync.Mutex
 	instance                      *core.Instance
 	config                        *Config
 	nodeInfo                      *api.VMessConfig
-	inboundTag                    string
-	userList                      *[]api.User
-	fetchUsers                    func(api.NodeId, api.NodeType) (*[]api.User, error)
-	reportTraffics                func(api.NodeId, api.NodeType, []*api.UserTraffic) error
+	inboundTags                   []string
+	userList                      *[]User
+	fetchUsers                    func(api.NodeId, api.NodeType) (*[]User, error)
+	reportTraffics                func(api.NodeId, api.NodeType, *TrafficBatch) error
+	reportBreakdown               func(api.NodeId, api.NodeType, []*UserBreakdown) error
+	multiplier                    *Multiplier
+	batches                       *batchQueue
+	blocks                        map[int]*Block
+	blockSaveFailed               bool
+	interruptUser                 func(string) int
+	blockPeriodic                 *task.Periodic
+	connLimiter                   *connlimit.Limiter
 	fetchUsersMonitorPeriodic     *task.Periodic
 	reportTrafficsMonitorPeriodic *task.Periodic
 }
 
-// New return a builder service with default parameters.
-func New(inboundTag string, instance *core.Instance, config *Config, nodeInfo *api.VMessConfig,
-	fetchUsers func(api.NodeId, api.NodeType) (*[]api.User, error), reportTraffics func(api.NodeId, api.NodeType, []*api.UserTraffic) error,
+// New return a builder service with default parameters, the users are added to every inbound of inboundTags
+// with the email of the first one so the traffic of a user is counted once, reportBreakdown is called with
+// the traffic by class when config.TrafficBreakdown is set
+func New(inboundTags []string, instance *core.Instance, config *Config, nodeInfo *api.VMessConfig,
+	fetchUsers func(api.NodeId, api.NodeType) (*[]User, error), reportTraffics func(api.NodeId, api.NodeType, *TrafficBatch) error,
+	reportBreakdown func(api.NodeId, api.NodeType, []*UserBreakdown) error,
 ) *Builder {
 	builder := &Builder{
-		inboundTag:     inboundTag,
-		instance:       instance,
-		config:         config,
-		nodeInfo:       nodeInfo,
-		fetchUsers:     fetchUsers,
-		reportTraffics: reportTraffics,
+		inboundTags:     inboundTags,
+		instance:        instance,
+		config:          config,
+		nodeInfo:        nodeInfo,
+		fetchUsers:      fetchUsers,
+		reportTraffics:  reportTraffics,
+		reportBreakdown: reportBreakdown,
 	}
 	return builder
 }
 
-// addUsers
-func (b *Builder) addUsers(users []*cProtocol.User, tag string) error {
+// getUserManager
+func (b *Builder) getUserManager(tag string) (proxy.UserManager, error) {
 	inboundManager := b.instance.GetFeature(inbound.ManagerType()).(inbound.Manager)
 	handler, err := inboundManager.GetHandler(context.Background(), tag)
 	if err != nil {
-		return fmt.Errorf("no such inbound tag: %s", err)
+		return nil, fmt.Errorf("no such inbound tag: %s", err)
 	}
+	return handlerUserManager(handler)
+}
+
+// handlerUserManager
+func handlerUserManager(handler inbound.Handler) (proxy.UserManager, error) {
 	inboundInstance, ok := handler.(proxy.GetInbound)
 	if !ok {
-		return fmt.Errorf("handler %s is not implement proxy.GetInbound", tag)
+		return nil, fmt.Errorf("handler %s is not implement proxy.GetInbound", handler.Tag())
 	}
 
 	userManager, ok := inboundInstance.GetInbound().(proxy.UserManager)
 	if !ok {
-		return fmt.Errorf("handler %s is not implement proxy.UserManager", err)
+		return nil, fmt.Errorf("handler %s is not implement proxy.UserManager", handler.Tag())
 	}
+	return userManager, nil
+}
+
+// userTag is the inbound tag in the user emails
+func (b *Builder) userTag() string {
+	return b.inboundTags[0]
+}
+
+// addUsers
+func (b *Builder) addUsers(users []*cProtocol.User) error {
+	for _, tag := range b.inboundTags {
+		userManager, err := b.getUserManager(tag)
+		if err != nil {
+			return err
+		}
+		if err := addUsersTo(userManager, users); err != nil {
+			return fmt.Errorf("add users to inbound %s failed: %s", tag, err)
+		}
+	}
+	return nil
+}
+
+// addUsersTo
+func addUsersTo(userManager proxy.UserManager, users []*cProtocol.User) error {
 	for _, item := range users {
 		mUser, err := item.ToMemoryUser()
 		if err != nil {
@@ -79,9 +173,9 @@ func (b *Builder) addUsers(users []*cProtocol.User, tag string) error {
 }
 
 // addNewUser
-func (b *Builder) addNewUser(userInfo []api.User) (err error) {
-	users := buildUser(b.inboundTag, userInfo)
-	err = b.addUsers(users, b.inboundTag)
+func (b *Builder) addNewUser(userInfo []User) (err error) {
+	users := buildUser(b.userTag(), userInfo)
+	err = b.addUsers(users)
 	if err != nil {
 		return err
 	}
@@ -89,22 +183,54 @@ func (b *Builder) addNewUser(userInfo []api.User) (err error) {
 	return nil
 }
 
+// SetMultiplier charge the reported traffic with the compiled multiplier, it must be called before Start
+func (b *Builder) SetMultiplier(multiplier *Multiplier) {
+	b.multiplier = multiplier
+}
+
+// SetConnLimiter keep the limits of the users set by the panel in limiter, it must be called before Start
+func (b *Builder) SetConnLimiter(limiter *connlimit.Limiter) {
+	b.connLimiter = limiter
+}
+
+// updateLimits pass the limits of the users to the conn limiter, it is called with the lock held once the users changed
+func (b *Builder) updateLimits() {
+	if b.connLimiter == nil {
+		return
+	}
+	limits := make(map[string]connlimit.Limits, len(*b.userList))
+	for _, user := range *b.userList {
+		limits[buildUserEmail(b.userTag(), user.ID, user.UUID)] = connlimit.Limits{Links: user.ConnLimit, Rate: user.ConnRate}
+	}
+	b.connLimiter.SetLimits(limits)
+}
+
 // Start implement the Start() function of the service interface
 func (b *Builder) Start() error {
 	log.Debugf("nodeinfo: %+v", b.nodeInfo)
 
+	batches, err := loadBatchQueue(b.config.BatchFile, time.Now())
+	if err != nil {
+		return err
+	}
+	b.batches = batches
+	b.blocks, err = loadBlocks(b.config.BlockFile, time.Now())
+	if err != nil {
+		return err
+	}
 	// Update user
 	userList, err := b.fetchUsers(api.NodeId(b.config.NodeID), api.VMess)
 	if err != nil {
 		return err
 	}
 
-	err = b.addNewUser(*userList)
+	err = b.addNewUser(b.unblocked(*userList))
 	if err != nil {
 		return err
 	}
 
 	b.userList = userList
+	b.updateLimits()
 	b.fetchUsersMonitorPeriodic = &task.Periodic{
 		Interval: b.config.FetchUsersInterval,
 		Execute:  b.fetchUsersMonitor,
@@ -124,6 +250,13 @@ func (b *Builder) Start() error {
 	if err != nil {
 		return fmt.Errorf("report users periodic, start erorr:%s", err)
 	}
+	b.blockPeriodic = &task.Periodic{
+		Interval: blockCheckInterval,
+		Execute:  b.expireBlocks,
+	}
+	if err := b.blockPeriodic.Start(); err != nil {
+		return fmt.Errorf("user blocks periodic, start error: %s", err)
+	}
 	return nil
 }
 
@@ -142,6 +275,17 @@ func (b *Builder) Close() error {
 			return fmt.Errorf("report traffics periodic close failed: %s", err)
 		}
 	}
+	if b.blockPeriodic != nil {
+		if err := b.blockPeriodic.Close(); err != nil {
+			return fmt.Errorf("user blocks periodic close failed: %s", err)
+		}
+	}
+	// the traffic since the last report is kept for the next run
+	if b.batches != nil {
+		if userTraffic, _ := b.collectTraffic(time.Now()); len(userTraffic) > 0 {
+			b.batches.add(userTraffic, time.Now())
+		}
+	}
 	return nil
 }
 
@@ -172,32 +316,51 @@ func (b *Builder) getTraffic(email string) (up int64, down int64, count int64) {
 }
 
 // removeUsers
-func (b *Builder) removeUsers(users []string, tag string) error {
-	inboundManager := b.instance.GetFeature(inbound.ManagerType()).(inbound.Manager)
-	handler, err := inboundManager.GetHandler(context.Background(), tag)
+func (b *Builder) removeUsers(users []string) error {
+	for _, tag := range b.inboundTags {
+		userManager, err := b.getUserManager(tag)
+		if err != nil {
+			return err
+		}
+		for _, email := range users {
+			err = userManager.RemoveUser(context.Background(), email)
+			if err != nil {
+				return fmt.Errorf("remove user from inbound %s failed: %s", tag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ReplaceInbound swap the running inbound of the same tag for handler, the current users are added to it first.
+// An inbound missing after a failed swap is added again.
+func (b *Builder) ReplaceInbound(handler inbound.Handler) error {
+	b.access.Lock()
+	defer b.access.Unlock()
+
+	userManager, err := handlerUserManager(handler)
 	if err != nil {
-		return fmt.Errorf("no such inbound tag: %s", err)
+		return err
 	}
-	inboundInstance, ok := handler.(proxy.GetInbound)
-	if !ok {
-		return fmt.Errorf("handler %s is not implement proxy.GetInbound", tag)
+	if err := addUsersTo(userManager, buildUser(b.userTag(), b.unblocked(*b.userList))); err != nil {
+		return err
 	}
-
-	userManager, ok := inboundInstance.GetInbound().(proxy.UserManager)
-	if !ok {
-		return fmt.Errorf("handler %s is not implement proxy.UserManager", err)
+	inboundManager := b.instance.GetFeature(inbound.ManagerType()).(inbound.Manager)
+	if err := inboundManager.RemoveHandler(context.Background(), handler.Tag()); err != nil && !errors.Is(err, common.ErrNoClue) {
+		return fmt.Errorf("remove inbound %s failed: %s", handler.Tag(), err)
 	}
-	for _, email := range users {
-		err = userManager.RemoveUser(context.Background(), email)
-		if err != nil {
-			return err
-		}
+	if err := inboundManager.AddHandler(context.Background(), handler); err != nil {
+		return fmt.Errorf("add inbound %s failed: %s", handler.Tag(), err)
 	}
+	log.Infof("inbound %s replaced with %d users", handler.Tag(), len(*b.userList))
 	return nil
 }
 
 // nodeInfoMonitor
 func (b *Builder) fetchUsersMonitor() (err error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+
 	// Update User
 	newUserList, err := b.fetchUsers(api.NodeId(b.config.NodeID), api.VMess)
 	if err != nil {
@@ -210,12 +373,14 @@ func (b *Builder) fetchUsersMonitor() (err error) {
 	}
 
 	deleted, added := b.compareUserList(newUserList)
+	// the blocked users are out of the inbounds whatever the panel returns
+	deleted, added = b.unblocked(deleted), b.unblocked(added)
 	if len(deleted) > 0 {
 		deletedEmail := make([]string, len(deleted))
 		for i, u := range deleted {
-			deletedEmail[i] = buildUserEmail(b.inboundTag, u.ID, u.UUID)
+			deletedEmail[i] = buildUserEmail(b.userTag(), u.ID, u.UUID)
 		}
-		err := b.removeUsers(deletedEmail, b.inboundTag)
+		err := b.removeUsers(deletedEmail)
 		if err != nil {
 			log.Errorln(err)
 			return nil
@@ -232,61 +397,193 @@ func (b *Builder) fetchUsersMonitor() (err error) {
 	log.Infof("%d user deleted, %d user added", len(deleted), len(added))
 
 	b.userList = newUserList
+	b.updateLimits()
 	return nil
 }
 
-// userInfoMonitor
-func (b *Builder) reportTrafficsMonitor() (err error) {
-	// Get User traffic
-	userTraffic := make([]*api.UserTraffic, 0)
+// UpdateUsers apply the changes pushed by the panel right away, a user of upserted is added, replaced with
+// another uuid or else updated with its limits, and the users of removedIDs are removed. The polling reconciles what is missed.
+func (b *Builder) UpdateUsers(upserted []User, removedIDs []int) error {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.userList == nil {
+		return fmt.Errorf("users not fetched yet")
+	}
+
+	current := make(map[int]User, len(*b.userList))
 	for _, user := range *b.userList {
-		email := buildUserEmail(b.inboundTag, user.ID, user.UUID)
-		up, down, count := b.getTraffic(email)
-		if up > 0 || down > 0 || count > 0 {
-			userTraffic = append(userTraffic, &api.UserTraffic{
-				UID:      user.ID,
-				Upload:   uint64(up),
-				Download: uint64(down),
-				Count:    uint64(count),
-			})
+		current[user.ID] = user
+	}
+	var deleted, added []User
+	updated := 0
+	for _, id := range removedIDs {
+		if user, ok := current[id]; ok {
+			deleted = append(deleted, user)
+			delete(current, id)
+		}
+	}
+	// a user upserted more than once takes its last change
+	last := make(map[int]int, len(upserted))
+	for i, user := range upserted {
+		last[user.ID] = i
+	}
+	for i, user := range upserted {
+		if last[user.ID] != i {
+			continue
+		}
+		if old, ok := current[user.ID]; ok {
+			if old.UUID == user.UUID {
+				// the user stays in the inbounds, its limits are applied by updateLimits
+				current[user.ID] = user
+				updated++
+				continue
+			}
+			deleted = append(deleted, old)
+		}
+		added = append(added, user)
+		current[user.ID] = user
+	}
+
+	if removed := b.unblocked(deleted); len(removed) > 0 {
+		deletedEmail := make([]string, len(removed))
+		for i, u := range removed {
+			deletedEmail[i] = buildUserEmail(b.userTag(), u.ID, u.UUID)
+		}
+		if err := b.removeUsers(deletedEmail); err != nil {
+			return err
+		}
+	}
+	if inserted := b.unblocked(added); len(inserted) > 0 {
+		if err := b.addNewUser(inserted); err != nil {
+			return err
+		}
+	}
+
+	userList := make([]User, 0, len(current))
+	for _, user := range *b.userList {
+		if u, ok := current[user.ID]; ok {
+			userList = append(userList, u)
+			delete(current, user.ID)
 		}
 	}
+	for _, user := range added {
+		if _, ok := current[user.ID]; ok {
+			userList = append(userList, user)
+		}
+	}
+	b.userList = &userList
+	b.updateLimits()
+	log.Infof("%d user deleted, %d user added, %d user updated by push", len(deleted), len(added), updated)
+	return nil
+}
+
+// userInfoMonitor
+func (b *Builder) reportTrafficsMonitor() (err error) {
+	now := time.Now()
+	userTraffic, breakdown := b.collectTraffic(now)
 	log.Infof("%d user traffic needs to be reported", len(userTraffic))
 	if len(userTraffic) > 0 {
-		err = b.reportTraffics(api.NodeId(b.config.NodeID), api.VMess, userTraffic)
-		if err != nil {
-			log.Errorln(err)
+		b.batches.add(userTraffic, now)
+	}
+	err = b.batches.flush(func(batch *TrafficBatch) error {
+		return b.reportTraffics(api.NodeId(b.config.NodeID), api.VMess, batch)
+	})
+	if err != nil {
+		log.Errorln(err)
+	}
+	if b.config.TrafficBreakdown && b.reportBreakdown != nil && len(breakdown) > 0 {
+		if err := b.reportBreakdown(api.NodeId(b.config.NodeID), api.VMess, breakdown); err != nil {
+			log.Errorf("report traffic breakdown failed: %s", err)
 		}
 	}
 
 	return nil
 }
 
-// compareUserList
-func (b *Builder) compareUserList(newUsers *[]api.User) (deleted, added []api.User) {
+// collectTraffic take the traffic of the users since the last call, charged at now
+func (b *Builder) collectTraffic(now time.Time) ([]*UserTraffic, []*UserBreakdown) {
+	b.access.Lock()
+	userList := *b.userList
+	b.access.Unlock()
+
+	byClass := b.config.TrafficBreakdown || b.multiplier.ByProtocol()
+	userTraffic := make([]*UserTraffic, 0)
+	breakdown := make([]*UserBreakdown, 0)
+	for _, user := range userList {
+		email := buildUserEmail(b.userTag(), user.ID, user.UUID)
+		up, down, count := b.getTraffic(email)
+		var classTraffic []*ClassTraffic
+		if byClass {
+			classTraffic = b.getBreakdown(email)
+		}
+		if up > 0 || down > 0 || count > 0 {
+			upload, download := b.multiplier.Charge(now, uint64(up), uint64(down), classTraffic)
+			userTraffic = append(userTraffic, &UserTraffic{
+				UserTraffic: api.UserTraffic{
+					UID:      user.ID,
+					Upload:   upload,
+					Download: download,
+					Count:    uint64(count),
+				},
+				RawUpload:   uint64(up),
+				RawDownload: uint64(down),
+			})
+		}
+		if len(classTraffic) > 0 {
+			breakdown = append(breakdown, &UserBreakdown{UID: user.ID, Traffic: classTraffic})
+		}
+	}
+	return userTraffic, breakdown
+}
+
+// getBreakdown return the traffic of the user by class and network since the last report
+func (b *Builder) getBreakdown(email string) []*ClassTraffic {
+	statsManager := b.instance.GetFeature(stats.ManagerType()).(stats.Manager)
+	take := func(name string) uint64 {
+		counter := statsManager.GetCounter(name)
+		if counter == nil {
+			return 0
+		}
+		return uint64(counter.Set(0))
+	}
+	var traffic []*ClassTraffic
+	for _, class := range dispatcher.Classes {
+		for _, network := range dispatcher.Networks {
+			up := take(dispatcher.BreakdownCounterName(email, class, network, "uplink"))
+			down := take(dispatcher.BreakdownCounterName(email, class, network, "downlink"))
+			if up > 0 || down > 0 {
+				traffic = append(traffic, &ClassTraffic{Class: class, Network: network, Upload: up, Download: down})
+			}
+		}
+	}
+	return traffic
+}
+
+// compareUserList compare the users by id and uuid, the ones in the inbounds, a change of their limits only is applied by updateLimits
+func (b *Builder) compareUserList(newUsers *[]User) (deleted, added []User) {
 	// 使用map来标记旧用户列表中的每个用户
-	userMap := make(map[api.User]bool)
+	userMap := make(map[api.User]*User)
 
 	// 标记旧用户列表中所有用户为已删除（暂时）
-	for _, user := range *b.userList {
-		userMap[user] = true
+	for i, user := range *b.userList {
+		userMap[user.User] = &(*b.userList)[i]
 	}
 
 	// 遍历新用户列表
 	for _, newUser := range *newUsers {
-		if userMap[newUser] {
+		if _, ok := userMap[newUser.User]; ok {
 			// 如果当前用户在旧列表中，标记为未删除（即用户仍在列表中）
-			userMap[newUser] = false
+			userMap[newUser.User] = nil
 		} else {
 			// 如果用户不在旧列表中，那么它是一个新增用户
 			added = append(added, newUser)
 		}
 	}
 
-	// 任何在userMap中仍标记为true的用户都是被删除的
-	for user, isDeleted := range userMap {
-		if isDeleted {
-			deleted = append(deleted, user)
+	// 任何在userMap中仍不为nil的用户都是被删除的
+	for _, user := range userMap {
+		if user != nil {
+			deleted = append(deleted, *user)
 		}
 	}
 
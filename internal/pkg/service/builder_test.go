@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/connlimit"
+	"github.com/xtls/xray-core/app/stats"
+)
+
+// limitedBuilder return a builder of users with the limiter of the default limits, the users stay in the
+// inbounds so none is needed
+func limitedBuilder(t *testing.T, users []User, defaults *connlimit.Config) (*Builder, *connlimit.Limiter) {
+	t.Helper()
+	manager, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := connlimit.New(defaults, manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Builder{config: &Config{}, inboundTags: []string{"vmess_test"}, userList: &users}
+	b.SetConnLimiter(limiter)
+	b.updateLimits()
+	return b, limiter
+}
+
+// links open links of the user till one is refused and return how many were accepted, up to 100
+func links(l *connlimit.Limiter, b *Builder, user User) int {
+	email := buildUserEmail(b.userTag(), user.ID, user.UUID)
+	n := 0
+	for ; n < 100; n++ {
+		if _, err := l.Acquire(email); err != nil {
+			break
+		}
+	}
+	return n
+}
+
+func TestUpdateLimitsFetched(t *testing.T) {
+	user := User{User: api.User{ID: 1, UUID: "uuid-1"}, ConnLimit: 2}
+	b, limiter := limitedBuilder(t, []User{user}, &connlimit.Config{Links: 5})
+	if n := links(limiter, b, user); n != 2 {
+		t.Fatalf("%d links accepted, want the 2 of the panel", n)
+	}
+
+	// the limits of the users fetched apply though the users stay the same in the inbounds
+	user.ConnLimit = 4
+	b.fetchUsers = func(api.NodeId, api.NodeType) (*[]User, error) {
+		return &[]User{user}, nil
+	}
+	if err := b.fetchUsersMonitor(); err != nil {
+		t.Fatal(err)
+	}
+	if n := links(limiter, b, user); n != 2 {
+		t.Errorf("%d more links accepted, want 2 up to the 4 of the panel", n)
+	}
+
+	// a limit removed by the panel takes the default
+	user.ConnLimit = 0
+	if err := b.fetchUsersMonitor(); err != nil {
+		t.Fatal(err)
+	}
+	if n := links(limiter, b, user); n != 1 {
+		t.Errorf("%d more links accepted, want 1 up to the 5 of the default", n)
+	}
+}
+
+func TestUpdateLimitsPushed(t *testing.T) {
+	user := User{User: api.User{ID: 1, UUID: "uuid-1"}, ConnLimit: 1}
+	other := User{User: api.User{ID: 2, UUID: "uuid-2"}, ConnLimit: 1}
+	b, limiter := limitedBuilder(t, []User{user, other}, &connlimit.Config{})
+	if n := links(limiter, b, user); n != 1 {
+		t.Fatalf("%d links accepted, want the 1 of the panel", n)
+	}
+
+	user.ConnLimit = 3
+	if err := b.UpdateUsers([]User{user}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := links(limiter, b, user); n != 2 {
+		t.Errorf("%d more links accepted, want 2 up to the 3 pushed", n)
+	}
+	// the limit of the user not pushed is kept
+	if n := links(limiter, b, other); n != 1 {
+		t.Errorf("%d links of the other user accepted, want the 1 of the panel", n)
+	}
+}
+
+func TestUpdateUsersDuplicate(t *testing.T) {
+	b, _ := blockBuilder(t, "")
+	const newUUID = "c9f1e2d4-6a7b-4c3d-8e9f-0a1b2c3d4e5f"
+	kept := blockUsers[0]
+	changed := kept
+	changed.UUID = newUUID
+	added := User{User: api.User{ID: 3, UUID: testUUID}}
+	replaced := added
+	replaced.UUID = newUUID
+	replaced.ConnLimit = 2
+
+	// the last change of a user wins
+	if err := b.UpdateUsers([]User{changed, kept, added, replaced}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !inInbound(t, b, kept) || inInbound(t, b, changed) {
+		t.Error("user changed back not kept with its uuid")
+	}
+	if !inInbound(t, b, replaced) || inInbound(t, b, added) {
+		t.Error("user added twice not added with its last uuid")
+	}
+	if len(*b.userList) != 3 {
+		t.Fatalf("users %+v, want each user once", *b.userList)
+	}
+	if user, ok := b.findUser(3); !ok || user != replaced {
+		t.Errorf("user %+v, want %+v", user, replaced)
+	}
+}
@@ -4,23 +4,161 @@ package service
 import (
 	"encoding/json"
 	"fmt"
-	api "github.com/xflash-panda/server-client/pkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-vmess/internal/pkg/front"
+	"github.com/xtls/xray-core/common/net"
 	"github.com/xtls/xray-core/core"
 	"github.com/xtls/xray-core/infra/conf"
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+	"github.com/xtls/xray-core/transport/internet/websocket"
+	"net/url"
+	"strings"
 	"unsafe"
 )
 
-// InboundBuilder build Inbound config for different protocol
-func InboundBuilder(config *Config, nodeInfo *api.VMessConfig) (*core.InboundHandlerConfig, error) {
-	inboundDetourConfig := &conf.InboundDetourConfig{}
+// Inbound is one of the inbounds of the node
+type Inbound struct {
+	*core.InboundHandlerConfig
+	Security      string
+	ProxyProtocol bool
+	// Front is set when the node listens on the ports of the inbound, which listens on Front.Backend then
+	Front *front.Config
+}
 
-	// Build Port
+// InboundBuilder build the inbounds of the node, the one on server_port first and then the transports,
+// they all share the users of the node
+func InboundBuilder(config *Config, nodeInfo *NodeConfig) ([]*Inbound, error) {
+	extraPorts, err := parsePorts(config.ExtraPorts)
+	if err != nil {
+		return nil, err
+	}
+	inbound, err := buildInbound(config, nodeInfo, fmt.Sprintf("%s_%d", protocol, nodeInfo.ServerPort),
+		ProxyProtocol(config, nodeInfo), extraPorts)
+	if err != nil {
+		return nil, err
+	}
+	inbounds := []*Inbound{inbound}
+	tags := map[string]bool{inbound.Tag: true}
+	claims := []*portClaim{newPortClaim(nodeInfo, extraPorts, "the inbound on server_port")}
+	for i, transport := range nodeInfo.Transports {
+		tag := fmt.Sprintf("%s_%d_%s", protocol, transport.ServerPort, transport.Network)
+		if tags[tag] {
+			return nil, fmt.Errorf("transport %d: another inbound has network %s on port %d", i+1, transport.Network, transport.ServerPort)
+		}
+		tags[tag] = true
+		claim := newPortClaim(transport, nil, fmt.Sprintf("transport %d", i+1))
+		for _, other := range claims {
+			if port, ok := claim.collides(other); ok {
+				return nil, fmt.Errorf("transport %d: %s already listens on %s port %d", i+1, other.owner, claim.layer, port)
+			}
+		}
+		claims = append(claims, claim)
+		// the proxy protocol flag is for the inbound on server_port, a transport behind a load balancer sets it in its settings
+		inbound, err := buildInbound(config, transport, tag, transport.acceptsProxyProtocol(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("transport %d: %s", i+1, err)
+		}
+		inbounds = append(inbounds, inbound)
+	}
+	return inbounds, nil
+}
+
+// PortOwner return the inbound which listens on the tcp port itself or with its front, the inbound on server_port
+// with the extra ports of config or a transport, empty if none does
+func PortOwner(config *Config, nodeInfo *NodeConfig, port int) (string, error) {
+	extraPorts, err := parsePorts(config.ExtraPorts)
+	if err != nil {
+		return "", err
+	}
+	claims := []*portClaim{newPortClaim(nodeInfo, extraPorts, "the inbound on server_port")}
+	for i, transport := range nodeInfo.Transports {
+		claims = append(claims, newPortClaim(transport, nil, fmt.Sprintf("transport %d", i+1)))
+	}
+	probe := &portClaim{layer: "tcp", ranges: []conf.PortRange{{From: uint32(port), To: uint32(port)}}}
+	for _, claim := range claims {
+		if _, ok := probe.collides(claim); ok {
+			return claim.owner, nil
+		}
+	}
+	return "", nil
+}
+
+// portClaim is the ports an inbound listens on
+type portClaim struct {
+	owner string
+	// layer is tcp or udp, the inbounds of different layers may share a port, it's empty for a domain socket
+	layer  string
+	ranges []conf.PortRange
+}
+
+func newPortClaim(nodeInfo *NodeConfig, extraPorts *conf.PortList, owner string) *portClaim {
+	claim := &portClaim{owner: owner, layer: "tcp", ranges: inboundPorts(nodeInfo, extraPorts).Range}
+	if networkType, err := conf.TransportProtocol(nodeInfo.Network).Build(); err == nil {
+		switch networkType {
+		case KCP, QUIC:
+			claim.layer = "udp"
+		case DS:
+			claim.layer = ""
+		}
+	}
+	return claim
+}
+
+// collides return the first port both claims listen on
+func (c *portClaim) collides(other *portClaim) (uint32, bool) {
+	if c.layer == "" || c.layer != other.layer {
+		return 0, false
+	}
+	for _, r := range c.ranges {
+		for _, o := range other.ranges {
+			if r.From <= o.To && o.From <= r.To {
+				if r.From > o.From {
+					return r.From, true
+				}
+				return o.From, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// inboundPorts return server_port and the extra ports of nodeInfo with extraPorts
+func inboundPorts(nodeInfo *NodeConfig, extraPorts *conf.PortList) *conf.PortList {
 	portList := &conf.PortList{
 		Range: []conf.PortRange{{From: uint32(nodeInfo.ServerPort), To: uint32(nodeInfo.ServerPort)}},
 	}
-	inboundDetourConfig.PortList = portList
+	for _, ports := range []*conf.PortList{nodeInfo.ExtraPorts, extraPorts} {
+		if ports != nil {
+			portList.Range = append(portList.Range, ports.Range...)
+		}
+	}
+	return portList
+}
+
+// parsePorts parse a port, a range like 20000-20100 or a comma separated list of both
+func parsePorts(ports string) (*conf.PortList, error) {
+	if ports == "" {
+		return nil, nil
+	}
+	portList := &conf.PortList{}
+	data, _ := json.Marshal(ports)
+	if err := portList.UnmarshalJSON(data); err != nil {
+		return nil, fmt.Errorf("invalid extra ports %s: %s", ports, err)
+	}
+	return portList, nil
+}
+
+// buildInbound build the inbound config of nodeInfo
+func buildInbound(config *Config, nodeInfo *NodeConfig, tag string, proxyProtocol bool, extraPorts *conf.PortList) (*Inbound, error) {
+	inboundDetourConfig := &conf.InboundDetourConfig{}
+
+	// Build Port
+	inboundDetourConfig.PortList = inboundPorts(nodeInfo, extraPorts)
+	if config.Sockopt != nil && config.Sockopt.Listen != "" {
+		inboundDetourConfig.ListenOn = &conf.Address{Address: net.ParseAddress(config.Sockopt.Listen)}
+	}
 	// Build Tag
-	inboundDetourConfig.Tag = fmt.Sprintf("%s_%d", protocol, nodeInfo.ServerPort)
+	inboundDetourConfig.Tag = tag
 	// SniffingConfig
 	sniffingConfig := &conf.SniffingConfig{
 		Enabled:      true,
@@ -47,6 +185,9 @@ func InboundBuilder(config *Config, nodeInfo *api.VMessConfig) (*core.InboundHan
 	if err != nil {
 		return nil, fmt.Errorf("convert TransportProtocol failed: %s", err)
 	}
+	if err := validateTransport(networkType, nodeInfo.Security(), nodeInfo); err != nil {
+		return nil, err
+	}
 	if networkType == TCP {
 		if nodeInfo.TcpConfig != nil {
 			streamSetting.TCPSettings = (*conf.TCPConfig)(nodeInfo.TcpConfig)
@@ -71,32 +212,179 @@ func InboundBuilder(config *Config, nodeInfo *api.VMessConfig) (*core.InboundHan
 		} else {
 			streamSetting.HTTPSettings = &conf.HTTPConfig{}
 		}
+	} else if networkType == KCP {
+		if nodeInfo.KcpConfig != nil {
+			streamSetting.KCPSettings = nodeInfo.KcpConfig
+		} else {
+			streamSetting.KCPSettings = &conf.KCPConfig{}
+		}
+	} else if networkType == QUIC {
+		if nodeInfo.QuicConfig != nil {
+			streamSetting.QUICSettings = nodeInfo.QuicConfig
+		} else {
+			streamSetting.QUICSettings = &conf.QUICConfig{}
+		}
+	} else if networkType == DS {
+		streamSetting.DSSettings = nodeInfo.DomainSocketConfig
+	}
+
+	if proxyProtocol && networkType != TCP && networkType != WS {
+		return nil, fmt.Errorf("proxy protocol works with network tcp and ws only, not %s", nodeInfo.Network)
 	}
 
+	if config.Sockopt != nil {
+		streamSetting.SocketSettings = config.Sockopt.Inbound()
+	}
 	streamSetting.Network = &transportProtocol
 	// Build TLS
-	if nodeInfo.TLS > 0 {
-		streamSetting.Security = TLS
-		certFile, keyFile, err := getCertFile(config.Cert)
-		if err != nil {
-			return nil, err
-		}
-
+	decoy := config.Decoy && (networkType == WS || networkType == H2 || networkType == GRPC)
+	guard := config.Guard && (networkType == TCP || networkType == WS || networkType == H2 || networkType == GRPC)
+	if config.Guard && !guard {
+		log.Warnf("inbound %s: the banned sources aren't rejected on network %s, only their failures are counted", tag, nodeInfo.Network)
+	}
+	var frontTLS *xtls.Config
+	if nodeInfo.Security() == REALITY {
+		streamSetting.Security = REALITY
+		// a copy, xray fills in the type of the dest while building
+		realitySettings := *nodeInfo.RealityConfig
+		streamSetting.REALITYSettings = &realitySettings
+	} else if nodeInfo.Security() == TLS {
 		var tlsSettings *conf.TLSConfig
 		if nodeInfo.TlsConfig == nil {
 			tlsSettings = &conf.TLSConfig{}
 		} else {
-			tlsSettings = (*conf.TLSConfig)(unsafe.Pointer(nodeInfo.TlsConfig))
+			// a copy, the inbound is rebuilt when the certificate changes and the node config must stay as fetched
+			tlsConfig := *(*conf.TLSConfig)(unsafe.Pointer(nodeInfo.TlsConfig))
+			tlsSettings = &tlsConfig
+		}
+		if decoy {
+			// the front reads the requests to pass the ones which aren't for the inbound to the decoy site,
+			// it hands out the certificate of the node itself
+			built, err := tlsSettings.Build()
+			if err != nil {
+				return nil, fmt.Errorf("build tls settings failed: %s", err)
+			}
+			frontTLS = built.(*xtls.Config)
+		} else {
+			streamSetting.Security = TLS
+			certConfig, err := buildCertConfig(config.Cert)
+			if err != nil {
+				return nil, err
+			}
+			tlsSettings.Certs = append(append([]*conf.TLSCertConfig{}, tlsSettings.Certs...), certConfig)
+			streamSetting.TLSSettings = tlsSettings
 		}
+	}
 
-		tlsSettings.Certs = append(tlsSettings.Certs, &conf.TLSCertConfig{CertFile: certFile, KeyFile: keyFile, OcspStapling: 3600})
-		streamSetting.TLSSettings = tlsSettings
+	var frontConfig *front.Config
+	if proxyProtocol || decoy || guard {
+		if frontConfig, err = buildFront(config, tag, inboundDetourConfig.PortList, streamSetting.SocketSettings); err != nil {
+			return nil, err
+		}
+		frontConfig.Network = networkType
+		frontConfig.ProxyProtocol = proxyProtocol
+		frontConfig.TLS = frontTLS
+		if decoy {
+			frontConfig.Decoy = true
+			if frontConfig.Paths, frontConfig.Hosts, err = decoyRoute(networkType, streamSetting); err != nil {
+				return nil, err
+			}
+		}
+		// the front passes the client address on in a PROXY protocol header of its own
+		inboundDetourConfig.ListenOn = &conf.Address{Address: net.DomainAddress(frontConfig.Backend)}
+		streamSetting.SocketSettings = &conf.SocketConfig{AcceptProxyProtocol: true}
 	}
 
 	inboundDetourConfig.Protocol = protocol
 	inboundDetourConfig.StreamSetting = streamSetting
 	inboundDetourConfig.Settings = &setting
-	return inboundDetourConfig.Build()
+	pbInboundConfig, err := inboundDetourConfig.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &Inbound{InboundHandlerConfig: pbInboundConfig, Security: nodeInfo.Security(), ProxyProtocol: proxyProtocol, Front: frontConfig}, nil
+}
+
+// buildFront build the front listening on ports with the socket options of the inbound tagged tag
+func buildFront(config *Config, tag string, ports *conf.PortList, sockopt *conf.SocketConfig) (*front.Config, error) {
+	if config.FrontDir == "" {
+		return nil, fmt.Errorf("inbound %s needs a front but no front dir is set", tag)
+	}
+	frontConfig := &front.Config{Tag: tag, Ports: ports.Build(), Backend: front.Backend(config.FrontDir, tag)}
+	if config.Sockopt != nil && config.Sockopt.Listen != "" {
+		frontConfig.Listen = net.ParseAddress(config.Sockopt.Listen)
+	}
+	if sockopt != nil {
+		var err error
+		if frontConfig.Sockopt, err = sockopt.Build(); err != nil {
+			return nil, fmt.Errorf("build socket options failed: %s", err)
+		}
+	}
+	return frontConfig, nil
+}
+
+// decoyRoute return the paths and the hosts of the requests for the inbound as xray compares them: the path of
+// the websocket upgrades, the prefix of the h2 requests with their hosts or the methods of the grpc service
+func decoyRoute(networkType string, streamSetting *conf.StreamConfig) ([]string, []string, error) {
+	switch networkType {
+	case WS:
+		built, err := streamSetting.WSSettings.Build()
+		if err != nil {
+			return nil, nil, fmt.Errorf("build websocket settings failed: %s", err)
+		}
+		return []string{built.(*websocket.Config).GetNormalizedPath()}, nil, nil
+	case GRPC:
+		return grpcMethods(streamSetting.GRPCConfig.ServiceName), nil, nil
+	}
+	hosts := []string{"www.example.com"}
+	if settings := streamSetting.HTTPSettings; settings.Host != nil && len(*settings.Host) > 0 {
+		hosts = *settings.Host
+	}
+	path := streamSetting.HTTPSettings.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return []string{path}, hosts, nil
+}
+
+// grpcMethods return the paths of the Tun and TunMulti methods of the grpc service, a service name starting with /
+// is a custom path like /service/tun|tunMulti
+func grpcMethods(serviceName string) []string {
+	if !strings.HasPrefix(serviceName, "/") {
+		name := url.PathEscape(serviceName)
+		return []string{"/" + name + "/Tun", "/" + name + "/TunMulti"}
+	}
+	last := strings.LastIndex(serviceName, "/")
+	if last < 1 {
+		last = 1
+	}
+	parts := strings.Split(serviceName[1:last], "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	name := strings.Join(parts, "/")
+	streams := strings.Split(serviceName[strings.LastIndex(serviceName, "/")+1:], "|")
+	tunMulti := streams[0]
+	if len(streams) > 1 {
+		tunMulti = streams[1]
+	}
+	return []string{"/" + name + "/" + url.PathEscape(streams[0]), "/" + name + "/" + url.PathEscape(tunMulti)}
+}
+
+// buildCertConfig
+func buildCertConfig(certConfig *CertConfig) (*conf.TLSCertConfig, error) {
+	if len(certConfig.CertPEM) > 0 && len(certConfig.KeyPEM) > 0 {
+		return &conf.TLSCertConfig{
+			CertStr:      strings.Split(string(certConfig.CertPEM), "\n"),
+			KeyStr:       strings.Split(string(certConfig.KeyPEM), "\n"),
+			OcspStapling: 3600,
+		}, nil
+	}
+	certFile, keyFile, err := getCertFile(certConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &conf.TLSCertConfig{CertFile: certFile, KeyFile: keyFile, OcspStapling: 3600}, nil
 }
 
 // getCertFile
@@ -0,0 +1,415 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/cert"
+	_ "github.com/xflash-panda/server-vmess/internal/pkg/dep"
+	"github.com/xflash-panda/server-vmess/internal/pkg/dispatcher"
+	"github.com/xflash-panda/server-vmess/internal/pkg/front"
+	"github.com/xflash-panda/server-vmess/internal/pkg/reputation"
+	"github.com/xtls/xray-core/app/proxyman"
+	xlog "github.com/xtls/xray-core/common/log"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/inbound"
+	confserial "github.com/xtls/xray-core/infra/conf/serial"
+	"github.com/xtls/xray-core/proxy/freedom"
+	"golang.org/x/net/http2"
+)
+
+const testUUID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+var testSite = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+	_, _ = io.WriteString(writer, "site")
+})
+
+// testPair return a self signed certificate for node.test
+func testPair(t *testing.T) *cert.Pair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "node.test"},
+		DNSNames:     []string{"node.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := cert.ParsePair(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// echoServer return the address of a tcp server echoing what it reads
+func echoServer(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr)
+}
+
+// startNode run the inbound of the node config node with its front like the server does, it returns the port
+func startNode(t *testing.T, node string, decoy bool) int {
+	t.Helper()
+	return startGuardedNode(t, node, decoy, nil)
+}
+
+// startGuardedNode run the node like startNode, the front rejects the sources banned by tracker if it is set
+func startGuardedNode(t *testing.T, node string, decoy bool, tracker *reputation.Tracker) int {
+	t.Helper()
+	port := freePort(t)
+	var nodeInfo NodeConfig
+	if err := json.Unmarshal([]byte(fmt.Sprintf(node, port)), &nodeInfo); err != nil {
+		t.Fatal(err)
+	}
+	// a short dir, the unix socket paths are limited
+	dir, err := os.MkdirTemp("", "front")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	pair := testPair(t)
+	config := &Config{Cert: &CertConfig{CertPEM: pair.CertPEM, KeyPEM: pair.KeyPEM}, FrontDir: dir, Decoy: decoy, Guard: tracker != nil}
+	inboundConfig, err := buildInbound(config, &nodeInfo, "vmess_test", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := front.PrepareDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	instance, err := core.New(&core.Config{
+		App: []*serial.TypedMessage{
+			serial.ToTypedMessage(&dispatcher.Config{}),
+			serial.ToTypedMessage(&proxyman.InboundConfig{}),
+			serial.ToTypedMessage(&proxyman.OutboundConfig{}),
+		},
+		Inbound:  []*core.InboundHandlerConfig{inboundConfig.InboundHandlerConfig},
+		Outbound: []*core.OutboundHandlerConfig{{ProxySettings: serial.ToTypedMessage(&freedom.Config{})}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := instance.GetFeature(inbound.ManagerType()).(inbound.Manager).GetHandler(context.Background(), "vmess_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userManager, err := handlerUserManager(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addUsersTo(userManager, buildUser("vmess_test", []User{{User: api.User{ID: 1, UUID: testUUID}}})); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = instance.Close() })
+	var sources front.Sources
+	if tracker != nil {
+		sources = tracker
+	}
+	if inboundConfig.Front != nil {
+		store := &cert.Store{}
+		if err := store.Set(pair); err != nil {
+			t.Fatal(err)
+		}
+		f, err := front.New(inboundConfig.Front, nil, sources, store, testSite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = f.Close() })
+	}
+	return port
+}
+
+// vmessEcho send a line through a vmess client with streamSettings to the node on port and return the echo
+func vmessEcho(t *testing.T, port int, streamSettings string) (string, error) {
+	t.Helper()
+	client, err := confserial.LoadJSONConfig(strings.NewReader(fmt.Sprintf(`{"log":{"loglevel":"none"},"outbounds":[{
+		"protocol":"vmess",
+		"settings":{"vnext":[{"address":"127.0.0.1","port":%d,"users":[{"id":"%s"}]}]},
+		"streamSettings":%s}]}`, port, testUUID, streamSettings)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := core.New(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+	echo := echoServer(t)
+	conn, err := core.Dial(context.Background(), instance, xnet.TCPDestination(xnet.IPAddress(echo.IP), xnet.Port(echo.Port)))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		return "", err
+	}
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func TestInboundVMess(t *testing.T) {
+	const tlsSettings = `"security":"tls","tlsSettings":{"serverName":"node.test","allowInsecure":true}`
+	for _, test := range []struct {
+		name   string
+		node   string
+		decoy  bool
+		stream string
+	}{
+		{"tcp", `{"server_port":%d,"tls":1,"network":"tcp"}`, false, `{"network":"tcp",` + tlsSettings + `}`},
+		{"tcp with decoy", `{"server_port":%d,"tls":1,"network":"tcp"}`, true, `{"network":"tcp",` + tlsSettings + `}`},
+		{"ws", `{"server_port":%d,"tls":1,"network":"ws","ws_settings":{"path":"/ws"}}`, true,
+			`{"network":"ws","wsSettings":{"path":"/ws"},` + tlsSettings + `}`},
+		{"ws early data", `{"server_port":%d,"tls":1,"network":"ws","ws_settings":{"path":"/ws?ed=2048"}}`, true,
+			`{"network":"ws","wsSettings":{"path":"/ws?ed=2048"},` + tlsSettings + `}`},
+		{"h2", `{"server_port":%d,"tls":1,"network":"h2","h2_config":{"path":"/h2","host":["node.test"]}}`, true,
+			`{"network":"h2","httpSettings":{"path":"/h2","host":["node.test"]},` + tlsSettings + `}`},
+		{"grpc", `{"server_port":%d,"tls":1,"network":"grpc","grpc_settings":{"serviceName":"gs"}}`, true,
+			`{"network":"grpc","grpcSettings":{"serviceName":"gs"},` + tlsSettings + `}`},
+		{"grpc multi", `{"server_port":%d,"tls":1,"network":"grpc","grpc_settings":{"serviceName":"gs"}}`, true,
+			`{"network":"grpc","grpcSettings":{"serviceName":"gs","multiMode":true},` + tlsSettings + `}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			port := startNode(t, test.node, test.decoy)
+			echo, err := vmessEcho(t, port, test.stream)
+			if err != nil || echo != "hello" {
+				t.Errorf("echo %q, %v through the inbound, want hello", echo, err)
+			}
+		})
+	}
+}
+
+// probe send a request for path to the node on port over TLS with h2 or HTTP/1.1 and return the body of the answer
+func probe(t *testing.T, port int, useH2 bool, method string, path string, contentType string) string {
+	t.Helper()
+	tlsConfig := &tls.Config{ServerName: "node.test", InsecureSkipVerify: true}
+	var transport http.RoundTripper = &http.Transport{TLSClientConfig: tlsConfig}
+	if useH2 {
+		transport = &http2.Transport{TLSClientConfig: tlsConfig}
+	}
+	request, err := http.NewRequest(method, fmt.Sprintf("https://node.test:%d%s", port, path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if useH2 {
+		transport.(*http2.Transport).DialTLSContext = func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+			return tls.DialWithDialer(dialer, "tcp", fmt.Sprintf("127.0.0.1:%d", port), config)
+		}
+	} else {
+		transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		}
+	}
+	response, err := (&http.Client{Transport: transport, Timeout: 5 * time.Second}).Do(request)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, path, err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	return string(body)
+}
+
+func TestInboundDecoy(t *testing.T) {
+	ws := startNode(t, `{"server_port":%d,"tls":1,"network":"ws","ws_settings":{"path":"/ws"}}`, true)
+	for _, path := range []string{"/", "/ws"} {
+		if body := probe(t, ws, false, http.MethodGet, path, ""); body != "site" {
+			t.Errorf("ws probe %s answered %q, want the site", path, body)
+		}
+	}
+	if body := probe(t, ws, true, http.MethodGet, "/", ""); body != "site" {
+		t.Errorf("ws probe over h2 answered %q, want the site", body)
+	}
+
+	h2 := startNode(t, `{"server_port":%d,"tls":1,"network":"h2","h2_config":{"path":"/h2","host":["node.test"]}}`, true)
+	for _, path := range []string{"/", "/other"} {
+		if body := probe(t, h2, true, http.MethodGet, path, ""); body != "site" {
+			t.Errorf("h2 probe %s answered %q, want the site", path, body)
+		}
+	}
+
+	grpc := startNode(t, `{"server_port":%d,"tls":1,"network":"grpc","grpc_settings":{"serviceName":"gs"}}`, true)
+	for _, test := range [][2]string{{"/gs/Other", "application/grpc"}, {"/gs/Tun", "text/plain"}, {"/", ""}} {
+		if body := probe(t, grpc, true, http.MethodPost, test[0], test[1]); body != "site" {
+			t.Errorf("grpc probe %s %s answered %q, want the site", test[0], test[1], body)
+		}
+	}
+}
+
+func TestInboundFrontTLS(t *testing.T) {
+	dial := func(port int, config *tls.Config) (*tls.Conn, error) {
+		return tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", fmt.Sprintf("127.0.0.1:%d", port), config)
+	}
+
+	// the h2 and grpc inbounds speak h2 only
+	for _, node := range []string{
+		`{"server_port":%d,"tls":1,"network":"h2","h2_config":{"path":"/h2","host":["node.test"]}}`,
+		`{"server_port":%d,"tls":1,"network":"grpc","grpc_settings":{"serviceName":"gs"}}`,
+	} {
+		port := startNode(t, node, true)
+		conn, err := dial(port, &tls.Config{ServerName: "node.test", InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proto := conn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+			t.Errorf("alpn %q, want h2", proto)
+		}
+		conn.Close()
+	}
+
+	port := startNode(t, `{"server_port":%d,"tls":1,"network":"ws","ws_settings":{"path":"/ws"},
+		"tls_settings":{"minVersion":"1.3","rejectUnknownSni":true,"alpn":["http/1.1"]}}`, true)
+	conn, err := dial(port, &tls.Config{ServerName: "node.test", InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := conn.ConnectionState(); state.Version != tls.VersionTLS13 || state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("version %x, alpn %q, want the TLS 1.3 and http/1.1 of the settings", state.Version, state.NegotiatedProtocol)
+	}
+	conn.Close()
+	if conn, err := dial(port, &tls.Config{ServerName: "node.test", InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}); err == nil {
+		conn.Close()
+		t.Error("TLS 1.2 handshake succeeded with minVersion 1.3")
+	}
+	if conn, err := dial(port, &tls.Config{ServerName: "other.test", InsecureSkipVerify: true}); err == nil {
+		conn.Close()
+		t.Error("handshake for a name the certificate doesn't cover succeeded with rejectUnknownSni")
+	}
+}
+
+func TestInboundGuard(t *testing.T) {
+	tracker, err := reputation.New(&reputation.Config{Threshold: 2, Window: time.Minute, BanDuration: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := startGuardedNode(t, `{"server_port":%d,"network":"tcp"}`, false, tracker)
+	if echo, err := vmessEcho(t, port, `{"network":"tcp"}`); err != nil || echo != "hello" {
+		t.Fatalf("echo %q, %v before a ban, want hello", echo, err)
+	}
+	// the log of the client took over as the handler of xray like the one of the server does
+	xlog.RegisterHandler(tracker.Recorder(nil))
+	// the inbound rejects the handshakes, the front the source once it is banned
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = conn.Write(bytes.Repeat([]byte{0x42}, 64))
+		_, _ = io.Copy(io.Discard, conn)
+		_ = conn.Close()
+	}
+	if tracker.Allowed(net.ParseIP("127.0.0.1")) {
+		t.Fatal("not banned after the rejected handshakes")
+	}
+	if echo, err := vmessEcho(t, port, `{"network":"tcp"}`); err == nil {
+		t.Errorf("echo %q from a banned source", echo)
+	}
+}
+
+func TestPortOwner(t *testing.T) {
+	var nodeInfo NodeConfig
+	if err := json.Unmarshal([]byte(`{"server_port":443,"network":"ws","extra_ports":"8443-8445","transports":[
+		{"server_port":2053,"network":"grpc"},{"server_port":80,"network":"kcp"}]}`), &nodeInfo); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{ExtraPorts: "9000,9100-9101"}
+	tests := []struct {
+		port  int
+		owner string
+	}{
+		{443, "the inbound on server_port"},
+		{8444, "the inbound on server_port"},
+		{9101, "the inbound on server_port"},
+		{2053, "transport 1"},
+		// the challenges are tcp, kcp listens on udp
+		{80, ""},
+		{8446, ""},
+	}
+	for _, test := range tests {
+		owner, err := PortOwner(config, &nodeInfo, test.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner != test.owner {
+			t.Errorf("port %d owned by %q, want %q", test.port, owner, test.owner)
+		}
+	}
+	if _, err := PortOwner(&Config{ExtraPorts: "x"}, &nodeInfo, 80); err == nil {
+		t.Error("invalid extra ports accepted")
+	}
+}
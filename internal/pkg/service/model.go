@@ -1,12 +1,22 @@
 package service
 
+import (
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xtls/xray-core/infra/conf"
+)
+
 const (
 	protocol = "vmess"
 	TLS      = "tls"
-	TCP      = "tcp"
-	WS       = "ws"
-	GRPC     = "grpc"
-	H2       = "h2"
+	REALITY  = "reality"
+	// the networks are the names conf.TransportProtocol builds
+	TCP  = "tcp"
+	WS   = "websocket"
+	GRPC = "grpc"
+	H2   = "http"
+	KCP  = "mkcp"
+	QUIC = "quic"
+	DS   = "domainsocket"
 )
 
 // Service is the interface of all the services running in the panel
@@ -18,4 +28,28 @@ type Service interface {
 type CertConfig struct {
 	CertFile string
 	KeyFile  string
+	// CertPEM and KeyPEM are used instead of the files when set, e.g. for certificates issued by ACME
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// NodeConfig is the node config with the fields the panel client doesn't know about
+type NodeConfig struct {
+	api.VMessConfig
+	// TLSCert and TLSKey are the PEM certificate of the node, used instead of the local files when set
+	TLSCert string `json:"tls_cert,omitempty"`
+	TLSKey  string `json:"tls_key,omitempty"`
+	// KcpConfig, QuicConfig and DomainSocketConfig are in the xray config format
+	KcpConfig          *conf.KCPConfig          `json:"kcp_settings,omitempty"`
+	QuicConfig         *conf.QUICConfig         `json:"quic_settings,omitempty"`
+	DomainSocketConfig *conf.DomainSocketConfig `json:"ds_settings,omitempty"`
+	// RealityConfig is used when tls is 2, in the xray config format
+	RealityConfig *conf.REALITYConfig `json:"reality_settings,omitempty"`
+	// ExtraPorts are listened on besides server_port, a port, a range like 20000-20100 or a comma separated list of both
+	ExtraPorts *conf.PortList `json:"extra_ports,omitempty"`
+	// Transports are more inbounds with the users of the node, each one is built from the server_port, extra_ports,
+	// network, tls and the transport settings of its entry
+	Transports []*NodeConfig `json:"transports,omitempty"`
+	// TrafficMultiplier charges the reported traffic by the time and the protocol
+	TrafficMultiplier *Multiplier `json:"traffic_multiplier,omitempty"`
 }
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/xflash-panda/server-vmess/internal/pkg/dispatcher"
+)
+
+// Multiplier is the traffic multiplier of the node config, the traffic is charged at the product of the factors
+// of the rules which match, e.g. a rule of 1.5 for the node and one of 0.5 from 01:00 to 07:00 charge 0.75 at night
+type Multiplier struct {
+	// Timezone is the IANA name of the zone of the windows, the one of the host if empty
+	Timezone string            `json:"timezone,omitempty"`
+	Rules    []*MultiplierRule `json:"rules"`
+
+	location *time.Location
+}
+
+// MultiplierRule matches the traffic in all of its conditions, a condition left empty matches everything
+type MultiplierRule struct {
+	Factor float64 `json:"factor"`
+	// Start and End are the window of the day, HH:MM, a window ending before it starts spans midnight and
+	// one ending when it starts is rejected
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	// Days are the days of the week, 0 is Sunday
+	Days []int `json:"days,omitempty"`
+	// Protocols are the protocol classes of the sniffed traffic, tls, http, quic, bittorrent or unknown
+	Protocols []string `json:"protocols,omitempty"`
+
+	start, end int
+}
+
+// Compile check the rules and parse their windows, it is called once before the multiplier is used
+func (m *Multiplier) Compile() error {
+	m.location = time.Local
+	if m.Timezone != "" {
+		location, err := time.LoadLocation(m.Timezone)
+		if err != nil {
+			return fmt.Errorf("traffic multiplier timezone %s: %s", m.Timezone, err)
+		}
+		m.location = location
+	}
+	for i, rule := range m.Rules {
+		if rule.Factor < 0 {
+			return fmt.Errorf("traffic multiplier rule %d: negative factor %g", i, rule.Factor)
+		}
+		if (rule.Start == "") != (rule.End == "") {
+			return fmt.Errorf("traffic multiplier rule %d: the window needs both start and end", i)
+		}
+		if rule.Start != "" {
+			var err error
+			if rule.start, err = parseClock(rule.Start); err != nil {
+				return fmt.Errorf("traffic multiplier rule %d: %s", i, err)
+			}
+			if rule.end, err = parseClock(rule.End); err != nil {
+				return fmt.Errorf("traffic multiplier rule %d: %s", i, err)
+			}
+			if rule.start == rule.end {
+				return fmt.Errorf("traffic multiplier rule %d: the window from %s to %s is empty, leave both out for the whole day", i, rule.Start, rule.End)
+			}
+		}
+		for _, day := range rule.Days {
+			if day < 0 || day > 6 {
+				return fmt.Errorf("traffic multiplier rule %d: invalid day %d", i, day)
+			}
+		}
+		for _, protocol := range rule.Protocols {
+			if !contains(dispatcher.Classes, protocol) {
+				return fmt.Errorf("traffic multiplier rule %d: protocol %s not supported, use one of %v", i, protocol, dispatcher.Classes)
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock return the minutes of the day of HH:MM
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, use HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ByProtocol report whether a rule depends on the protocol, so the traffic has to be broken down by class
+func (m *Multiplier) ByProtocol() bool {
+	if m == nil {
+		return false
+	}
+	for _, rule := range m.Rules {
+		if len(rule.Protocols) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Factor return the factor of the traffic of class at now
+func (m *Multiplier) Factor(now time.Time, class string) float64 {
+	if m == nil {
+		return 1
+	}
+	now = now.In(m.location)
+	factor := 1.0
+	for _, rule := range m.Rules {
+		if rule.matches(now, class) {
+			factor *= rule.Factor
+		}
+	}
+	return factor
+}
+
+func (r *MultiplierRule) matches(now time.Time, class string) bool {
+	if r.Start != "" {
+		minute := now.Hour()*60 + now.Minute()
+		if r.start <= r.end && (minute < r.start || minute >= r.end) {
+			return false
+		}
+		if r.start > r.end && minute < r.start && minute >= r.end {
+			return false
+		}
+	}
+	if len(r.Days) > 0 {
+		matched := false
+		for _, day := range r.Days {
+			if time.Weekday(day) == now.Weekday() {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return len(r.Protocols) == 0 || contains(r.Protocols, class)
+}
+
+// Charge return the upload and the download to report for the bytes relayed at now, classTraffic is
+// their breakdown when a rule depends on the protocol, the bytes it misses are charged as unknown
+func (m *Multiplier) Charge(now time.Time, upload uint64, download uint64, classTraffic []*ClassTraffic) (uint64, uint64) {
+	if m == nil || len(m.Rules) == 0 {
+		return upload, download
+	}
+	var up, down float64
+	var classUp, classDown uint64
+	if m.ByProtocol() {
+		for _, traffic := range classTraffic {
+			factor := m.Factor(now, traffic.Class)
+			up += float64(traffic.Upload) * factor
+			down += float64(traffic.Download) * factor
+			classUp += traffic.Upload
+			classDown += traffic.Download
+		}
+	}
+	factor := m.Factor(now, dispatcher.ClassUnknown)
+	if upload > classUp {
+		up += float64(upload-classUp) * factor
+	}
+	if download > classDown {
+		down += float64(download-classDown) * factor
+	}
+	return uint64(math.Round(up)), uint64(math.Round(down))
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/dispatcher"
+	"github.com/xtls/xray-core/app/stats"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	statsFeature "github.com/xtls/xray-core/features/stats"
+)
+
+// friday is 2024-01-05, a Friday, at hh:mm UTC
+func friday(hh, mm int) time.Time {
+	return time.Date(2024, 1, 5, hh, mm, 0, 0, time.UTC)
+}
+
+func compile(t *testing.T, m *Multiplier) *Multiplier {
+	t.Helper()
+	if m.Timezone == "" {
+		m.Timezone = "UTC"
+	}
+	if err := m.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMultiplierCompile(t *testing.T) {
+	tests := []struct {
+		rule *MultiplierRule
+		err  string
+	}{
+		{&MultiplierRule{Factor: 2, Start: "01:00", End: "07:00", Days: []int{0, 6}, Protocols: []string{"bittorrent"}}, ""},
+		{&MultiplierRule{Factor: 0.5, Start: "22:00", End: "06:00"}, ""},
+		{&MultiplierRule{Factor: -1}, "negative factor"},
+		{&MultiplierRule{Factor: 1, Start: "01:00"}, "needs both start and end"},
+		{&MultiplierRule{Factor: 1, Start: "01:00", End: "25:00"}, "invalid time"},
+		{&MultiplierRule{Factor: 1, Start: "1am", End: "07:00"}, "invalid time"},
+		{&MultiplierRule{Factor: 1, Start: "08:00", End: "08:00"}, "is empty"},
+		{&MultiplierRule{Factor: 1, Start: "00:00", End: "00:00"}, "is empty"},
+		{&MultiplierRule{Factor: 1, Days: []int{7}}, "invalid day"},
+		{&MultiplierRule{Factor: 1, Protocols: []string{"ftp"}}, "not supported"},
+	}
+	for _, test := range tests {
+		err := (&Multiplier{Rules: []*MultiplierRule{test.rule}}).Compile()
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("rule %+v compiled with %v, want %q", test.rule, err, test.err)
+		}
+	}
+	if err := (&Multiplier{Timezone: "Mars/Olympus"}).Compile(); err == nil {
+		t.Error("unknown timezone accepted")
+	}
+}
+
+func TestMultiplierFactor(t *testing.T) {
+	night := &MultiplierRule{Factor: 0.5, Start: "22:00", End: "06:00"}
+	day := &MultiplierRule{Factor: 2, Start: "09:00", End: "17:30"}
+	weekend := &MultiplierRule{Factor: 0, Days: []int{0, 6}}
+	bittorrent := &MultiplierRule{Factor: 3, Protocols: []string{dispatcher.ClassBitTorrent}}
+	node := &MultiplierRule{Factor: 1.5}
+	tests := []struct {
+		name  string
+		rules []*MultiplierRule
+		now   time.Time
+		class string
+		want  float64
+	}{
+		{"window start", []*MultiplierRule{day}, friday(9, 0), dispatcher.ClassTLS, 2},
+		{"window end", []*MultiplierRule{day}, friday(17, 30), dispatcher.ClassTLS, 1},
+		{"window last minute", []*MultiplierRule{day}, friday(17, 29), dispatcher.ClassTLS, 2},
+		{"before window", []*MultiplierRule{day}, friday(8, 59), dispatcher.ClassTLS, 1},
+		{"midnight span evening", []*MultiplierRule{night}, friday(23, 59), dispatcher.ClassTLS, 0.5},
+		{"midnight span midnight", []*MultiplierRule{night}, friday(0, 0), dispatcher.ClassTLS, 0.5},
+		{"midnight span morning", []*MultiplierRule{night}, friday(5, 59), dispatcher.ClassTLS, 0.5},
+		{"midnight span end", []*MultiplierRule{night}, friday(6, 0), dispatcher.ClassTLS, 1},
+		{"midnight span day", []*MultiplierRule{night}, friday(21, 59), dispatcher.ClassTLS, 1},
+		{"weekday", []*MultiplierRule{weekend}, friday(12, 0), dispatcher.ClassTLS, 1},
+		{"saturday", []*MultiplierRule{weekend}, friday(12, 0).AddDate(0, 0, 1), dispatcher.ClassTLS, 0},
+		{"sunday", []*MultiplierRule{weekend}, friday(12, 0).AddDate(0, 0, 2), dispatcher.ClassTLS, 0},
+		{"protocol", []*MultiplierRule{bittorrent}, friday(12, 0), dispatcher.ClassBitTorrent, 3},
+		{"other protocol", []*MultiplierRule{bittorrent}, friday(12, 0), dispatcher.ClassUnknown, 1},
+		{"product", []*MultiplierRule{node, night, bittorrent}, friday(23, 0), dispatcher.ClassBitTorrent, 2.25},
+		{"product outside window", []*MultiplierRule{node, night, bittorrent}, friday(12, 0), dispatcher.ClassBitTorrent, 4.5},
+		{"no rules", nil, friday(12, 0), dispatcher.ClassTLS, 1},
+	}
+	for _, test := range tests {
+		m := compile(t, &Multiplier{Rules: test.rules})
+		if got := m.Factor(test.now, test.class); got != test.want {
+			t.Errorf("%s: factor %g, want %g", test.name, got, test.want)
+		}
+	}
+	if got := (*Multiplier)(nil).Factor(friday(12, 0), dispatcher.ClassTLS); got != 1 {
+		t.Errorf("factor of no multiplier %g, want 1", got)
+	}
+}
+
+func TestMultiplierTimezone(t *testing.T) {
+	m := compile(t, &Multiplier{Timezone: "Asia/Shanghai", Rules: []*MultiplierRule{{Factor: 0.5, Start: "01:00", End: "07:00", Days: []int{6}}}})
+	// 18:00 on Friday in UTC is 02:00 on Saturday in Shanghai
+	if got := m.Factor(friday(18, 0), dispatcher.ClassTLS); got != 0.5 {
+		t.Errorf("factor %g at night in the zone of the windows, want 0.5", got)
+	}
+	if got := m.Factor(friday(2, 0), dispatcher.ClassTLS); got != 1 {
+		t.Errorf("factor %g at night in UTC, want 1", got)
+	}
+}
+
+func TestMultiplierCharge(t *testing.T) {
+	byProtocol := []*MultiplierRule{{Factor: 0.5, Protocols: []string{dispatcher.ClassTLS}}, {Factor: 2, Protocols: []string{dispatcher.ClassUnknown}}}
+	tests := []struct {
+		name             string
+		multiplier       *Multiplier
+		upload, download uint64
+		classTraffic     []*ClassTraffic
+		wantUp, wantDown uint64
+	}{
+		{"no multiplier", nil, 1000, 2000, nil, 1000, 2000},
+		{"no rules", &Multiplier{}, 1000, 2000, nil, 1000, 2000},
+		{"node factor", &Multiplier{Rules: []*MultiplierRule{{Factor: 1.5}}}, 1000, 2001, nil, 1500, 3002},
+		{"free", &Multiplier{Rules: []*MultiplierRule{{Factor: 0}}}, 1000, 2000, nil, 0, 0},
+		{"by class", &Multiplier{Rules: byProtocol}, 1000, 2000, []*ClassTraffic{
+			{Class: dispatcher.ClassTLS, Network: "tcp", Upload: 600, Download: 1000},
+			{Class: dispatcher.ClassUnknown, Network: "udp", Upload: 400, Download: 1000},
+		}, 1100, 2500},
+		// the bytes the breakdown misses are charged as unknown
+		{"by class missing", &Multiplier{Rules: byProtocol}, 1000, 2000, []*ClassTraffic{
+			{Class: dispatcher.ClassTLS, Network: "tcp", Upload: 600, Download: 1000},
+		}, 1100, 2500},
+		{"by class without breakdown", &Multiplier{Rules: byProtocol}, 1000, 2000, nil, 2000, 4000},
+		{"large", &Multiplier{Rules: []*MultiplierRule{{Factor: 0.1}}}, 1 << 50, 1 << 40, nil, 112589990684262, 109951162778},
+	}
+	for _, test := range tests {
+		m := test.multiplier
+		if m != nil {
+			m = compile(t, m)
+		}
+		up, down := m.Charge(friday(12, 0), test.upload, test.download, test.classTraffic)
+		if up != test.wantUp || down != test.wantDown {
+			t.Errorf("%s: charged %d and %d, want %d and %d", test.name, up, down, test.wantUp, test.wantDown)
+		}
+	}
+}
+
+// statsBuilder return a builder of the users with the stats of an instance which isn't started
+func statsBuilder(t *testing.T, users []User) (*Builder, statsFeature.Manager) {
+	t.Helper()
+	instance, err := core.New(&core.Config{App: []*serial.TypedMessage{serial.ToTypedMessage(&stats.Config{})}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Builder{instance: instance, config: &Config{}, inboundTags: []string{"vmess_test"}, userList: &users}
+	return b, instance.GetFeature(statsFeature.ManagerType()).(statsFeature.Manager)
+}
+
+func addCounter(t *testing.T, manager statsFeature.Manager, name string, value int64) {
+	t.Helper()
+	counter := manager.GetCounter(name)
+	if counter == nil {
+		var err error
+		if counter, err = manager.RegisterCounter(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counter.Add(value)
+}
+
+func TestCollectTrafficRaw(t *testing.T) {
+	b, manager := statsBuilder(t, []User{{User: api.User{ID: 1, UUID: "uuid-1"}}, {User: api.User{ID: 2, UUID: "uuid-2"}}})
+	b.multiplier = compile(t, &Multiplier{Rules: []*MultiplierRule{{Factor: 0.5, Protocols: []string{dispatcher.ClassBitTorrent}}}})
+	email := buildUserEmail("vmess_test", 1, "uuid-1")
+	addCounter(t, manager, "user>>>"+email+">>>traffic>>>uplink", 1000)
+	addCounter(t, manager, "user>>>"+email+">>>traffic>>>downlink", 3000)
+	addCounter(t, manager, "user>>>"+email+">>>request>>>count", 2)
+	addCounter(t, manager, dispatcher.BreakdownCounterName(email, dispatcher.ClassBitTorrent, "tcp", "uplink"), 600)
+	addCounter(t, manager, dispatcher.BreakdownCounterName(email, dispatcher.ClassBitTorrent, "tcp", "downlink"), 2000)
+
+	traffic, breakdown := b.collectTraffic(friday(12, 0))
+	if len(traffic) != 1 {
+		t.Fatalf("traffic of %d users, want the one with traffic", len(traffic))
+	}
+	want := UserTraffic{UserTraffic: api.UserTraffic{UID: 1, Upload: 700, Download: 2000, Count: 2}, RawUpload: 1000, RawDownload: 3000}
+	if *traffic[0] != want {
+		t.Errorf("traffic %+v, want %+v", *traffic[0], want)
+	}
+	if len(breakdown) != 1 || len(breakdown[0].Traffic) != 1 || breakdown[0].Traffic[0].Upload != 600 {
+		t.Errorf("breakdown %+v, want the bittorrent traffic", breakdown)
+	}
+	// the counters are taken
+	if traffic, _ := b.collectTraffic(friday(12, 1)); len(traffic) != 0 {
+		t.Errorf("traffic %+v collected twice", traffic)
+	}
+}
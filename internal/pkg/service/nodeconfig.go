@@ -0,0 +1,77 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+
+	api "github.com/xflash-panda/server-client/pkg"
+)
+
+// UnmarshalNodeConfig parse the config response of the panel
+func UnmarshalNodeConfig(data []byte) (*NodeConfig, error) {
+	resp := api.RespConfig{
+		Data: &NodeConfig{},
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("parse node config failed: %s", err)
+	}
+	if len(resp.Message) > 0 {
+		return nil, fmt.Errorf("api error, message: %s", resp.Message)
+	}
+	return resp.Data.(*NodeConfig), nil
+}
+
+// HasCert report whether the panel delivered the certificate of the node
+func (n *NodeConfig) HasCert() bool {
+	return n.TLSCert != "" && n.TLSKey != ""
+}
+
+// Security return the security of the inbound, tls is 1 for TLS and 2 for REALITY
+func (n *NodeConfig) Security() string {
+	switch n.TLS {
+	case 0:
+		return ""
+	case 2:
+		return REALITY
+	default:
+		return TLS
+	}
+}
+
+// Inbounds return the node config of the inbound on server_port and the ones of the transports
+func (n *NodeConfig) Inbounds() []*NodeConfig {
+	return append([]*NodeConfig{n}, n.Transports...)
+}
+
+// UsesSecurity report whether the inbound on server_port or one of the transports uses security
+func (n *NodeConfig) UsesSecurity(security string) bool {
+	for _, inbound := range n.Inbounds() {
+		if inbound.Security() == security {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerName return the server name of the first TLS inbound, the certificate is shared by all of them
+func (n *NodeConfig) ServerName() string {
+	for _, inbound := range n.Inbounds() {
+		if inbound.Security() == TLS && inbound.TlsConfig != nil && inbound.TlsConfig.ServerName != "" {
+			return inbound.TlsConfig.ServerName
+		}
+	}
+	return ""
+}
+
+// ProxyProtocol report whether the inbound on server_port accepts the PROXY protocol, by the flag or the transport settings of the node
+func ProxyProtocol(config *Config, nodeInfo *NodeConfig) bool {
+	return config.ProxyProtocol || nodeInfo.acceptsProxyProtocol()
+}
+
+// acceptsProxyProtocol report whether the transport settings accept the PROXY protocol
+func (n *NodeConfig) acceptsProxyProtocol() bool {
+	if n.TcpConfig != nil && n.TcpConfig.AcceptProxyProtocol {
+		return true
+	}
+	return n.WebSocketConfig != nil && n.WebSocketConfig.AcceptProxyProtocol
+}
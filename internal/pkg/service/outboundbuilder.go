@@ -9,7 +9,7 @@ import (
 )
 
 // OutboundBuilder build freedom outbund config for addoutbound
-func OutboundBuilder(nodeInfo *api.VMessConfig) (*core.OutboundHandlerConfig, error) {
+func OutboundBuilder(config *Config, nodeInfo *api.VMessConfig) (*core.OutboundHandlerConfig, error) {
 	outboundDetourConfig := &conf.OutboundDetourConfig{}
 	outboundDetourConfig.Protocol = "freedom"
 	outboundDetourConfig.Tag = fmt.Sprintf("%s_%d", protocol, nodeInfo.ServerPort)
@@ -27,6 +27,11 @@ func OutboundBuilder(nodeInfo *api.VMessConfig) (*core.OutboundHandlerConfig, er
 		return nil, fmt.Errorf("marshal proxy %s config fialed: %s", protocol, err)
 	}
 	outboundDetourConfig.Settings = &setting
+	if config.Sockopt != nil {
+		if socketSettings := config.Sockopt.Outbound(); socketSettings != nil {
+			outboundDetourConfig.StreamSetting = &conf.StreamConfig{SocketSettings: socketSettings}
+		}
+	}
 	return outboundDetourConfig.Build()
 }
 
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+// headerTypes are the packet headers of mKCP and QUIC, each one is linked in internal/pkg/dep
+var headerTypes = []string{"none", "srtp", "utp", "wechat-video", "dtls", "wireguard", "dns"}
+
+// quicSecurities are the packet encryptions of QUIC
+var quicSecurities = []string{"none", "aes-128-gcm", "chacha20-poly1305"}
+
+// securityNetworks lists the transports of the securities which don't work with every one
+var securityNetworks = map[string][]string{
+	REALITY: {TCP, H2, GRPC, DS},
+}
+
+// validateTransport reject the transport settings xray would refuse or fail on once listening
+func validateTransport(networkType string, security string, nodeInfo *NodeConfig) error {
+	if networks, ok := securityNetworks[security]; ok && !contains(networks, networkType) {
+		return fmt.Errorf("security %s doesn't work with network %s, use one of %s", security, nodeInfo.Network, strings.Join(networks, ", "))
+	}
+	if security == REALITY {
+		if err := validateReality(nodeInfo.RealityConfig); err != nil {
+			return err
+		}
+	}
+
+	switch networkType {
+	case KCP:
+		if nodeInfo.KcpConfig != nil {
+			if err := validateHeader("kcp_settings", nodeInfo.KcpConfig.HeaderConfig); err != nil {
+				return err
+			}
+		}
+	case QUIC:
+		if nodeInfo.QuicConfig != nil {
+			if err := validateHeader("quic_settings", nodeInfo.QuicConfig.Header); err != nil {
+				return err
+			}
+			security := strings.ToLower(nodeInfo.QuicConfig.Security)
+			if security != "" && !contains(quicSecurities, security) {
+				return fmt.Errorf("quic_settings security %s not supported, use one of %s", nodeInfo.QuicConfig.Security, strings.Join(quicSecurities, ", "))
+			}
+			if security != "" && security != "none" && nodeInfo.QuicConfig.Key == "" {
+				return fmt.Errorf("quic_settings security %s requires a key", security)
+			}
+		}
+	case DS:
+		if nodeInfo.DomainSocketConfig == nil || nodeInfo.DomainSocketConfig.Path == "" {
+			return fmt.Errorf("network %s requires ds_settings with a path", nodeInfo.Network)
+		}
+	}
+	return nil
+}
+
+func validateHeader(settings string, header json.RawMessage) error {
+	if len(header) == 0 {
+		return nil
+	}
+	var h struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return fmt.Errorf("%s header invalid: %s", settings, err)
+	}
+	if h.Type != "" && !contains(headerTypes, h.Type) {
+		return fmt.Errorf("%s header type %s not supported, use one of %s", settings, h.Type, strings.Join(headerTypes, ", "))
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateReality check the settings the node must supply, xray checks the format of each
+func validateReality(config *conf.REALITYConfig) error {
+	if config == nil {
+		return fmt.Errorf("security %s requires reality_settings", REALITY)
+	}
+	if len(config.Dest) == 0 {
+		return fmt.Errorf("reality_settings requires a dest")
+	}
+	if len(config.ServerNames) == 0 {
+		return fmt.Errorf("reality_settings requires serverNames")
+	}
+	if config.PrivateKey == "" {
+		return fmt.Errorf("reality_settings requires a privateKey, generate one with reality-keygen")
+	}
+	if len(config.ShortIds) == 0 {
+		return fmt.Errorf("reality_settings requires shortIds, generate them with reality-keygen")
+	}
+	return nil
+}
@@ -2,13 +2,12 @@ package service
 
 import (
 	"fmt"
-	api "github.com/xflash-panda/server-client/pkg"
 	cProtocol "github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
 	"github.com/xtls/xray-core/infra/conf"
 )
 
-func buildUser(tag string, userInfo []api.User) (users []*cProtocol.User) {
+func buildUser(tag string, userInfo []User) (users []*cProtocol.User) {
 	users = make([]*cProtocol.User, len(userInfo))
 	for i, user := range userInfo {
 		vMessAccount := &conf.VMessAccount{
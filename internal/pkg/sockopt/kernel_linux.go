@@ -0,0 +1,66 @@
+package sockopt
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// validateKernel set each option on a probe socket, the way xray sets them on the real ones
+func validateKernel(c *Config) error {
+	if c.TCPFastOpen {
+		if err := validateFastOpen(); err != nil {
+			return err
+		}
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("create probe socket failed: %s", err)
+	}
+	defer unix.Close(fd)
+
+	if c.Congestion != "" {
+		if err := unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, c.Congestion); err != nil {
+			available, _ := os.ReadFile("/proc/sys/net/ipv4/tcp_available_congestion_control")
+			return fmt.Errorf("tcp congestion %s not supported: %s, available: %s", c.Congestion, err, strings.TrimSpace(string(available)))
+		}
+	}
+	if c.Mark > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, c.Mark); err != nil {
+			return fmt.Errorf("socket mark not allowed: %s, it requires CAP_NET_ADMIN", err)
+		}
+	}
+	if c.UserTimeout > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(c.UserTimeout.Milliseconds())); err != nil {
+			return fmt.Errorf("tcp user timeout not supported: %s", err)
+		}
+	}
+	for _, iface := range []string{c.ListenInterface, c.OutboundInterface} {
+		if iface == "" {
+			continue
+		}
+		if err := unix.BindToDevice(fd, iface); err != nil {
+			return fmt.Errorf("bind to interface %s not allowed: %s", iface, err)
+		}
+	}
+	return nil
+}
+
+// validateFastOpen require both the client and the server bits of net.ipv4.tcp_fastopen
+func validateFastOpen() error {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		return fmt.Errorf("read tcp_fastopen failed: %s", err)
+	}
+	value, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("parse tcp_fastopen failed: %s", err)
+	}
+	if value&3 != 3 {
+		return fmt.Errorf("tcp fast open is disabled by the kernel (net.ipv4.tcp_fastopen = %d), set it to 3", value)
+	}
+	return nil
+}
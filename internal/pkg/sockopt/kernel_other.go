@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sockopt
+
+import "errors"
+
+func validateKernel(c *Config) error {
+	if c.TCPFastOpen || c.Congestion != "" || c.Mark > 0 || c.UserTimeout > 0 || c.ListenInterface != "" || c.OutboundInterface != "" {
+		return errors.New("socket options are only supported on linux")
+	}
+	return nil
+}
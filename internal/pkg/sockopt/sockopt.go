@@ -0,0 +1,99 @@
+// Package sockopt tunes the sockets of the inbound and the freedom outbound
+package sockopt
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+type Config struct {
+	// Listen is the inbound address, all addresses when empty
+	Listen            string
+	ListenInterface   string
+	OutboundInterface string
+	TCPFastOpen       bool
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	UserTimeout       time.Duration
+	Congestion        string
+	Mark              int
+}
+
+// Inbound return the socket settings of the inbound, nil if nothing is tuned
+func (c *Config) Inbound() *conf.SocketConfig {
+	return c.build(c.ListenInterface)
+}
+
+// Outbound return the socket settings of the freedom outbound, nil if nothing is tuned
+func (c *Config) Outbound() *conf.SocketConfig {
+	return c.build(c.OutboundInterface)
+}
+
+func (c *Config) build(iface string) *conf.SocketConfig {
+	socket := &conf.SocketConfig{
+		Mark:                 int32(c.Mark),
+		TCPKeepAliveIdle:     int32(c.KeepAliveIdle / time.Second),
+		TCPKeepAliveInterval: int32(c.KeepAliveInterval / time.Second),
+		TCPUserTimeout:       int32(c.UserTimeout / time.Millisecond),
+		TCPCongestion:        c.Congestion,
+		Interface:            iface,
+	}
+	if c.TCPFastOpen {
+		socket.TFO = true
+	}
+	if *socket == (conf.SocketConfig{}) {
+		return nil
+	}
+	return socket
+}
+
+// Validate check the values against the running kernel, so a setting it ignores or refuses fails the start
+func (c *Config) Validate() error {
+	if c.Listen != "" {
+		if err := validateListen(c.Listen); err != nil {
+			return err
+		}
+	}
+	if c.Mark < 0 {
+		return fmt.Errorf("invalid socket mark %d", c.Mark)
+	}
+	if c.KeepAliveIdle < 0 || c.KeepAliveInterval < 0 || c.UserTimeout < 0 {
+		return fmt.Errorf("socket timeouts must not be negative")
+	}
+	if c.KeepAliveIdle%time.Second != 0 || c.KeepAliveInterval%time.Second != 0 {
+		return fmt.Errorf("tcp keepalive is set in whole seconds")
+	}
+	for _, iface := range []string{c.ListenInterface, c.OutboundInterface} {
+		if iface == "" {
+			continue
+		}
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return fmt.Errorf("interface %s: %s", iface, err)
+		}
+	}
+	return validateKernel(c)
+}
+
+// validateListen accept the unspecified address or one of the local addresses
+func validateListen(listen string) error {
+	ip := net.ParseIP(listen)
+	if ip == nil {
+		return fmt.Errorf("listen address %s is not an ip address", listen)
+	}
+	if ip.IsUnspecified() {
+		return nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("list interface addresses failed: %s", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("listen address %s is not assigned to this host", listen)
+}
@@ -0,0 +1,165 @@
+// Package standalone reads the node and its users from a local file instead of the panel
+// and appends the traffic to a local ledger
+package standalone
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	log "github.com/sirupsen/logrus"
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/backend"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+	"github.com/xtls/xray-core/common/uuid"
+)
+
+// File is the schema of the file, node has the fields of the node config of the panel and users the ones of its users
+type File struct {
+	Node  json.RawMessage `json:"node"`
+	Users []service.User  `json:"users"`
+}
+
+// Entry is a line of the ledger
+type Entry struct {
+	Time    string `json:"time"`
+	NodeID  int    `json:"node_id"`
+	BatchID uint64 `json:"batch_id"`
+	*service.UserTraffic
+}
+
+type Backend struct {
+	access sync.Mutex
+	path   string
+	ledger string
+	// modTime and size tell whether the file changed since the users were read
+	modTime time.Time
+	size    int64
+	node    []byte
+}
+
+// New return the backend of the file at path, json or yaml, which appends the traffic to ledger
+func New(path string, ledger string) *Backend {
+	return &Backend{path: path, ledger: ledger}
+}
+
+// load read and check the file
+func (b *Backend) load() (*File, os.FileInfo, error) {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("standalone file unavailable: %s", err)
+	}
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read standalone file failed: %s", err)
+	}
+	if ext := strings.ToLower(filepath.Ext(b.path)); ext == ".yaml" || ext == ".yml" {
+		if data, err = yaml.YAMLToJSON(data); err != nil {
+			return nil, nil, fmt.Errorf("parse standalone file %s failed: %s", b.path, err)
+		}
+	}
+	file := &File{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, nil, fmt.Errorf("parse standalone file %s failed: %s", b.path, err)
+	}
+	if len(file.Node) == 0 {
+		return nil, nil, fmt.Errorf("standalone file %s has no node", b.path)
+	}
+	ids := make(map[int]bool, len(file.Users))
+	for _, user := range file.Users {
+		if ids[user.ID] {
+			return nil, nil, fmt.Errorf("standalone file %s: user id %d is used twice", b.path, user.ID)
+		}
+		ids[user.ID] = true
+		if _, err := uuid.ParseString(user.UUID); err != nil {
+			return nil, nil, fmt.Errorf("standalone file %s: user %d has an invalid uuid: %s", b.path, user.ID, err)
+		}
+	}
+	return file, info, nil
+}
+
+// Config return the node config of the file, a change of it takes a restart
+func (b *Backend) Config(nodeId api.NodeId, nodeType api.NodeType) (*service.NodeConfig, error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	file, _, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+	nodeConfig := &service.NodeConfig{}
+	if err := json.Unmarshal(file.Node, nodeConfig); err != nil {
+		return nil, fmt.Errorf("parse node of standalone file failed: %s", err)
+	}
+	b.node = file.Node
+	return nodeConfig, nil
+}
+
+// Users return the users of the file, api.ErrorUserNotModified if it didn't change since the last call
+func (b *Backend) Users(nodeId api.NodeId, nodeType api.NodeType) (*[]service.User, error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return nil, fmt.Errorf("standalone file unavailable: %s", err)
+	}
+	if info.ModTime().Equal(b.modTime) && info.Size() == b.size {
+		return nil, api.ErrorUserNotModified
+	}
+	file, info, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+	if b.node != nil && !bytes.Equal(file.Node, b.node) {
+		log.Warnln("node of the standalone file changed, restart to apply it")
+		b.node = file.Node
+	}
+	b.modTime, b.size = info.ModTime(), info.Size()
+	users := file.Users
+	return &users, nil
+}
+
+// Submit append the traffic to the ledger, one json line for each user
+func (b *Backend) Submit(nodeId api.NodeId, nodeType api.NodeType, batch *service.TrafficBatch) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, traffic := range batch.Traffic {
+		if err := encoder.Encode(&Entry{Time: now, NodeID: int(nodeId), BatchID: batch.ID, UserTraffic: traffic}); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(b.ledger), 0700); err != nil {
+		return fmt.Errorf("create ledger dir failed: %s", err)
+	}
+	f, err := os.OpenFile(b.ledger, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open ledger failed: %s", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write ledger failed: %s", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("sync ledger failed: %s", err)
+	}
+	return f.Close()
+}
+
+func (b *Backend) SubmitOnline(nodeId api.NodeId, nodeType api.NodeType, onlineUsers []*backend.OnlineUser) error {
+	return backend.ErrUnsupported
+}
+
+func (b *Backend) SubmitStatus(nodeId api.NodeId, nodeType api.NodeType, status *backend.Status) error {
+	return backend.ErrUnsupported
+}
+
+func (b *Backend) SubmitBreakdown(nodeId api.NodeId, nodeType api.NodeType, breakdown []*service.UserBreakdown) error {
+	return backend.ErrUnsupported
+}
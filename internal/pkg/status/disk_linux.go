@@ -0,0 +1,21 @@
+package status
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// supported is true as the host has /proc and statfs
+const supported = true
+
+// diskUsage return the total and the used bytes of the file system of path, the blocks reserved for root count as used
+func diskUsage(path string) (total uint64, used uint64, err error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, 0, fmt.Errorf("statfs %s failed: %s", path, err)
+	}
+	total = stat.Blocks * uint64(stat.Bsize)
+	used = (stat.Blocks - stat.Bavail) * uint64(stat.Bsize)
+	return total, used, nil
+}
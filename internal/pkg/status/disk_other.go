@@ -0,0 +1,10 @@
+//go:build !linux
+
+package status
+
+// supported is false as the state is read from /proc and statfs
+const supported = false
+
+func diskUsage(path string) (total uint64, used uint64, err error) {
+	return 0, 0, ErrUnsupported
+}
@@ -0,0 +1,217 @@
+// Package status reads the state of the host from /proc, without cgo
+package status
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrUnsupported is returned by Collect on the hosts other than linux
+var ErrUnsupported = errors.New("the host status is only read on linux")
+
+// System is the state of the host
+type System struct {
+	// CPU, Mem and Disk are used percents
+	CPU       float64
+	Mem       float64
+	MemTotal  uint64
+	MemUsed   uint64
+	Disk      float64
+	DiskTotal uint64
+	DiskUsed  uint64
+	Load      [3]float64
+	Uptime    uint64
+}
+
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+// Collector reads the files under procRoot, /proc unless a fixture, and the usage of the file system of diskPath
+type Collector struct {
+	access   sync.Mutex
+	procRoot string
+	diskPath string
+	// last is the cpu times of the previous collection, the cpu usage is the one between two collections
+	last *cpuTimes
+}
+
+func NewCollector(procRoot string, diskPath string) *Collector {
+	if procRoot == "" {
+		procRoot = "/proc"
+	}
+	if diskPath == "" {
+		diskPath = "/"
+	}
+	return &Collector{procRoot: procRoot, diskPath: diskPath}
+}
+
+// Collect return the state of the host, the cpu usage of the first call is the one since the boot
+func (c *Collector) Collect() (*System, error) {
+	if !supported {
+		return nil, ErrUnsupported
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	system := &System{}
+	times, err := c.readCPU()
+	if err != nil {
+		return nil, err
+	}
+	system.CPU = cpuUsage(c.last, times)
+	c.last = times
+	if system.MemTotal, system.MemUsed, err = c.readMem(); err != nil {
+		return nil, err
+	}
+	system.Mem = percent(system.MemUsed, system.MemTotal)
+	if system.Load, err = c.readLoad(); err != nil {
+		return nil, err
+	}
+	if system.Uptime, err = c.readUptime(); err != nil {
+		return nil, err
+	}
+	if system.DiskTotal, system.DiskUsed, err = diskUsage(c.diskPath); err != nil {
+		return nil, err
+	}
+	system.Disk = percent(system.DiskUsed, system.DiskTotal)
+	return system, nil
+}
+
+func (c *Collector) read(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(c.procRoot, name))
+	if err != nil {
+		return nil, fmt.Errorf("read %s failed: %s", name, err)
+	}
+	return data, nil
+}
+
+// readCPU read the aggregated cpu line of stat, the idle time includes iowait
+func (c *Collector) readCPU() (*cpuTimes, error) {
+	data, err := c.read("stat")
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		times := &cpuTimes{}
+		for i, field := range fields[1:] {
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parse stat failed: %s", err)
+			}
+			// guest and guest_nice are already counted in user and nice
+			if i < 8 {
+				times.total += value
+			}
+			// idle and iowait
+			if i == 3 || i == 4 {
+				times.idle += value
+			}
+		}
+		return times, nil
+	}
+	return nil, fmt.Errorf("parse stat failed: no cpu line")
+}
+
+func cpuUsage(last *cpuTimes, now *cpuTimes) float64 {
+	if last == nil || now.total <= last.total || now.idle < last.idle {
+		last = &cpuTimes{}
+	}
+	total := now.total - last.total
+	if total == 0 {
+		return 0
+	}
+	return float64(total-(now.idle-last.idle)) / float64(total) * 100
+}
+
+// readMem return the total and the used memory in bytes, the memory which is not available counts as used
+func (c *Collector) readMem() (total uint64, used uint64, err error) {
+	data, err := c.read("meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("parse meminfo failed: %s", err)
+		}
+		// the values are in kB
+		values[key] = value * 1024
+	}
+	total, ok := values["MemTotal"]
+	if !ok || total == 0 {
+		return 0, 0, fmt.Errorf("parse meminfo failed: no MemTotal")
+	}
+	available, ok := values["MemAvailable"]
+	if !ok {
+		// kernels before 3.14
+		available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	if available > total {
+		available = total
+	}
+	return total, total - available, nil
+}
+
+func (c *Collector) readLoad() (load [3]float64, err error) {
+	data, err := c.read("loadavg")
+	if err != nil {
+		return load, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return load, fmt.Errorf("parse loadavg failed: %q", data)
+	}
+	for i := range load {
+		if load[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return load, fmt.Errorf("parse loadavg failed: %s", err)
+		}
+	}
+	return load, nil
+}
+
+// readUptime return the seconds since the boot
+func (c *Collector) readUptime() (uint64, error) {
+	data, err := c.read("uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("parse uptime failed: %q", data)
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse uptime failed: %s", err)
+	}
+	return uint64(uptime), nil
+}
+
+func percent(used uint64, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(used) / float64(total) * 100
+}
@@ -0,0 +1,155 @@
+package status
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// procRoot return a proc root with the fixtures of testdata, by the name of the proc file
+func procRoot(t *testing.T, fixtures map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, fixture := range fixtures {
+		copyFixture(t, fixture, filepath.Join(root, name))
+	}
+	return root
+}
+
+func copyFixture(t *testing.T, fixture string, path string) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func defaultFixtures() map[string]string {
+	return map[string]string{"stat": "stat", "meminfo": "meminfo", "loadavg": "loadavg", "uptime": "uptime"}
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func skipWithoutDiskUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("disk usage is only supported on linux")
+	}
+}
+
+func TestCollectUnsupported(t *testing.T) {
+	_, err := NewCollector(procRoot(t, defaultFixtures()), t.TempDir()).Collect()
+	if unsupported := errors.Is(err, ErrUnsupported); unsupported != (runtime.GOOS != "linux") {
+		t.Errorf("collect on %s returned %v", runtime.GOOS, err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	skipWithoutDiskUsage(t)
+	system, err := NewCollector(procRoot(t, defaultFixtures()), t.TempDir()).Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1500 of 10000 jiffies busy since the boot, iowait counts as idle
+	if !almostEqual(system.CPU, 15) {
+		t.Errorf("cpu %v, want 15", system.CPU)
+	}
+	if system.MemTotal != 2048000*1024 || system.MemUsed != 1024000*1024 {
+		t.Errorf("memory %d of %d, want %d of %d", system.MemUsed, system.MemTotal, 1024000*1024, 2048000*1024)
+	}
+	if !almostEqual(system.Mem, 50) {
+		t.Errorf("mem %v, want 50", system.Mem)
+	}
+	if system.Load != [3]float64{0.52, 0.58, 0.59} {
+		t.Errorf("load %v, want [0.52 0.58 0.59]", system.Load)
+	}
+	if system.Uptime != 12345 {
+		t.Errorf("uptime %d, want 12345", system.Uptime)
+	}
+	if system.DiskTotal == 0 || system.DiskUsed > system.DiskTotal {
+		t.Errorf("disk %d of %d", system.DiskUsed, system.DiskTotal)
+	}
+}
+
+func TestCollectCPUDelta(t *testing.T) {
+	skipWithoutDiskUsage(t)
+	root := procRoot(t, defaultFixtures())
+	c := NewCollector(root, t.TempDir())
+	if _, err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+	copyFixture(t, "stat_next", filepath.Join(root, "stat"))
+	system, err := c.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1600 jiffies passed, 700 of them idle or iowait, the guest time is already in user
+	if !almostEqual(system.CPU, 56.25) {
+		t.Errorf("cpu %v between the collections, want 56.25", system.CPU)
+	}
+
+	// counters going back, e.g. a restored snapshot, give the usage since the boot again
+	copyFixture(t, "stat", filepath.Join(root, "stat"))
+	if system, err = c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+	if !almostEqual(system.CPU, 15) {
+		t.Errorf("cpu %v after the counters went back, want 15", system.CPU)
+	}
+}
+
+func TestReadMemWithoutAvailable(t *testing.T) {
+	c := NewCollector(procRoot(t, map[string]string{"meminfo": "meminfo_old"}), "")
+	total, used, err := c.readMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// MemFree, Buffers and Cached are available before MemAvailable exists
+	if total != 2048000*1024 || used != 512000*1024 {
+		t.Errorf("memory %d of %d, want %d of %d", used, total, 512000*1024, 2048000*1024)
+	}
+}
+
+func TestCollectMissingFile(t *testing.T) {
+	fixtures := defaultFixtures()
+	delete(fixtures, "loadavg")
+	if _, err := NewCollector(procRoot(t, fixtures), t.TempDir()).Collect(); err == nil {
+		t.Error("missing loadavg returned no error")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"stat":    "intr 1 2 3\n",
+		"meminfo": "MemFree: 100 kB\n",
+		"loadavg": "0.5\n",
+		"uptime":  "\n",
+	} {
+		root := t.TempDir()
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		c := NewCollector(root, "")
+		var err error
+		switch name {
+		case "stat":
+			_, err = c.readCPU()
+		case "meminfo":
+			_, _, err = c.readMem()
+		case "loadavg":
+			_, err = c.readLoad()
+		case "uptime":
+			_, err = c.readUptime()
+		}
+		if err == nil {
+			t.Errorf("%s %q parsed without an error", name, content)
+		}
+	}
+}
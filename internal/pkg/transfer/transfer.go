@@ -0,0 +1,331 @@
+// Package transfer accounts the bytes of the inbounds and the outbounds of the node over the month
+// and enforces the transfer cap of a metered provider
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xflash-panda/server-vmess/internal/pkg/metrics"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/features/stats"
+	"golang.org/x/time/rate"
+)
+
+// what the node does once the cap is reached
+const (
+	ActionAlert    = "alert"
+	ActionStop     = "stop"
+	ActionThrottle = "throttle"
+)
+
+// collectInterval is how often the counters of xray are moved into the totals and the totals saved
+const collectInterval = 10 * time.Second
+
+// warnPercents are the shares of the cap warned about, each one once a period
+var warnPercents = []int{80, 90, 100}
+
+type Config struct {
+	// Cap is the bytes the node may transfer in a period, unit: GB, 0 for no cap
+	Cap int
+	// ResetDay is the day of the month a period starts on, 1 to 28
+	ResetDay int
+	Action   string
+	// ThrottleRate is the rate of the whole node once throttled, both directions together, unit: KB/s
+	ThrottleRate int
+}
+
+// Usage is the bytes of the period, the inbounds count the connections of the users and the outbounds
+// the ones to the destinations, both directions of both make the transfer
+type Usage struct {
+	PeriodStart      time.Time `json:"period_start"`
+	InboundUplink    uint64    `json:"inbound_uplink"`
+	InboundDownlink  uint64    `json:"inbound_downlink"`
+	OutboundUplink   uint64    `json:"outbound_uplink"`
+	OutboundDownlink uint64    `json:"outbound_downlink"`
+}
+
+func (u *Usage) total() uint64 {
+	return u.InboundUplink + u.InboundDownlink + u.OutboundUplink + u.OutboundDownlink
+}
+
+// Status is the usage of the period against the cap
+type Status struct {
+	Usage
+	Total     uint64    `json:"total"`
+	Cap       uint64    `json:"cap"`
+	NextReset time.Time `json:"next_reset"`
+	Action    string    `json:"action"`
+	Capped    bool      `json:"capped"`
+}
+
+// Clock is the time of a meter
+type Clock interface {
+	Now() time.Time
+	// Sleep wait for d, it fails once ctx is done
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type visitor interface {
+	VisitCounters(func(string, stats.Counter) bool)
+}
+
+type Meter struct {
+	access   sync.Mutex
+	config   *Config
+	stats    stats.Manager
+	path     string
+	cap      uint64
+	usage    *Usage
+	warned   int
+	capped   atomic.Bool
+	limiter  *rate.Limiter
+	clock    Clock
+	periodic *task.Periodic
+	// saveFailed keeps a failing save from being logged at each collection
+	saveFailed bool
+}
+
+// New return the meter of the counters of m, the totals of the period are kept in the file at path
+func New(config *Config, m stats.Manager, path string) (*Meter, error) {
+	if config.Cap < 0 {
+		return nil, fmt.Errorf("invalid transfer cap %d", config.Cap)
+	}
+	if config.ResetDay < 1 || config.ResetDay > 28 {
+		return nil, fmt.Errorf("invalid transfer cap reset day %d, use 1 to 28", config.ResetDay)
+	}
+	meter := &Meter{config: config, stats: m, path: path, cap: uint64(config.Cap) << 30, clock: systemClock{}}
+	switch config.Action {
+	case ActionAlert, ActionStop:
+	case ActionThrottle:
+		if config.ThrottleRate <= 0 {
+			return nil, fmt.Errorf("invalid transfer cap throttle rate %d", config.ThrottleRate)
+		}
+		limit := config.ThrottleRate << 10
+		meter.limiter = rate.NewLimiter(rate.Limit(limit), limit)
+	default:
+		return nil, fmt.Errorf("transfer cap action %s not supported, use one of %s, %s, %s", config.Action, ActionAlert, ActionStop, ActionThrottle)
+	}
+	if _, ok := m.(visitor); !ok {
+		return nil, errors.New("the stats manager can't list its counters")
+	}
+	usage, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	meter.usage = usage
+	return meter, nil
+}
+
+func load(path string) (*Usage, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Usage{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read transfer usage failed: %s", err)
+	}
+	usage := &Usage{}
+	if err := json.Unmarshal(data, usage); err != nil {
+		return nil, fmt.Errorf("parse transfer usage %s failed: %s", path, err)
+	}
+	return usage, nil
+}
+
+// save replace the file by a rename, so a crash never leaves half of it
+func (m *Meter) save() error {
+	data, err := json.Marshal(m.usage)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return fmt.Errorf("create transfer usage dir failed: %s", err)
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write %s failed: %s", tmp, err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("rename %s failed: %s", tmp, err)
+	}
+	return nil
+}
+
+// SetClock replace the clock of the periods and the throttle, it must be called before Start
+func (m *Meter) SetClock(clock Clock) {
+	m.clock = clock
+}
+
+func (m *Meter) Start() error {
+	m.periodic = &task.Periodic{
+		Interval: collectInterval,
+		Execute: func() error {
+			err := m.collect()
+			if err != nil && !m.saveFailed {
+				log.Errorf("transfer usage not saved, it is kept in memory: %s", err)
+			}
+			m.saveFailed = err != nil
+			return nil
+		},
+	}
+	return m.periodic.Start()
+}
+
+// Close save the bytes counted since the last collection
+func (m *Meter) Close() error {
+	if m.periodic != nil {
+		if err := m.periodic.Close(); err != nil {
+			return err
+		}
+	}
+	return m.collect()
+}
+
+// periodStart return the start of the period of now, at midnight of the reset day
+func periodStart(now time.Time, resetDay int) time.Time {
+	start := time.Date(now.Year(), now.Month(), resetDay, 0, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// collect move the counters of the inbounds and the outbounds into the totals of the period and the node metrics
+func (m *Meter) collect() error {
+	m.access.Lock()
+	defer m.access.Unlock()
+	now := m.clock.Now()
+	if start := periodStart(now, m.config.ResetDay); !m.usage.PeriodStart.Equal(start) {
+		if !m.usage.PeriodStart.IsZero() {
+			log.Infof("transfer period from %s ended with %d bytes, new period from %s",
+				m.usage.PeriodStart.Format(time.DateOnly), m.usage.total(), start.Format(time.DateOnly))
+		}
+		m.usage = &Usage{PeriodStart: start}
+		m.warned = 0
+		if m.capped.Swap(false) {
+			log.Infoln("transfer cap lifted")
+		}
+	}
+	// the counters are registered after the visit, which holds the lock of the manager
+	deltas := make(map[string]int64)
+	m.stats.(visitor).VisitCounters(func(name string, counter stats.Counter) bool {
+		// inbound>>>tag>>>traffic>>>uplink
+		parts := strings.Split(name, ">>>")
+		if len(parts) != 4 || parts[2] != "traffic" || (parts[0] != "inbound" && parts[0] != "outbound") {
+			return true
+		}
+		if delta := counter.Set(0); delta > 0 {
+			deltas[name] = delta
+		}
+		return true
+	})
+	for name, delta := range deltas {
+		parts := strings.Split(name, ">>>")
+		metrics.Counter(m.stats, parts[0], parts[1], parts[3]).Add(delta)
+		switch parts[0] + ">>>" + parts[3] {
+		case "inbound>>>uplink":
+			m.usage.InboundUplink += uint64(delta)
+		case "inbound>>>downlink":
+			m.usage.InboundDownlink += uint64(delta)
+		case "outbound>>>uplink":
+			m.usage.OutboundUplink += uint64(delta)
+		case "outbound>>>downlink":
+			m.usage.OutboundDownlink += uint64(delta)
+		}
+	}
+	m.enforce()
+	return m.save()
+}
+
+// enforce warn as the usage gets near the cap and apply the action once it is reached
+func (m *Meter) enforce() {
+	if m.cap == 0 {
+		return
+	}
+	total := m.usage.total()
+	for _, percent := range warnPercents {
+		if percent > m.warned && total >= m.cap/100*uint64(percent) {
+			m.warned = percent
+			log.Warnf("transfer reached %d%% of the cap, %d of %d bytes", percent, total, m.cap)
+		}
+	}
+	if total >= m.cap && !m.capped.Swap(true) {
+		switch m.config.Action {
+		case ActionStop:
+			log.Warnln("transfer cap reached, new connections are refused until the period resets")
+		case ActionThrottle:
+			log.Warnf("transfer cap reached, the node is throttled to %d KB/s until the period resets", m.config.ThrottleRate)
+		}
+	}
+}
+
+// Blocked return whether new links are refused
+func (m *Meter) Blocked() bool {
+	return m.config.Action == ActionStop && m.capped.Load()
+}
+
+// Wait block until n bytes may pass, it returns at once unless the node is throttled
+func (m *Meter) Wait(ctx context.Context, n int) error {
+	if m.limiter == nil || !m.capped.Load() {
+		return nil
+	}
+	burst := m.limiter.Burst()
+	for n > 0 {
+		chunk := n
+		if chunk > burst {
+			chunk = burst
+		}
+		now := m.clock.Now()
+		reservation := m.limiter.ReserveN(now, chunk)
+		if err := m.clock.Sleep(ctx, reservation.DelayFrom(now)); err != nil {
+			reservation.CancelAt(m.clock.Now())
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// Status return the usage of the period
+func (m *Meter) Status() *Status {
+	m.access.Lock()
+	defer m.access.Unlock()
+	start := periodStart(m.clock.Now(), m.config.ResetDay)
+	return &Status{
+		Usage:     *m.usage,
+		Total:     m.usage.total(),
+		Cap:       m.cap,
+		NextReset: start.AddDate(0, 1, 0),
+		Action:    m.config.Action,
+		Capped:    m.capped.Load(),
+	}
+}
@@ -0,0 +1,225 @@
+package transfer
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/app/stats"
+	statsFeature "github.com/xtls/xray-core/features/stats"
+)
+
+// clock is a fake clock, sleeping moves it forward at once
+type clock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.now = c.now.Add(d)
+	c.slept += d
+	return nil
+}
+
+// newMeter return a meter of config with the fake clock at 2024-01-10, its usage kept in path
+func newMeter(t *testing.T, config *Config, path string) (*Meter, statsFeature.Manager, *clock) {
+	t.Helper()
+	manager, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "transfer.json")
+	}
+	meter, err := New(config, manager, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &clock{now: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)}
+	meter.SetClock(c)
+	return meter, manager, c
+}
+
+func add(t *testing.T, manager statsFeature.Manager, name string, value int64) {
+	t.Helper()
+	counter, err := statsFeature.GetOrRegisterCounter(manager, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter.Add(value)
+}
+
+func TestNew(t *testing.T) {
+	manager, err := stats.NewManager(context.Background(), &stats.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "transfer.json")
+	tests := []struct {
+		config *Config
+		m      statsFeature.Manager
+		valid  bool
+	}{
+		{&Config{Cap: 1, ResetDay: 1, Action: ActionStop}, manager, true},
+		{&Config{Cap: 1, ResetDay: 28, Action: ActionThrottle, ThrottleRate: 64}, manager, true},
+		{&Config{Cap: -1, ResetDay: 1, Action: ActionStop}, manager, false},
+		{&Config{Cap: 1, ResetDay: 0, Action: ActionStop}, manager, false},
+		{&Config{Cap: 1, ResetDay: 29, Action: ActionStop}, manager, false},
+		{&Config{Cap: 1, ResetDay: 1, Action: "drop"}, manager, false},
+		{&Config{Cap: 1, ResetDay: 1, Action: ActionThrottle}, manager, false},
+		// the counters can't be listed
+		{&Config{Cap: 1, ResetDay: 1, Action: ActionStop}, statsFeature.NoopManager{}, false},
+	}
+	for _, test := range tests {
+		if _, err := New(test.config, test.m, path); (err == nil) != test.valid {
+			t.Errorf("config %+v valid %t, want %t: %v", *test.config, err == nil, test.valid, err)
+		}
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	tests := []struct {
+		now      time.Time
+		resetDay int
+		start    time.Time
+	}{
+		{time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC), 1, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC), 10, time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC), 15, time.Date(2023, 12, 15, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), 28, time.Date(2024, 2, 28, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if start := periodStart(test.now, test.resetDay); !start.Equal(test.start) {
+			t.Errorf("period of %s reset on %d starts %s, want %s", test.now, test.resetDay, start, test.start)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transfer.json")
+	meter, manager, _ := newMeter(t, &Config{ResetDay: 1, Action: ActionAlert}, path)
+	add(t, manager, "inbound>>>vmess>>>traffic>>>uplink", 1)
+	add(t, manager, "inbound>>>vmess>>>traffic>>>downlink", 2)
+	add(t, manager, "outbound>>>direct>>>traffic>>>uplink", 4)
+	add(t, manager, "outbound>>>direct>>>traffic>>>downlink", 8)
+	// the users are counted by the inbounds already
+	add(t, manager, "user>>>vmess|1|uuid>>>traffic>>>uplink", 16)
+	if err := meter.collect(); err != nil {
+		t.Fatal(err)
+	}
+	add(t, manager, "inbound>>>vmess>>>traffic>>>uplink", 32)
+	if err := meter.collect(); err != nil {
+		t.Fatal(err)
+	}
+
+	status := meter.Status()
+	want := Usage{PeriodStart: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), InboundUplink: 33, InboundDownlink: 2, OutboundUplink: 4, OutboundDownlink: 8}
+	if status.Usage != want || status.Total != 47 {
+		t.Errorf("usage %+v, total %d, want %+v", status.Usage, status.Total, want)
+	}
+	if !status.NextReset.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("next reset %s, want 2024-02-01", status.NextReset)
+	}
+	if c := manager.GetCounter("node>>>inbound>>>vmess>>>uplink"); c == nil || c.Value() != 33 {
+		t.Error("traffic of the inbound not counted into the node metrics")
+	}
+
+	// the usage of the period is kept over a restart
+	meter, _, _ = newMeter(t, &Config{ResetDay: 1, Action: ActionAlert}, path)
+	if status := meter.Status(); status.Usage != want {
+		t.Errorf("usage %+v loaded, want %+v", status.Usage, want)
+	}
+}
+
+func TestCapStop(t *testing.T) {
+	meter, manager, c := newMeter(t, &Config{Cap: 1, ResetDay: 15, Action: ActionStop}, "")
+	add(t, manager, "inbound>>>vmess>>>traffic>>>downlink", 1<<30-1)
+	if err := meter.collect(); err != nil {
+		t.Fatal(err)
+	}
+	if meter.Blocked() {
+		t.Fatal("blocked under the cap")
+	}
+	add(t, manager, "outbound>>>direct>>>traffic>>>uplink", 1)
+	if err := meter.collect(); err != nil {
+		t.Fatal(err)
+	}
+	if !meter.Blocked() || !meter.Status().Capped {
+		t.Fatal("not blocked at the cap")
+	}
+	if err := meter.Wait(context.Background(), 1<<20); err != nil || c.slept != 0 {
+		t.Errorf("stopped node waited %s, %v", c.slept, err)
+	}
+
+	// the cap is lifted once the period resets
+	c.now = time.Date(2024, 1, 14, 23, 59, 59, 0, time.UTC)
+	if err := meter.collect(); err != nil {
+		t.Fatal(err)
+	}
+	if !meter.Blocked() {
+		t.Fatal("cap lifted before the period resets")
+	}
+	c.now = time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	if err := meter.collect(); err != nil {
+		t.Fatal(err)
+	}
+	if status := meter.Status(); meter.Blocked() || status.Total != 0 || !status.PeriodStart.Equal(c.now) {
+		t.Errorf("status %+v once the period reset, want the cap lifted and no usage", status)
+	}
+}
+
+func TestCapAlert(t *testing.T) {
+	meter, manager, _ := newMeter(t, &Config{Cap: 1, ResetDay: 1, Action: ActionAlert}, "")
+	add(t, manager, "inbound>>>vmess>>>traffic>>>downlink", 2<<30)
+	if err := meter.collect(); err != nil {
+		t.Fatal(err)
+	}
+	if meter.Blocked() {
+		t.Error("blocked by an alert")
+	}
+	if status := meter.Status(); !status.Capped {
+		t.Error("cap reached not reported")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	meter, manager, c := newMeter(t, &Config{Cap: 1, ResetDay: 1, Action: ActionThrottle, ThrottleRate: 1}, "")
+	ctx := context.Background()
+	if err := meter.Wait(ctx, 1<<20); err != nil || c.slept != 0 {
+		t.Fatalf("waited %s, %v under the cap", c.slept, err)
+	}
+	add(t, manager, "inbound>>>vmess>>>traffic>>>downlink", 1<<30)
+	if err := meter.collect(); err != nil {
+		t.Fatal(err)
+	}
+	if meter.Blocked() {
+		t.Error("throttled node blocked")
+	}
+
+	// the burst of a second passes at once, the rest at 1 KB/s
+	if err := meter.Wait(ctx, 1024); err != nil || c.slept != 0 {
+		t.Fatalf("waited %s, %v for the burst", c.slept, err)
+	}
+	if err := meter.Wait(ctx, 3*1024); err != nil || c.slept != 3*time.Second {
+		t.Errorf("waited %s, %v for 3 KB, want 3s", c.slept, err)
+	}
+	// the bytes over the burst are paced in chunks
+	c.slept = 0
+	if err := meter.Wait(ctx, 2500); err != nil || c.slept != 2500*time.Second/1024 {
+		t.Errorf("waited %s, %v for 2500 bytes", c.slept, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := meter.Wait(canceled, 1024); err == nil {
+		t.Error("wait not ended by its context")
+	}
+}
@@ -0,0 +1,224 @@
+// Package webhook receives the user changes the panel pushes, signed with the node token
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	api "github.com/xflash-panda/server-client/pkg"
+	"github.com/xflash-panda/server-vmess/internal/pkg/admin"
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+	"github.com/xtls/xray-core/common/uuid"
+)
+
+const (
+	// Path is where the events are posted
+	Path = "/users"
+	// HeaderTimestamp is the unix time of the request, HeaderSignature the hex HMAC-SHA256 of
+	// the timestamp, a newline and the body, keyed with the node token
+	HeaderTimestamp = "X-Timestamp"
+	HeaderSignature = "X-Signature"
+	// MaxSkew is how far the timestamp may be from now, a signature is accepted once within it
+	MaxSkew = 5 * time.Minute
+	// maxBody bounds the body of a push
+	maxBody = 4 << 20
+)
+
+const (
+	ActionAdd    = "add"
+	ActionUpdate = "update"
+	ActionRemove = "remove"
+)
+
+// Event is a change of a user, remove only needs the id
+type Event struct {
+	Action string `json:"action"`
+	ID     int    `json:"id"`
+	UUID   string `json:"uuid"`
+	// ConnLimit and ConnRate are the limits of an added or updated user, 0 for the default of the node
+	ConnLimit int `json:"conn_limit,omitempty"`
+	ConnRate  int `json:"conn_rate,omitempty"`
+}
+
+// Push is the body of a request
+type Push struct {
+	Events []Event `json:"events"`
+}
+
+type Config struct {
+	// Listen is the address of the endpoint, empty to disable it
+	Listen string
+	// CertFile and KeyFile serve the endpoint over TLS, the uuids are credentials
+	CertFile string
+	KeyFile  string
+}
+
+// Apply add or replace upserted and remove the users of removedIDs
+type Apply func(upserted []service.User, removedIDs []int) error
+
+type Server struct {
+	config *Config
+	secret []byte
+	apply  Apply
+	server *http.Server
+	access sync.Mutex
+	// seen holds the signatures accepted within MaxSkew
+	seen map[string]time.Time
+}
+
+// New return the endpoint which verifies the pushes with secret and hands them to apply
+func New(config *Config, secret string, apply Apply) (*Server, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("webhook requires the node token to verify the panel")
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("webhook tls requires both the cert file and the key file")
+	}
+	s := &Server{config: config, secret: []byte(secret), apply: apply, seen: make(map[string]time.Time)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(Path, s.serveUsers)
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second, ReadTimeout: 30 * time.Second}
+	return s, nil
+}
+
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.config.Listen)
+	if err != nil {
+		return fmt.Errorf("listen webhook %s failed: %s", s.config.Listen, err)
+	}
+	tls := s.config.CertFile != ""
+	if host, _, err := net.SplitHostPort(s.config.Listen); err == nil && !tls {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			log.Warnf("webhook on %s without tls, the uuids of the users are sent in the clear", s.config.Listen)
+		}
+	}
+	go func() {
+		var err error
+		if tls {
+			err = s.server.ServeTLS(listener, s.config.CertFile, s.config.KeyFile)
+		} else {
+			err = s.server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("webhook server stopped: %s", err)
+		}
+	}()
+	log.Infof("webhook listening on %s", s.config.Listen)
+	return nil
+}
+
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// Sign return the signature of a push, as the panel computes it
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify check the signature and the timestamp and remember the signature against a replay
+func (s *Server) verify(timestamp string, signature string, body []byte) error {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+	now := time.Now()
+	at := time.Unix(unix, 0)
+	if at.Before(now.Add(-MaxSkew)) || at.After(now.Add(MaxSkew)) {
+		return fmt.Errorf("timestamp out of range")
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(s.secret, timestamp, body))) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	s.access.Lock()
+	defer s.access.Unlock()
+	for seen, expire := range s.seen {
+		if now.After(expire) {
+			delete(s.seen, seen)
+		}
+	}
+	if _, ok := s.seen[signature]; ok {
+		return fmt.Errorf("replayed request")
+	}
+	s.seen[signature] = at.Add(MaxSkew)
+	return nil
+}
+
+func (s *Server) serveUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		admin.WriteError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, fmt.Errorf("read body failed: %s", err))
+		return
+	}
+	if err := s.verify(r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderSignature), body); err != nil {
+		log.Warnf("webhook request from %s rejected: %s", r.RemoteAddr, err)
+		admin.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+	push := &Push{}
+	if err := json.Unmarshal(body, push); err != nil {
+		admin.WriteError(w, http.StatusBadRequest, fmt.Errorf("parse body failed: %s", err))
+		return
+	}
+	upserted, removedIDs, err := push.changes()
+	if err != nil {
+		admin.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.apply(upserted, removedIDs); err != nil {
+		log.Errorf("apply pushed users failed: %s", err)
+		admin.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	admin.WriteJSON(w, map[string]int{"upserted": len(upserted), "removed": len(removedIDs)})
+}
+
+// changes turn the events into the users to add or replace and the ids to remove, a user may appear once
+func (p *Push) changes() (upserted []service.User, removedIDs []int, err error) {
+	ids := make(map[int]bool, len(p.Events))
+	for _, event := range p.Events {
+		if ids[event.ID] {
+			return nil, nil, fmt.Errorf("user %d has more than one event", event.ID)
+		}
+		ids[event.ID] = true
+		switch event.Action {
+		case ActionAdd, ActionUpdate:
+			if _, err := uuid.ParseString(event.UUID); err != nil {
+				return nil, nil, fmt.Errorf("%s of user %d has an invalid uuid: %s", event.Action, event.ID, err)
+			}
+			upserted = append(upserted, service.User{
+				User:      api.User{ID: event.ID, UUID: event.UUID},
+				ConnLimit: event.ConnLimit,
+				ConnRate:  event.ConnRate,
+			})
+		case ActionRemove:
+			removedIDs = append(removedIDs, event.ID)
+		default:
+			return nil, nil, fmt.Errorf("action %s of user %d not supported", event.Action, event.ID)
+		}
+	}
+	return upserted, removedIDs, nil
+}
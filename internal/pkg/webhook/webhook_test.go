@@ -0,0 +1,203 @@
+package webhook
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/xflash-panda/server-vmess/internal/pkg/service"
+)
+
+const (
+	testSecret = "node-token"
+	testUUID   = "b831381d-6324-4d53-ad4f-8cda48b30811"
+)
+
+func newServer(t *testing.T, apply Apply) *Server {
+	t.Helper()
+	s, err := New(&Config{Listen: "127.0.0.1:0"}, testSecret, apply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func timestamp(at time.Time) string {
+	return strconv.FormatInt(at.Unix(), 10)
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(&Config{}, "", nil); err == nil {
+		t.Error("webhook accepted without a token")
+	}
+	if _, err := New(&Config{CertFile: "cert.pem"}, testSecret, nil); err == nil {
+		t.Error("webhook accepted with a cert file and no key file")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s := newServer(t, nil)
+	body := []byte(`{"events":[]}`)
+	at := time.Now()
+	now := timestamp(at)
+	sign := func(timestamp string) string {
+		return Sign([]byte(testSecret), timestamp, body)
+	}
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		valid     bool
+	}{
+		{"signed", now, sign(now), true},
+		{"replayed", now, sign(now), false},
+		{"other secret", now, Sign([]byte("other"), now, body), false},
+		{"other body", now, Sign([]byte(testSecret), now, []byte(`{"events":null}`)), false},
+		{"other timestamp", now, sign(timestamp(at.Add(-time.Second))), false},
+		{"no signature", now, "", false},
+		{"no timestamp", "", sign(""), false},
+		{"invalid timestamp", "now", sign("now"), false},
+		{"old", timestamp(at.Add(-MaxSkew - time.Minute)), sign(timestamp(at.Add(-MaxSkew - time.Minute))), false},
+		{"future", timestamp(at.Add(MaxSkew + time.Minute)), sign(timestamp(at.Add(MaxSkew + time.Minute))), false},
+		// a push signed again is a new one
+		{"signed again", timestamp(at.Add(-time.Minute)), sign(timestamp(at.Add(-time.Minute))), true},
+	}
+	for _, test := range tests {
+		if err := s.verify(test.timestamp, test.signature, body); (err == nil) != test.valid {
+			t.Errorf("%s: valid %t, want %t: %v", test.name, err == nil, test.valid, err)
+		}
+	}
+}
+
+func TestVerifyForget(t *testing.T) {
+	s := newServer(t, nil)
+	body := []byte(`{"events":[]}`)
+	at := timestamp(time.Now())
+	if err := s.verify(at, Sign([]byte(testSecret), at, body), body); err != nil {
+		t.Fatal(err)
+	}
+	// the signatures out of the skew are forgotten, their timestamp is rejected already
+	s.seen["expired"] = time.Now().Add(-time.Second)
+	at = timestamp(time.Now().Add(time.Second))
+	if err := s.verify(at, Sign([]byte(testSecret), at, body), body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.seen["expired"]; ok || len(s.seen) != 2 {
+		t.Errorf("%d signatures kept, want the 2 within the skew", len(s.seen))
+	}
+}
+
+func TestChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []Event
+		upserted []int
+		removed  []int
+		valid    bool
+	}{
+		{"empty", nil, nil, nil, true},
+		{"changes", []Event{
+			{Action: ActionAdd, ID: 1, UUID: testUUID, ConnLimit: 2},
+			{Action: ActionUpdate, ID: 2, UUID: testUUID},
+			{Action: ActionRemove, ID: 3},
+		}, []int{1, 2}, []int{3}, true},
+		{"duplicate id", []Event{{Action: ActionAdd, ID: 1, UUID: testUUID}, {Action: ActionRemove, ID: 1}}, nil, nil, false},
+		{"duplicate update", []Event{{Action: ActionUpdate, ID: 1, UUID: testUUID}, {Action: ActionUpdate, ID: 1, UUID: testUUID}}, nil, nil, false},
+		// a short name maps to a uuid, a longer string must be one
+		{"name", []Event{{Action: ActionAdd, ID: 1, UUID: "user-1"}}, []int{1}, nil, true},
+		{"invalid uuid", []Event{{Action: ActionAdd, ID: 1, UUID: "b831381d-6324-4d53-ad4f-8cda48b3081z"}}, nil, nil, false},
+		{"no uuid", []Event{{Action: ActionUpdate, ID: 1}}, nil, nil, false},
+		{"unknown action", []Event{{Action: "block", ID: 1}}, nil, nil, false},
+	}
+	for _, test := range tests {
+		upserted, removed, err := (&Push{Events: test.events}).changes()
+		if (err == nil) != test.valid {
+			t.Errorf("%s: valid %t, want %t: %v", test.name, err == nil, test.valid, err)
+			continue
+		}
+		ids := make([]int, len(upserted))
+		for i, user := range upserted {
+			ids[i] = user.ID
+		}
+		if !equalInts(ids, test.upserted) || !equalInts(removed, test.removed) {
+			t.Errorf("%s: upserted %v, removed %v, want %v, %v", test.name, ids, removed, test.upserted, test.removed)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestServeUsers(t *testing.T) {
+	var upserted []service.User
+	var removed []int
+	var applyErr error
+	s := newServer(t, func(u []service.User, r []int) error {
+		upserted, removed = u, r
+		return applyErr
+	})
+	post := func(body string, sign bool) int {
+		request := httptest.NewRequest(http.MethodPost, Path, bytes.NewBufferString(body))
+		if sign {
+			// each push is a second apart, so its signature is new
+			at := timestamp(time.Now().Add(-time.Duration(len(s.seen)) * time.Second))
+			request.Header.Set(HeaderTimestamp, at)
+			request.Header.Set(HeaderSignature, Sign([]byte(testSecret), at, []byte(body)))
+		}
+		recorder := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	body := `{"events":[{"action":"add","id":1,"uuid":"` + testUUID + `","conn_limit":3},{"action":"remove","id":2}]}`
+	if code := post(body, true); code != http.StatusOK {
+		t.Fatalf("signed push answered %d", code)
+	}
+	if len(upserted) != 1 || upserted[0].ID != 1 || upserted[0].UUID != testUUID || upserted[0].ConnLimit != 3 || !equalInts(removed, []int{2}) {
+		t.Errorf("applied %+v, %v", upserted, removed)
+	}
+
+	upserted, removed = nil, nil
+	tests := []struct {
+		name string
+		body string
+		sign bool
+		code int
+	}{
+		{"unsigned", body, false, http.StatusUnauthorized},
+		{"invalid body", `{"events":`, true, http.StatusBadRequest},
+		{"duplicate id", `{"events":[{"action":"remove","id":2},{"action":"remove","id":2}]}`, true, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if code := post(test.body, test.sign); code != test.code {
+			t.Errorf("%s: answered %d, want %d", test.name, code, test.code)
+		}
+	}
+	if upserted != nil || removed != nil {
+		t.Errorf("rejected push applied: %+v, %v", upserted, removed)
+	}
+
+	applyErr = errors.New("users not fetched yet")
+	if code := post(body, true); code != http.StatusInternalServerError {
+		t.Errorf("push failed to apply answered %d", code)
+	}
+
+	recorder := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, Path, nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("get answered %d", recorder.Code)
+	}
+}